@@ -0,0 +1,81 @@
+// Command rekey re-encrypts the objects under a bucket prefix from an old key to a new key.
+//
+//	rekey -bucket documents -prefix 2024/ -old-secret service.ENCRYPTION_KEY_OLD \
+//		-new-secret service.ENCRYPTION_KEY -checkpoint rekey.json
+//
+// Keys are read from AWS secret manager. An interrupted run resumes from the checkpoint file.
+// Progress is reported to datadog when the statsd environment is configured.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/diptamay/go-commons/crypt"
+	"github.com/diptamay/go-commons/doggie"
+	"github.com/diptamay/go-commons/metrics"
+	"github.com/diptamay/go-commons/rekey"
+	"github.com/diptamay/go-commons/s3buckets"
+	"github.com/diptamay/go-commons/secrets"
+)
+
+func makeKeeper(secretName string) crypt.CryptKeeperInterface {
+	secret, err := secrets.GetSecretsFromAWSSecretManager(secretName)
+	if err != nil {
+		log.Fatalln("error fetching secret", secretName, err)
+	}
+	keeper, err := crypt.MakeCryptKeeper(secret.Value.Reveal())
+	if err != nil {
+		log.Fatalln("error creating keeper from secret", secretName, err)
+	}
+	return keeper
+}
+
+func makeMetrics() metrics.Metrics {
+	client, err := doggie.MakeClient("rekey")
+	if err != nil {
+		log.Println("datadog client is not available, metrics are disabled:", err)
+		return metrics.NewEmptyMetrics()
+	}
+	return metrics.NewMetrics(client, nil)
+}
+
+func main() {
+	bucket := flag.String("bucket", "", "name of the bucket to rekey")
+	prefix := flag.String("prefix", "", "prefix of the objects to rekey")
+	oldSecret := flag.String("old-secret", "", "name of the secret holding the old key")
+	newSecret := flag.String("new-secret", secrets.DetermineSecretName(), "name of the secret holding the new key")
+	checkpoint := flag.String("checkpoint", "rekey-checkpoint.json", "file to record progress in and resume from")
+	localstack := flag.String("localstack", "", "address of localstack, for local runs")
+	flag.Parse()
+	if *bucket == "" || *oldSecret == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cfg := &s3buckets.S3BucketConfig{Name: bucket, S3LocalstackAddress: localstack}
+	s3Bucket, err := s3buckets.MakeBucket(ctx, cfg, makeKeeper(*newSecret))
+	if err != nil {
+		log.Fatalln("error initializing bucket", *bucket, err)
+	}
+	rekeyer := &rekey.Rekeyer{
+		Bucket:         rekey.S3Bucket{Bucket: s3Bucket},
+		Old:            makeKeeper(*oldSecret),
+		CheckpointFile: *checkpoint,
+		Metrics:        makeMetrics(),
+	}
+	result, err := rekeyer.Run(ctx, *prefix)
+	if result != nil {
+		log.Printf("rekeyed %d objects, skipped %d, failed %d, last key %q\n",
+			result.Rekeyed, result.Skipped, len(result.Failed), result.LastKey)
+	}
+	if err != nil {
+		log.Fatalln("rekey did not complete:", err)
+	}
+}
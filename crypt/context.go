@@ -0,0 +1,164 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrInvalidContext  = errors.New("derivation context must be non-empty and at most 65535 bytes")
+	ErrContextMismatch = errors.New("token was encrypted for another derivation context")
+)
+
+// contextKeyCacheSize is the number of parent keys a derived keeper caches subkeys for.
+const contextKeyCacheSize = 64
+
+// deriveContextKey derives the subkey of block for context. The HKDF input keying material is
+// itself derived from block, so that subkeys are independent of the keys used by the
+// deterministic mode and blind indexes.
+func deriveContextKey(block cipher.Block, context string) (cipher.Block, error) {
+	kdf := hkdf.New(sha256.New, deriveSubkey(block, subkeyContextKDF), nil, []byte(context))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return aes.NewCipher(key)
+}
+
+func validateContext(context string) error {
+	if context == "" || len(context) > maxFieldLength {
+		return ErrInvalidContext
+	}
+	return nil
+}
+
+// contextKeyDeriver is implemented by key sources that cache the subkeys they derive.
+type contextKeyDeriver interface {
+	contextKey(block cipher.Block, context string) (cipher.Block, error)
+}
+
+// contextKey returns the subkey of block for context, from the cache of keys if it has one.
+func contextKey(keys keySource, block cipher.Block, context string) (cipher.Block, error) {
+	if deriver, ok := keys.(contextKeyDeriver); ok {
+		return deriver.contextKey(block, context)
+	}
+	return deriveContextKey(block, context)
+}
+
+// contextKeeper is the keeper returned by ForContext. It caches its subkeys by parent key, so
+// that they are derived once rather than on every call.
+type contextKeeper struct {
+	parent  keySource
+	context string
+	mutex   sync.Mutex
+	subkeys map[cipher.Block]cipher.Block
+}
+
+func (keeper *contextKeeper) contextKey(block cipher.Block, context string) (cipher.Block, error) {
+	if context != keeper.context {
+		return deriveContextKey(block, context)
+	}
+	keeper.mutex.Lock()
+	defer keeper.mutex.Unlock()
+	if subkey, ok := keeper.subkeys[block]; ok {
+		return subkey, nil
+	}
+	subkey, err := deriveContextKey(block, context)
+	if err != nil {
+		return nil, err
+	}
+	// Parent keys only change when a keyring rotates, so a full cache is simply started over
+	if len(keeper.subkeys) >= contextKeyCacheSize {
+		keeper.subkeys = map[cipher.Block]cipher.Block{}
+	}
+	keeper.subkeys[block] = subkey
+	return subkey, nil
+}
+
+func (keeper *contextKeeper) sealingKey() (*envelope, cipher.Block, error) {
+	env, block, err := keeper.parent.sealingKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	env.context = keeper.context
+	return env, block, nil
+}
+
+func (keeper *contextKeeper) openingKeys(env *envelope) ([]cipher.Block, error) {
+	if env.context != keeper.context {
+		return nil, fmt.Errorf("%w: %q", ErrContextMismatch, env.context)
+	}
+	return keeper.parent.openingKeys(env)
+}
+
+func (keeper *contextKeeper) Encrypt(toEnc []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, nil)
+}
+
+func (keeper *contextKeeper) EncryptWithAssociatedData(toEnc []byte, associatedData []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, associatedData)
+}
+
+func (keeper *contextKeeper) EncryptPayload(payload *map[string]interface{}, whitelist *[]string) (*map[string]interface{}, error) {
+	return encryptPayload(keeper.Encrypt, payload, whitelist)
+}
+
+func (keeper *contextKeeper) EncryptPayloadWithAssociatedData(payload *map[string]interface{}, whitelist *[]string, associatedData []byte) (*map[string]interface{}, error) {
+	return encryptPayload(bindEncrypt(keeper.EncryptWithAssociatedData, associatedData), payload, whitelist)
+}
+
+func (keeper *contextKeeper) Decrypt(value string) ([]byte, error) {
+	return openEnvelope(keeper, value, nil)
+}
+
+func (keeper *contextKeeper) DecryptWithAssociatedData(value string, associatedData []byte) ([]byte, error) {
+	return openEnvelope(keeper, value, associatedData)
+}
+
+func (keeper *contextKeeper) DecryptPayload(payload *map[string]interface{}) (*map[string]interface{}, error) {
+	return decryptPayload(keeper.Decrypt, payload)
+}
+
+func (keeper *contextKeeper) DecryptPayloadWithAssociatedData(payload *map[string]interface{}, associatedData []byte) (*map[string]interface{}, error) {
+	return decryptPayload(bindDecrypt(keeper.DecryptWithAssociatedData, associatedData), payload)
+}
+
+func (keeper *contextKeeper) EncryptDeterministic(toEnc []byte) (string, error) {
+	return encryptDeterministic(keeper, toEnc)
+}
+
+func (keeper *contextKeeper) DecryptDeterministic(value string) ([]byte, error) {
+	return decryptDeterministic(keeper, value)
+}
+
+func (keeper *contextKeeper) BlindIndex(value []byte) (string, error) {
+	return blindIndex(keeper, value)
+}
+
+func forContext(parent keySource, context string) (CryptKeeperInterface, error) {
+	if err := validateContext(context); err != nil {
+		return nil, err
+	}
+	return &contextKeeper{parent: parent, context: context, subkeys: map[cipher.Block]cipher.Block{}}, nil
+}
+
+// ForContext returns a keeper whose keys are derived from the keys of its parent with HKDF,
+// using context as the HKDF info, so that each tenant or purpose is encrypted under its own
+// subkey. Tokens record their context: the parent keeper decrypts tokens of any context, while
+// the derived keeper only decrypts tokens of its own context.
+func (keeper *CryptKeeper) ForContext(context string) (CryptKeeperInterface, error) {
+	return forContext(keeper, context)
+}
+
+// ForContext returns a keeper that encrypts with a subkey of the active key derived for
+// context, as CryptKeeper.ForContext does. It follows rotations of the keyring.
+func (keeper *KeyringCryptKeeper) ForContext(context string) (CryptKeeperInterface, error) {
+	return forContext(keeper, context)
+}
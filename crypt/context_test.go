@@ -0,0 +1,141 @@
+package crypt
+
+import (
+	"errors"
+	"testing"
+
+	Chance "github.com/ZeFort/chance"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForContext(t *testing.T) {
+	chance := Chance.New()
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	tenant, err := crypter.ForContext("tenant-123")
+	if err != nil {
+		panic(err)
+	}
+	other, err := crypter.ForContext("tenant-456")
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(chance.String())
+	encrypted, err := tenant.Encrypt(toEncrypt)
+	assert.Nil(t, err)
+	env, err := parseToken(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "tenant-123", env.context, "should record the derivation context")
+
+	decrypted, err := tenant.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens of its own context")
+
+	decrypted, err = crypter.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens of any context with the parent keeper")
+
+	_, err = other.Decrypt(encrypted)
+	assert.True(t, errors.Is(err, ErrContextMismatch), "should not decrypt tokens of another context")
+
+	plain, err := crypter.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	_, err = tenant.Decrypt(plain)
+	assert.True(t, errors.Is(err, ErrContextMismatch), "should not decrypt tokens without a context")
+
+	// Re-pointing a token at another context derives another key, so decryption fails.
+	env.context = "tenant-456"
+	repointed, err := env.encode()
+	if err != nil {
+		panic(err)
+	}
+	_, err = other.Decrypt(repointed)
+	assert.NotNil(t, err, "should fail to decrypt a token moved to another context")
+
+	_, err = crypter.ForContext("")
+	assert.True(t, errors.Is(err, ErrInvalidContext), "should reject an empty context")
+}
+
+func TestForContextSubkeys(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	tenant, _ := crypter.ForContext("tenant-123")
+	other, _ := crypter.ForContext("tenant-456")
+	value := []byte(Chance.New().Word())
+
+	tenantIndex, err := tenant.BlindIndex(value)
+	assert.Nil(t, err)
+	otherIndex, err := other.BlindIndex(value)
+	assert.Nil(t, err)
+	rootIndex, err := crypter.BlindIndex(value)
+	assert.Nil(t, err)
+	assert.NotEqual(t, tenantIndex, otherIndex, "should derive a blind index key per context")
+	assert.NotEqual(t, tenantIndex, rootIndex)
+
+	tenantToken, err := tenant.EncryptDeterministic(value)
+	assert.Nil(t, err)
+	otherToken, err := other.EncryptDeterministic(value)
+	assert.Nil(t, err)
+	assert.NotEqual(t, tenantToken, otherToken, "should derive a deterministic key per context")
+	decrypted, err := tenant.DecryptDeterministic(tenantToken)
+	assert.Nil(t, err)
+	assert.Equal(t, value, decrypted)
+}
+
+func TestKeyringForContext(t *testing.T) {
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	tenant, err := keeper.ForContext("tenant-123")
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(Chance.New().Word())
+	before, err := tenant.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	if err := keeper.Rotate(Key{"v2", TestRetiredSecretKey}); err != nil {
+		panic(err)
+	}
+	after, err := tenant.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	env, _ := parseToken(after)
+	assert.Equal(t, "v2", env.keyID, "should follow rotations of the keyring")
+	for _, token := range []string{before, after} {
+		decrypted, err := tenant.Decrypt(token)
+		assert.Nil(t, err)
+		assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens of retired and active keys")
+	}
+}
+
+func TestForContextCachesSubkeys(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	tenant, err := crypter.ForContext("tenant-123")
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 3; i++ {
+		encrypted, err := tenant.Encrypt([]byte("value"))
+		assert.Nil(t, err)
+		_, err = tenant.Decrypt(encrypted)
+		assert.Nil(t, err)
+	}
+	subkeys := tenant.(*contextKeeper).subkeys
+	assert.Len(t, subkeys, 1, "should derive the subkey of a parent key once")
+	expected, err := deriveContextKey(crypter.Cipher, "tenant-123")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, subkeys[crypter.Cipher], "should cache the subkey of the parent key")
+}
@@ -0,0 +1,94 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+// The deterministic mode produces the same token for the same plaintext and key, so encrypted
+// identifiers can be matched exactly, for example with an Elasticsearch term query. It reveals
+// which values are equal and should only be used for fields that need to be searched.
+//
+// Deterministic tokens are envelopes with the AlgorithmAESGCMSyntheticNonce algorithm. The nonce
+// is an HMAC-SHA256 of the header, associated data and plaintext, truncated to the 96 bits of a
+// GCM nonce, and the plaintext is sealed with AES-GCM under that nonce, so a nonce is only ever
+// reused for an identical message. This is a synthetic nonce construction of its own, not
+// AES-GCM-SIV as in RFC 8452. The HMAC and AES keys are derived from the keeper's key, using
+// AES as a PRF, so that they are independent of the key used by the randomized mode.
+//
+// Blind indexes are an alternative when the value does not need to be decrypted from the
+// index: an HMAC-SHA256 of the value under another derived key.
+const (
+	subkeySyntheticIVMAC byte = 1
+	subkeySyntheticIVEnc byte = 2
+	subkeyBlindIndex     byte = 3
+	subkeyContextKDF     byte = 4
+)
+
+var errSyntheticIVMismatch = errors.New("token nonce does not match its plaintext")
+
+// deriveSubkey derives a 256 bit key for purpose from block by encrypting two counter blocks.
+func deriveSubkey(block cipher.Block, purpose byte) []byte {
+	subkey := make([]byte, 2*aes.BlockSize)
+	for i := 0; i < 2; i++ {
+		in := make([]byte, aes.BlockSize)
+		copy(in, "crypt-subkey")
+		in[aes.BlockSize-2] = purpose
+		in[aes.BlockSize-1] = byte(i)
+		block.Encrypt(subkey[i*aes.BlockSize:], in)
+	}
+	return subkey
+}
+
+func syntheticIVKeys(block cipher.Block) ([]byte, cipher.Block, error) {
+	encBlock, err := aes.NewCipher(deriveSubkey(block, subkeySyntheticIVEnc))
+	if err != nil {
+		return nil, nil, err
+	}
+	return deriveSubkey(block, subkeySyntheticIVMAC), encBlock, nil
+}
+
+func syntheticIV(macKey []byte, header []byte, associatedData []byte, plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(header)))
+	mac.Write(length)
+	mac.Write(header)
+	binary.BigEndian.PutUint32(length, uint32(len(associatedData)))
+	mac.Write(length)
+	mac.Write(associatedData)
+	mac.Write(plaintext)
+	return mac.Sum(nil)[:IVSize]
+}
+
+func blindIndexWith(block cipher.Block, value []byte) string {
+	mac := hmac.New(sha256.New, deriveSubkey(block, subkeyBlindIndex))
+	mac.Write(value)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func blindIndex(keys keySource, value []byte) (string, error) {
+	env, block, err := keys.sealingKey()
+	if err != nil {
+		return "", err
+	}
+	if env.context != "" {
+		if block, err = contextKey(keys, block, env.context); err != nil {
+			return "", err
+		}
+	}
+	return blindIndexWith(block, value), nil
+}
+
+func encryptDeterministic(keys keySource, toEnc []byte) (string, error) {
+	return sealEnvelopeAs(keys, AlgorithmAESGCMSyntheticNonce, toEnc, nil)
+}
+
+func decryptDeterministic(keys keySource, value string) ([]byte, error) {
+	return openEnvelopeAs(keys, AlgorithmAESGCMSyntheticNonce, value, nil)
+}
@@ -0,0 +1,110 @@
+package crypt
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	Chance "github.com/ZeFort/chance"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptAndDecryptDeterministic(t *testing.T) {
+	chance := Chance.New()
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(chance.String())
+	first, err := crypter.EncryptDeterministic(toEncrypt)
+	assert.Nil(t, err)
+	second, err := crypter.EncryptDeterministic(toEncrypt)
+	assert.Nil(t, err)
+	assert.Equal(t, first, second, "should produce equal tokens for equal plaintexts")
+
+	other, err := crypter.EncryptDeterministic([]byte(chance.String() + "x"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, other, "should produce different tokens for different plaintexts")
+
+	decrypted, err := crypter.DecryptDeterministic(first)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt deterministic tokens")
+
+	env, err := parseToken(first)
+	assert.Nil(t, err)
+	assert.Equal(t, AlgorithmAESGCMSyntheticNonce, env.algorithm, "should record the deterministic algorithm")
+}
+
+func TestDeterministicModeSeparation(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(Chance.New().Word())
+	deterministic, err := crypter.EncryptDeterministic(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	randomized, err := crypter.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	_, err = crypter.Decrypt(deterministic)
+	assert.True(t, errors.Is(err, ErrModeMismatch), "should not decrypt deterministic tokens with Decrypt")
+	_, err = crypter.DecryptDeterministic(randomized)
+	assert.True(t, errors.Is(err, ErrModeMismatch), "should not decrypt randomized tokens with DecryptDeterministic")
+	_, err = crypter.DecryptDeterministic(legacyEncrypt(crypter.Cipher, toEncrypt))
+	assert.True(t, errors.Is(err, ErrModeMismatch), "should not decrypt legacy tokens with DecryptDeterministic")
+
+	raw, _ := base64.StdEncoding.DecodeString(deterministic)
+	raw[len(raw)-1] ^= 1
+	_, err = crypter.DecryptDeterministic(base64.StdEncoding.EncodeToString(raw))
+	assert.NotNil(t, err, "should detect tampered deterministic tokens")
+}
+
+func TestDeterministicWithKeyring(t *testing.T) {
+	toEncrypt := []byte(Chance.New().Word())
+	old, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	encrypted, err := old.EncryptDeterministic(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	keeper, err := MakeKeyringCryptKeeper(Key{"v2", TestRetiredSecretKey}, Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	decrypted, err := keeper.DecryptDeterministic(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt deterministic tokens of retired keys")
+
+	current, err := keeper.EncryptDeterministic(toEncrypt)
+	assert.Nil(t, err)
+	assert.NotEqual(t, encrypted, current, "should encrypt with the active key")
+}
+
+func TestBlindIndex(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	value := []byte(Chance.New().String())
+	index, err := crypter.BlindIndex(value)
+	assert.Nil(t, err)
+	again, err := crypter.BlindIndex(value)
+	assert.Nil(t, err)
+	assert.Equal(t, index, again, "should produce equal indexes for equal values")
+	other, err := crypter.BlindIndex(append(value, 'x'))
+	assert.Nil(t, err)
+	assert.NotEqual(t, index, other, "should produce different indexes for different values")
+
+	keeper, err := MakeKeyringCryptKeeper(Key{"v2", TestRetiredSecretKey}, Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	active, err := keeper.BlindIndex(value)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{active, index}, keeper.BlindIndexes(value), "should return the indexes under every key")
+}
@@ -0,0 +1,420 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Tokens produced by Encrypt are base64 encoded envelopes with the following layout:
+//
+//	version (1 byte) | algorithm (1 byte) | field count (1 byte) |
+//	fields: id (1 byte) | length (2 bytes, big endian) | value |
+//	nonce | ciphertext | tag
+//
+// Everything before the nonce is the header. It is authenticated as GCM additional data,
+// followed by any caller supplied associated data, so that the recorded key id or algorithm
+// can not be altered without decryption failing. Tokens sealed with associated data carry the
+// bound field so that decrypting them without it, or decrypting an unbound token with it,
+// fails with a distinct error.
+// Legacy tokens are recognised by the TokenSeparator, which never occurs in base64.
+const (
+	EnvelopeVersion1 byte = 1
+
+	AlgorithmAESGCM byte = 1
+	// AlgorithmAESGCMSyntheticNonce is AES-GCM with a nonce derived from the plaintext by a
+	// truncated HMAC, used by the deterministic mode. It is not AES-GCM-SIV (RFC 8452).
+	AlgorithmAESGCMSyntheticNonce byte = 2
+
+	fieldKeyID byte = 1
+	fieldBound byte = 2
+	// fieldWrappedKey holds the data key of the token, wrapped by a KeyWrapper.
+	fieldWrappedKey byte = 3
+	// fieldContext holds the context the key of the token was derived for by ForContext.
+	fieldContext byte = 4
+	// fieldSubject holds the id of the subject whose data key encrypted the token, a keyed hash
+	// of the subject, see SubjectCryptKeeper.
+	fieldSubject byte = 5
+
+	maxFieldLength = 1<<16 - 1
+)
+
+var (
+	ErrMalformedToken   = errors.New("token is malformed")
+	ErrTruncatedToken   = errors.New("token is truncated")
+	ErrUnknownVersion   = errors.New("token has an unknown envelope version")
+	ErrUnknownAlgorithm = errors.New("token has an unknown algorithm")
+	ErrNoMatchingKey    = errors.New("none of the configured keys could decrypt the token")
+	ErrModeMismatch     = errors.New("token was encrypted in the other encryption mode")
+
+	ErrUnboundToken           = errors.New("token was not encrypted with associated data")
+	ErrAssociatedDataRequired = errors.New("token was encrypted with associated data")
+)
+
+// envelope is the parsed form of a token, either a versioned envelope or a legacy token.
+type envelope struct {
+	version    byte
+	algorithm  byte
+	keyID      string
+	bound      bool
+	wrappedKey []byte
+	context    string
+	subject    string
+	nonce      []byte
+	ciphertext []byte
+	tag        []byte
+	legacy     bool
+	// rawHeader holds the header bytes exactly as they were parsed.
+	rawHeader []byte
+}
+
+// keySource resolves the AES keys a keeper seals and opens envelopes with.
+type keySource interface {
+	// sealingKey returns the key new tokens are encrypted with, along with an envelope
+	// that has the fields identifying that key filled in.
+	sealingKey() (*envelope, cipher.Block, error)
+	// openingKeys returns the keys to try when decrypting env, in order.
+	openingKeys(env *envelope) ([]cipher.Block, error)
+}
+
+func algorithmSizes(algorithm byte) (int, int, error) {
+	switch algorithm {
+	case AlgorithmAESGCM, AlgorithmAESGCMSyntheticNonce:
+		return IVSize, GCMTagSize, nil
+	}
+	return 0, 0, fmt.Errorf("%w: %d", ErrUnknownAlgorithm, algorithm)
+}
+
+func (env *envelope) fields() [][]byte {
+	fields := [][]byte{}
+	if env.keyID != "" {
+		fields = append(fields, append([]byte{fieldKeyID}, env.keyID...))
+	}
+	if env.bound {
+		fields = append(fields, []byte{fieldBound, 1})
+	}
+	if len(env.wrappedKey) > 0 {
+		fields = append(fields, append([]byte{fieldWrappedKey}, env.wrappedKey...))
+	}
+	if env.context != "" {
+		fields = append(fields, append([]byte{fieldContext}, env.context...))
+	}
+	if env.subject != "" {
+		fields = append(fields, append([]byte{fieldSubject}, env.subject...))
+	}
+	return fields
+}
+
+func (env *envelope) header() ([]byte, error) {
+	fields := env.fields()
+	if len(fields) > 255 {
+		return nil, fmt.Errorf("%w: too many header fields", ErrMalformedToken)
+	}
+	header := []byte{env.version, env.algorithm, byte(len(fields))}
+	for _, field := range fields {
+		value := field[1:]
+		if len(value) > maxFieldLength {
+			return nil, fmt.Errorf("%w: header field %d is too long", ErrMalformedToken, field[0])
+		}
+		header = append(header, field[0], 0, 0)
+		binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(value)))
+		header = append(header, value...)
+	}
+	return header, nil
+}
+
+func (env *envelope) encode() (string, error) {
+	header, err := env.header()
+	if err != nil {
+		return "", err
+	}
+	raw := make([]byte, 0, len(header)+len(env.nonce)+len(env.ciphertext)+len(env.tag))
+	raw = append(raw, header...)
+	raw = append(raw, env.nonce...)
+	raw = append(raw, env.ciphertext...)
+	raw = append(raw, env.tag...)
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func (env *envelope) setField(id byte, value []byte) error {
+	switch id {
+	case fieldKeyID:
+		if env.keyID != "" {
+			return fmt.Errorf("%w: duplicate key id field", ErrMalformedToken)
+		}
+		if len(value) == 0 {
+			return fmt.Errorf("%w: empty key id field", ErrMalformedToken)
+		}
+		env.keyID = string(value)
+		return nil
+	case fieldBound:
+		if env.bound {
+			return fmt.Errorf("%w: duplicate bound field", ErrMalformedToken)
+		}
+		if len(value) != 1 || value[0] != 1 {
+			return fmt.Errorf("%w: invalid bound field", ErrMalformedToken)
+		}
+		env.bound = true
+		return nil
+	case fieldWrappedKey:
+		if env.wrappedKey != nil {
+			return fmt.Errorf("%w: duplicate wrapped key field", ErrMalformedToken)
+		}
+		if len(value) == 0 {
+			return fmt.Errorf("%w: empty wrapped key field", ErrMalformedToken)
+		}
+		env.wrappedKey = append([]byte{}, value...)
+		return nil
+	case fieldContext:
+		if env.context != "" {
+			return fmt.Errorf("%w: duplicate context field", ErrMalformedToken)
+		}
+		if len(value) == 0 {
+			return fmt.Errorf("%w: empty context field", ErrMalformedToken)
+		}
+		env.context = string(value)
+		return nil
+	case fieldSubject:
+		if env.subject != "" {
+			return fmt.Errorf("%w: duplicate subject field", ErrMalformedToken)
+		}
+		if len(value) == 0 {
+			return fmt.Errorf("%w: empty subject field", ErrMalformedToken)
+		}
+		env.subject = string(value)
+		return nil
+	}
+	return fmt.Errorf("%w: unknown header field %d", ErrMalformedToken, id)
+}
+
+// parseEnvelopeHeader parses the header at the start of raw, which may hold only part of the
+// rest of the token.
+func parseEnvelopeHeader(raw []byte) (*envelope, error) {
+	if len(raw) < 3 {
+		return nil, ErrTruncatedToken
+	}
+	env := &envelope{version: raw[0], algorithm: raw[1]}
+	if env.version != EnvelopeVersion1 {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, env.version)
+	}
+	if _, _, err := algorithmSizes(env.algorithm); err != nil {
+		return nil, err
+	}
+	count := int(raw[2])
+	offset := 3
+	for i := 0; i < count; i++ {
+		if len(raw) < offset+3 {
+			return nil, ErrTruncatedToken
+		}
+		id := raw[offset]
+		length := int(binary.BigEndian.Uint16(raw[offset+1 : offset+3]))
+		offset += 3
+		if len(raw) < offset+length {
+			return nil, ErrTruncatedToken
+		}
+		if err := env.setField(id, raw[offset:offset+length]); err != nil {
+			return nil, err
+		}
+		offset += length
+	}
+	env.rawHeader = raw[:offset]
+	return env, nil
+}
+
+func parseEnvelope(value string) (*envelope, error) {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedToken, err.Error())
+	}
+	env, err := parseEnvelopeHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize, tagSize, err := algorithmSizes(env.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	offset := len(env.rawHeader)
+	if len(raw) < offset+nonceSize+tagSize {
+		return nil, ErrTruncatedToken
+	}
+	env.nonce = raw[offset : offset+nonceSize]
+	env.ciphertext = raw[offset+nonceSize : len(raw)-tagSize]
+	env.tag = raw[len(raw)-tagSize:]
+	return env, nil
+}
+
+func parseLegacyToken(value string) (*envelope, error) {
+	encrypted, iv, tag, err := getIV(value)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{algorithm: AlgorithmAESGCM, nonce: iv, ciphertext: encrypted, tag: tag, legacy: true}, nil
+}
+
+// parseToken parses both versioned envelopes and legacy TokenSeparator delimited tokens.
+func parseToken(value string) (*envelope, error) {
+	if strings.Contains(value, TokenSeparator) {
+		return parseLegacyToken(value)
+	}
+	return parseEnvelope(value)
+}
+
+// TokenKeyID returns the id of the key token was encrypted with, or "" if it records none, as
+// for keepers without key ids.
+func TokenKeyID(token string) (string, error) {
+	env, err := parseToken(token)
+	if err != nil {
+		return "", err
+	}
+	return env.keyID, nil
+}
+
+// IsBound reports whether the ciphertext starting with prefix, a token or a stream, was
+// encrypted with associated data. prefix needs to hold only the header of the token, or the
+// header of the stream; ErrTruncatedToken is returned if it is too short. Legacy tokens are
+// never bound.
+func IsBound(prefix []byte) (bool, error) {
+	if IsStream(prefix) {
+		header, _, err := readStreamHeader(bytes.NewReader(prefix))
+		if err != nil {
+			return false, err
+		}
+		prefix = streamToken(header)
+	}
+	if bytes.Contains(prefix, []byte(TokenSeparator)) {
+		return false, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(prefix[:len(prefix)/4*4]))
+	if err != nil {
+		return false, fmt.Errorf("%w: %s", ErrMalformedToken, err.Error())
+	}
+	env, err := parseEnvelopeHeader(raw)
+	if err != nil {
+		return false, err
+	}
+	return env.bound, nil
+}
+
+func additionalData(header []byte, associatedData []byte) []byte {
+	if len(associatedData) == 0 {
+		return header
+	}
+	return append(append([]byte{}, header...), associatedData...)
+}
+
+func sealEnvelope(keys keySource, toEnc []byte, associatedData []byte) (string, error) {
+	return sealEnvelopeAs(keys, AlgorithmAESGCM, toEnc, associatedData)
+}
+
+func sealEnvelopeAs(keys keySource, algorithm byte, toEnc []byte, associatedData []byte) (string, error) {
+	env, block, err := keys.sealingKey()
+	if err != nil {
+		return "", err
+	}
+	env.version = EnvelopeVersion1
+	env.algorithm = algorithm
+	env.bound = len(associatedData) > 0
+	header, err := env.header()
+	if err != nil {
+		return "", err
+	}
+	if env.context != "" {
+		if block, err = contextKey(keys, block, env.context); err != nil {
+			return "", err
+		}
+	}
+	if algorithm == AlgorithmAESGCMSyntheticNonce {
+		var macKey []byte
+		if macKey, block, err = syntheticIVKeys(block); err != nil {
+			return "", err
+		}
+		env.nonce = syntheticIV(macKey, header, associatedData, toEnc)
+	} else {
+		env.nonce = make([]byte, IVSize)
+		if _, err := io.ReadFull(rand.Reader, env.nonce); err != nil {
+			return "", err
+		}
+	}
+	gcmCipher, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	encrypted := gcmCipher.Seal(nil, env.nonce, toEnc, additionalData(header, associatedData))
+	env.ciphertext = encrypted[:len(encrypted)-GCMTagSize]
+	env.tag = encrypted[len(encrypted)-GCMTagSize:]
+	return env.encode()
+}
+
+func openWith(block cipher.Block, env *envelope, associatedData []byte) ([]byte, error) {
+	var macKey []byte
+	if env.algorithm == AlgorithmAESGCMSyntheticNonce {
+		var err error
+		if macKey, block, err = syntheticIVKeys(block); err != nil {
+			return nil, err
+		}
+	}
+	gcmDecipher, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(env.ciphertext)+len(env.tag))
+	sealed = append(sealed, env.ciphertext...)
+	sealed = append(sealed, env.tag...)
+	decrypted, err := gcmDecipher.Open(nil, env.nonce, sealed, additionalData(env.rawHeader, associatedData))
+	if err != nil {
+		return nil, err
+	}
+	if macKey != nil && !hmac.Equal(env.nonce, syntheticIV(macKey, env.rawHeader, associatedData, decrypted)) {
+		return nil, errSyntheticIVMismatch
+	}
+	return decrypted, nil
+}
+
+func openEnvelope(keys keySource, value string, associatedData []byte) ([]byte, error) {
+	return openEnvelopeAs(keys, AlgorithmAESGCM, value, associatedData)
+}
+
+func openEnvelopeAs(keys keySource, algorithm byte, value string, associatedData []byte) ([]byte, error) {
+	env, err := parseToken(value)
+	if err != nil {
+		return []byte{}, err
+	}
+	if env.algorithm != algorithm {
+		return []byte{}, ErrModeMismatch
+	}
+	if !env.bound && len(associatedData) > 0 {
+		return []byte{}, ErrUnboundToken
+	}
+	if env.bound && len(associatedData) == 0 {
+		return []byte{}, ErrAssociatedDataRequired
+	}
+	blocks, err := keys.openingKeys(env)
+	if err != nil {
+		return []byte{}, err
+	}
+	var lastErr error
+	for _, block := range blocks {
+		if env.context != "" {
+			if block, err = contextKey(keys, block, env.context); err != nil {
+				return []byte{}, err
+			}
+		}
+		decrypted, err := openWith(block, env, associatedData)
+		if err == nil {
+			return decrypted, nil
+		}
+		lastErr = err
+	}
+	if len(blocks) != 1 {
+		return []byte{}, ErrNoMatchingKey
+	}
+	return []byte{}, lastErr
+}
@@ -0,0 +1,203 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	DataKeySize            = 32
+	DefaultDataKeyCacheTTL = 5 * time.Minute
+	// DataKeyCacheSize is the number of unwrapped data keys the cache holds at most.
+	DataKeyCacheSize = 1024
+)
+
+var (
+	ErrMissingWrappedKey  = errors.New("token does not carry a wrapped data key")
+	ErrUnsupportedMode    = errors.New("keeper does not support this encryption mode")
+	ErrInvalidDataKeySize = errors.New("unwrapped data key has an invalid size")
+)
+
+type cachedDataKey struct {
+	block   cipher.Block
+	expires time.Time
+}
+
+// dataKeyCache holds up to size unwrapped data keys by their wrapped form so that decrypting
+// many tokens sealed with the same data key only unwraps it once per TTL. Expired keys are
+// dropped when they are looked up, and an arbitrary key when the cache is full.
+type dataKeyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]cachedDataKey
+	now     func() time.Time
+}
+
+func (cache *dataKeyCache) get(wrapped []byte) (cipher.Block, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[string(wrapped)]
+	if !ok {
+		return nil, false
+	}
+	if !cache.now().Before(entry.expires) {
+		delete(cache.entries, string(wrapped))
+		return nil, false
+	}
+	return entry.block, true
+}
+
+func (cache *dataKeyCache) put(wrapped []byte, block cipher.Block) {
+	if cache.ttl <= 0 {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, ok := cache.entries[string(wrapped)]; !ok && len(cache.entries) >= cache.size {
+		for key := range cache.entries {
+			delete(cache.entries, key)
+			break
+		}
+	}
+	cache.entries[string(wrapped)] = cachedDataKey{block: block, expires: cache.now().Add(cache.ttl)}
+}
+
+// EnvelopeCryptKeeper encrypts every token with a fresh data key. The data key is wrapped by
+// a KeyWrapper and stored in the token header, so tokens can be decrypted for as long as the
+// wrapper can unwrap their key. The fields of a payload share one data key, so encrypting a
+// payload wraps a single key. Unwrapped data keys are cached for the cache TTL.
+//
+// As every token has its own data key, the deterministic mode and blind indexes are not
+// supported and return ErrUnsupportedMode.
+type EnvelopeCryptKeeper struct {
+	wrapper KeyWrapper
+	cache   *dataKeyCache
+}
+
+func (keeper *EnvelopeCryptKeeper) sealingKey() (*envelope, cipher.Block, error) {
+	dataKey := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := keeper.wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &envelope{wrappedKey: wrapped}, block, nil
+}
+
+// dataKeySession seals every token with the same data key, generated and wrapped when it is
+// first needed, so the tokens of one payload cost a single call to the KeyWrapper.
+type dataKeySession struct {
+	keeper     *EnvelopeCryptKeeper
+	wrappedKey []byte
+	block      cipher.Block
+}
+
+func (session *dataKeySession) sealingKey() (*envelope, cipher.Block, error) {
+	if session.block == nil {
+		env, block, err := session.keeper.sealingKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		session.wrappedKey, session.block = env.wrappedKey, block
+	}
+	return &envelope{wrappedKey: session.wrappedKey}, session.block, nil
+}
+
+func (session *dataKeySession) openingKeys(env *envelope) ([]cipher.Block, error) {
+	return session.keeper.openingKeys(env)
+}
+
+// payloadEncrypt returns the function encrypting the fields of a single payload.
+func (keeper *EnvelopeCryptKeeper) payloadEncrypt(associatedData []byte) func([]byte) (string, error) {
+	session := &dataKeySession{keeper: keeper}
+	return func(toEnc []byte) (string, error) {
+		return sealEnvelope(session, toEnc, associatedData)
+	}
+}
+
+func (keeper *EnvelopeCryptKeeper) openingKeys(env *envelope) ([]cipher.Block, error) {
+	if len(env.wrappedKey) == 0 {
+		return nil, ErrMissingWrappedKey
+	}
+	if block, ok := keeper.cache.get(env.wrappedKey); ok {
+		return []cipher.Block{block}, nil
+	}
+	dataKey, err := keeper.wrapper.UnwrapKey(env.wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataKey) != DataKeySize {
+		return nil, ErrInvalidDataKeySize
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	keeper.cache.put(env.wrappedKey, block)
+	return []cipher.Block{block}, nil
+}
+
+func (keeper *EnvelopeCryptKeeper) Encrypt(toEnc []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, nil)
+}
+
+func (keeper *EnvelopeCryptKeeper) EncryptWithAssociatedData(toEnc []byte, associatedData []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, associatedData)
+}
+
+func (keeper *EnvelopeCryptKeeper) EncryptPayload(payload *map[string]interface{}, whitelist *[]string) (*map[string]interface{}, error) {
+	return encryptPayload(keeper.payloadEncrypt(nil), payload, whitelist)
+}
+
+func (keeper *EnvelopeCryptKeeper) EncryptPayloadWithAssociatedData(payload *map[string]interface{}, whitelist *[]string, associatedData []byte) (*map[string]interface{}, error) {
+	return encryptPayload(keeper.payloadEncrypt(associatedData), payload, whitelist)
+}
+
+func (keeper *EnvelopeCryptKeeper) Decrypt(value string) ([]byte, error) {
+	return openEnvelope(keeper, value, nil)
+}
+
+func (keeper *EnvelopeCryptKeeper) DecryptWithAssociatedData(value string, associatedData []byte) ([]byte, error) {
+	return openEnvelope(keeper, value, associatedData)
+}
+
+func (keeper *EnvelopeCryptKeeper) DecryptPayload(payload *map[string]interface{}) (*map[string]interface{}, error) {
+	return decryptPayload(keeper.Decrypt, payload)
+}
+
+func (keeper *EnvelopeCryptKeeper) DecryptPayloadWithAssociatedData(payload *map[string]interface{}, associatedData []byte) (*map[string]interface{}, error) {
+	return decryptPayload(bindDecrypt(keeper.DecryptWithAssociatedData, associatedData), payload)
+}
+
+func (keeper *EnvelopeCryptKeeper) EncryptDeterministic(toEnc []byte) (string, error) {
+	return "", ErrUnsupportedMode
+}
+
+func (keeper *EnvelopeCryptKeeper) DecryptDeterministic(value string) ([]byte, error) {
+	return nil, ErrUnsupportedMode
+}
+
+func (keeper *EnvelopeCryptKeeper) BlindIndex(value []byte) (string, error) {
+	return "", ErrUnsupportedMode
+}
+
+// MakeEnvelopeCryptKeeper creates a keeper that wraps its data keys with wrapper and caches
+// up to DataKeyCacheSize unwrapped data keys for cacheTTL. A cacheTTL of zero disables the cache.
+func MakeEnvelopeCryptKeeper(wrapper KeyWrapper, cacheTTL time.Duration) *EnvelopeCryptKeeper {
+	return &EnvelopeCryptKeeper{
+		wrapper: wrapper,
+		cache:   &dataKeyCache{ttl: cacheTTL, size: DataKeyCacheSize, entries: map[string]cachedDataKey{}, now: time.Now},
+	}
+}
@@ -0,0 +1,199 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	Chance "github.com/ZeFort/chance"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingKeyWrapper struct {
+	KeyWrapper
+	wraps   int
+	unwraps int
+}
+
+func (wrapper *countingKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	wrapper.wraps++
+	return wrapper.KeyWrapper.WrapKey(dataKey)
+}
+
+func (wrapper *countingKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	wrapper.unwraps++
+	return wrapper.KeyWrapper.UnwrapKey(wrapped)
+}
+
+func makeTestFileKeyWrapper(t *testing.T) *FileKeyWrapper {
+	path := filepath.Join(t.TempDir(), "kek")
+	if err := ioutil.WriteFile(path, []byte(TestSecretKey+"\n"), 0600); err != nil {
+		panic(err)
+	}
+	wrapper, err := MakeFileKeyWrapper(path)
+	if err != nil {
+		panic(err)
+	}
+	return wrapper
+}
+
+func TestEnvelopeCryptKeeper(t *testing.T) {
+	chance := Chance.New()
+	keeper := MakeEnvelopeCryptKeeper(makeTestFileKeyWrapper(t), DefaultDataKeyCacheTTL)
+	toEncrypt := []byte(chance.String())
+	first, err := keeper.Encrypt(toEncrypt)
+	assert.Nil(t, err)
+	second, err := keeper.Encrypt(toEncrypt)
+	assert.Nil(t, err)
+
+	firstEnv, err := parseToken(first)
+	assert.Nil(t, err)
+	secondEnv, err := parseToken(second)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, firstEnv.wrappedKey, "should store the wrapped data key in the token")
+	assert.NotEqual(t, firstEnv.wrappedKey, secondEnv.wrappedKey, "should use a fresh data key for every token")
+
+	decrypted, err := keeper.Decrypt(first)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt with the unwrapped data key")
+
+	// Another keeper with the same key encryption key can decrypt the token.
+	other := MakeEnvelopeCryptKeeper(makeTestFileKeyWrapper(t), 0)
+	decrypted, err = other.Decrypt(second)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted)
+
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	plain, err := crypter.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	_, err = keeper.Decrypt(plain)
+	assert.True(t, errors.Is(err, ErrMissingWrappedKey), "should reject tokens without a wrapped key")
+
+	_, err = keeper.EncryptDeterministic(toEncrypt)
+	assert.True(t, errors.Is(err, ErrUnsupportedMode), "should not support the deterministic mode")
+}
+
+func TestEnvelopeCryptKeeperCache(t *testing.T) {
+	wrapper := &countingKeyWrapper{KeyWrapper: makeTestFileKeyWrapper(t)}
+	keeper := MakeEnvelopeCryptKeeper(wrapper, time.Minute)
+	now := time.Now()
+	keeper.cache.now = func() time.Time { return now }
+
+	encrypted, err := keeper.Encrypt([]byte(Chance.New().Word()))
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := keeper.Decrypt(encrypted)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, wrapper.unwraps, "should unwrap a data key once while it is cached")
+
+	now = now.Add(time.Minute)
+	_, err = keeper.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, wrapper.unwraps, "should unwrap the data key again once the cache expired")
+}
+
+func TestEnvelopeCryptKeeperPayloadDataKey(t *testing.T) {
+	wrapper := &countingKeyWrapper{KeyWrapper: makeTestFileKeyWrapper(t)}
+	keeper := MakeEnvelopeCryptKeeper(wrapper, time.Minute)
+	payload := &map[string]interface{}{"id": "1", "email": "a@example.com", "card": "4111111111111111", "name": "Jane"}
+
+	encrypted, err := EncryptPayloadWithSelectors(keeper, payload, &PayloadSelectors{Clear: []string{"id"}, Encrypt: []string{"email", "card"}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, wrapper.wraps, "should wrap one data key for all the fields of a payload")
+	decrypted, err := keeper.DecryptPayload(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, decrypted)
+
+	_, err = keeper.EncryptPayload(payload, &[]string{"id"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, wrapper.wraps, "should use a fresh data key for every payload")
+}
+
+func TestDataKeyCacheSize(t *testing.T) {
+	cache := &dataKeyCache{ttl: time.Minute, size: 2, entries: map[string]cachedDataKey{}, now: time.Now}
+	for _, wrapped := range []string{"a", "b", "c"} {
+		cache.put([]byte(wrapped), nil)
+	}
+	assert.Len(t, cache.entries, 2, "should not hold more keys than its size")
+	cache.put([]byte("c"), nil)
+	assert.Len(t, cache.entries, 2, "should replace a cached key in place")
+}
+
+func TestEnvelopeCryptKeeperTamperedWrappedKey(t *testing.T) {
+	keeper := MakeEnvelopeCryptKeeper(makeTestFileKeyWrapper(t), DefaultDataKeyCacheTTL)
+	first, err := keeper.Encrypt([]byte(Chance.New().Word()))
+	if err != nil {
+		panic(err)
+	}
+	second, err := keeper.Encrypt([]byte(Chance.New().Word()))
+	if err != nil {
+		panic(err)
+	}
+	firstEnv, _ := parseToken(first)
+	secondEnv, _ := parseToken(second)
+	// Swap in the wrapped key of another token, whose data key is then already cached.
+	_, err = keeper.Decrypt(second)
+	assert.Nil(t, err)
+	firstEnv.wrappedKey = secondEnv.wrappedKey
+	swapped, err := firstEnv.encode()
+	if err != nil {
+		panic(err)
+	}
+	_, err = keeper.Decrypt(swapped)
+	assert.NotNil(t, err, "should fail to decrypt a token with a swapped wrapped key")
+}
+
+type MockKMS struct {
+	kmsiface.KMSAPI
+	crypter *CryptKeeper
+}
+
+func (m *MockKMS) Encrypt(input *kms.EncryptInput) (*kms.EncryptOutput, error) {
+	encrypted, err := m.crypter.EncryptWithAssociatedData(input.Plaintext, []byte(*input.KeyId+*input.EncryptionContext["tenant"]))
+	if err != nil {
+		return nil, err
+	}
+	return &kms.EncryptOutput{CiphertextBlob: []byte(encrypted), KeyId: input.KeyId}, nil
+}
+
+func (m *MockKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	decrypted, err := m.crypter.DecryptWithAssociatedData(string(input.CiphertextBlob), []byte(*input.KeyId+*input.EncryptionContext["tenant"]))
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DecryptOutput{Plaintext: decrypted, KeyId: input.KeyId}, nil
+}
+
+func TestKMSKeyWrapper(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	wrapper := MakeKMSKeyWrapper(&MockKMS{crypter: crypter}, "alias/documents")
+	wrapper.EncryptionContext = map[string]string{"tenant": "t1"}
+	dataKey := randomBytes(DataKeySize)
+	wrapped, err := wrapper.WrapKey(dataKey)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(wrapped, dataKey), "should not store the data key in the clear")
+
+	unwrapped, err := wrapper.UnwrapKey(wrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, dataKey, unwrapped, "should unwrap the data key")
+
+	wrapper.EncryptionContext = map[string]string{"tenant": "t2"}
+	_, err = wrapper.UnwrapKey(wrapped)
+	assert.NotNil(t, err, "should pass the encryption context to KMS")
+}
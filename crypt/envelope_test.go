@@ -0,0 +1,224 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+
+	Chance "github.com/ZeFort/chance"
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyEncrypt produces a token in the TokenSeparator delimited format used before envelopes.
+func legacyEncrypt(block cipher.Block, toEnc []byte) string {
+	iv := make([]byte, IVSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		panic(err)
+	}
+	gcmCipher, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	encrypted := gcmCipher.Seal(nil, iv, toEnc, nil)
+	return setIV(encrypted[:len(encrypted)-GCMTagSize], iv, encrypted[len(encrypted)-GCMTagSize:])
+}
+
+func encryptRaw(keeper *KeyringCryptKeeper, toEnc []byte) []byte {
+	encrypted, err := keeper.Encrypt(toEnc)
+	if err != nil {
+		panic(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func TestParseEnvelope(t *testing.T) {
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(Chance.New().Word())
+	encrypted, err := keeper.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	env, err := parseToken(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, EnvelopeVersion1, env.version, "should record the envelope version")
+	assert.Equal(t, AlgorithmAESGCM, env.algorithm, "should record the algorithm")
+	assert.Equal(t, "v1", env.keyID, "should record the key id")
+	assert.Equal(t, IVSize, len(env.nonce), "should carry a nonce")
+	assert.Equal(t, GCMTagSize, len(env.tag), "should carry a tag")
+	assert.Equal(t, len(toEncrypt), len(env.ciphertext), "should carry the ciphertext")
+	assert.False(t, env.legacy)
+}
+
+func TestDecryptLegacyToken(t *testing.T) {
+	chance := Chance.New()
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(chance.Word())
+	decrypted, err := crypter.Decrypt(legacyEncrypt(crypter.Cipher, toEncrypt))
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens in the legacy format")
+}
+
+func TestParseEnvelopeErrorHandling(t *testing.T) {
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	raw := encryptRaw(keeper, []byte(Chance.New().Word()))
+
+	_, err = keeper.Decrypt("not base64!")
+	assert.True(t, errors.Is(err, ErrMalformedToken), "should reject tokens that are not base64")
+
+	_, err = keeper.Decrypt(base64.StdEncoding.EncodeToString(raw[:2]))
+	assert.True(t, errors.Is(err, ErrTruncatedToken), "should reject tokens without a complete header")
+
+	_, err = keeper.Decrypt(base64.StdEncoding.EncodeToString(raw[:10]))
+	assert.True(t, errors.Is(err, ErrTruncatedToken), "should reject tokens without a nonce and tag")
+
+	unknownVersion := append([]byte{}, raw...)
+	unknownVersion[0] = 9
+	_, err = keeper.Decrypt(base64.StdEncoding.EncodeToString(unknownVersion))
+	assert.True(t, errors.Is(err, ErrUnknownVersion), "should reject unknown envelope versions")
+
+	unknownAlgorithm := append([]byte{}, raw...)
+	unknownAlgorithm[1] = 9
+	_, err = keeper.Decrypt(base64.StdEncoding.EncodeToString(unknownAlgorithm))
+	assert.True(t, errors.Is(err, ErrUnknownAlgorithm), "should reject unknown algorithms")
+
+	unknownField := append([]byte{}, raw...)
+	unknownField[3] = 99
+	_, err = keeper.Decrypt(base64.StdEncoding.EncodeToString(unknownField))
+	assert.True(t, errors.Is(err, ErrMalformedToken), "should reject unknown header fields")
+
+	duplicateField := append([]byte{raw[0], raw[1], 2, 1, 0, 2, 'v', '1'}, raw[3:]...)
+	_, err = keeper.Decrypt(base64.StdEncoding.EncodeToString(duplicateField))
+	assert.True(t, errors.Is(err, ErrMalformedToken), "should reject duplicate header fields")
+}
+
+func TestDecryptTamperedHeader(t *testing.T) {
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey}, Key{"v2", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	raw := encryptRaw(keeper, []byte(Chance.New().Word()))
+	// Re-point the token at another key id holding the same key material.
+	raw[7] = '2'
+	_, err = keeper.Decrypt(base64.StdEncoding.EncodeToString(raw))
+	assert.NotNil(t, err, "should fail to decrypt when the header was altered")
+}
+
+func TestEncryptAndDecryptWithAssociatedData(t *testing.T) {
+	chance := Chance.New()
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(chance.Word())
+	encrypted, err := crypter.EncryptWithAssociatedData(toEncrypt, []byte("documents/1"))
+	if err != nil {
+		panic(err)
+	}
+
+	decrypted, err := crypter.DecryptWithAssociatedData(encrypted, []byte("documents/1"))
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt with the same associated data")
+
+	_, err = crypter.DecryptWithAssociatedData(encrypted, []byte("documents/2"))
+	assert.NotNil(t, err, "should fail to decrypt with different associated data")
+
+	_, err = crypter.Decrypt(encrypted)
+	assert.True(t, errors.Is(err, ErrAssociatedDataRequired), "should fail to decrypt without associated data")
+
+	unbound, err := crypter.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	_, err = crypter.DecryptWithAssociatedData(unbound, []byte("documents/1"))
+	assert.True(t, errors.Is(err, ErrUnboundToken), "should report tokens that are not bound")
+	_, err = crypter.DecryptWithAssociatedData(legacyEncrypt(crypter.Cipher, toEncrypt), []byte("documents/1"))
+	assert.True(t, errors.Is(err, ErrUnboundToken), "should report legacy tokens as not bound")
+}
+
+func TestIsBound(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(Chance.New().String())
+	bound, _ := crypter.EncryptWithAssociatedData(toEncrypt, []byte("documents/1"))
+	unbound, _ := crypter.Encrypt(toEncrypt)
+	boundStream := &bytes.Buffer{}
+	writer, _ := NewEncryptWriterWithAssociatedData(crypter, boundStream, []byte("documents/1"))
+	writer.Write(toEncrypt)
+	writer.Close()
+	for _, test := range []struct {
+		prefix string
+		bound  bool
+	}{
+		{bound[:16], true},
+		{unbound[:16], false},
+		{legacyEncrypt(crypter.Cipher, toEncrypt), false},
+		{boundStream.String(), true},
+		{string(encryptStream(crypter, toEncrypt, testChunkSize)), false},
+	} {
+		result, err := IsBound([]byte(test.prefix))
+		assert.Nil(t, err)
+		assert.Equal(t, test.bound, result, "should tell whether %.16s is bound", test.prefix)
+	}
+	_, err = IsBound([]byte(bound[:2]))
+	assert.True(t, errors.Is(err, ErrTruncatedToken), "should fail on a prefix shorter than the header")
+}
+
+func TestDecryptStrippedBoundField(t *testing.T) {
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	encrypted, err := keeper.EncryptWithAssociatedData([]byte(Chance.New().Word()), []byte("documents/1"))
+	if err != nil {
+		panic(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(encrypted)
+	// Drop the bound field to try and decrypt the token without associated data.
+	stripped := append([]byte{raw[0], raw[1], 1}, raw[3:8]...)
+	stripped = append(stripped, raw[12:]...)
+	_, err = keeper.Decrypt(base64.StdEncoding.EncodeToString(stripped))
+	assert.NotNil(t, err, "should fail to decrypt when the bound field was removed")
+}
+
+func TestEncryptAndDecryptPayloadWithAssociatedData(t *testing.T) {
+	chance := Chance.New()
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	payload := &map[string]interface{}{
+		"should-encrypt":     chance.String(),
+		"should-not-encrypt": chance.Word(),
+	}
+	encrypted, err := keeper.EncryptPayloadWithAssociatedData(payload, &[]string{"should-not-encrypt"}, []byte("documents/1"))
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = keeper.DecryptPayloadWithAssociatedData(encrypted, []byte("documents/2"))
+	assert.NotNil(t, err, "should fail to decrypt a payload moved to another document")
+
+	decrypted, err := keeper.DecryptPayloadWithAssociatedData(encrypted, []byte("documents/1"))
+	assert.Nil(t, err)
+	_, ok := (*decrypted)["should-encrypt"]
+	assert.Equal(t, true, ok, "should have \"should-encrypt\" field")
+}
@@ -3,10 +3,8 @@ package crypt
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
-	"io"
+	"fmt"
 	"strings"
 )
 
@@ -16,19 +14,24 @@ const (
 	TokenSeparator = "|$|"
 )
 
-func getIV(value string) ([]byte, []byte, []byte) {
-	var encrypted, iv, tag []byte
-	for index, v := range strings.Split(value, TokenSeparator) {
-		switch index {
-		case 0:
-			encrypted, _ = base64.StdEncoding.DecodeString(v)
-		case 1:
-			iv, _ = base64.StdEncoding.DecodeString(v)
-		case 2:
-			tag, _ = base64.StdEncoding.DecodeString(v)
+func getIV(value string) ([]byte, []byte, []byte, error) {
+	segments := strings.Split(value, TokenSeparator)
+	if len(segments) != 3 {
+		return nil, nil, nil, fmt.Errorf("%w: expected 3 segments, got %d", ErrMalformedToken, len(segments))
+	}
+	decoded := make([][]byte, 3)
+	for index, v := range segments {
+		segment, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %s", ErrMalformedToken, err.Error())
 		}
+		decoded[index] = segment
 	}
-	return encrypted, iv, tag
+	encrypted, iv, tag := decoded[0], decoded[1], decoded[2]
+	if len(iv) != IVSize || len(tag) != GCMTagSize {
+		return nil, nil, nil, fmt.Errorf("%w: invalid iv or tag size", ErrMalformedToken)
+	}
+	return encrypted, iv, tag, nil
 }
 
 func setIV(value []byte, iv []byte, tag []byte) string {
@@ -40,90 +43,103 @@ type CryptKeeperInterface interface {
 	DecryptPayload(*map[string]interface{}) (*map[string]interface{}, error)
 	Encrypt([]byte) (string, error)
 	Decrypt(string) ([]byte, error)
+
+	// The associated data variants bind a token to its context, such as an S3 object key or a
+	// document id. Decryption fails unless the same associated data is given again.
+	EncryptPayloadWithAssociatedData(*map[string]interface{}, *[]string, []byte) (*map[string]interface{}, error)
+	DecryptPayloadWithAssociatedData(*map[string]interface{}, []byte) (*map[string]interface{}, error)
+	EncryptWithAssociatedData([]byte, []byte) (string, error)
+	DecryptWithAssociatedData(string, []byte) ([]byte, error)
+
+	// The deterministic mode returns equal tokens for equal plaintexts so encrypted values can
+	// be searched for. Its tokens can only be decrypted with DecryptDeterministic, and tokens
+	// from Encrypt can not be decrypted with it. BlindIndex returns a keyed hash of a value
+	// for exact-match lookups of values that do not need to be decrypted.
+	EncryptDeterministic([]byte) (string, error)
+	DecryptDeterministic(string) ([]byte, error)
+	BlindIndex([]byte) (string, error)
 }
 
 type CryptKeeper struct {
 	Cipher cipher.Block
 }
 
+func (keeper *CryptKeeper) sealingKey() (*envelope, cipher.Block, error) {
+	return &envelope{}, keeper.Cipher, nil
+}
+
+func (keeper *CryptKeeper) openingKeys(env *envelope) ([]cipher.Block, error) {
+	return []cipher.Block{keeper.Cipher}, nil
+}
+
 func (keeper *CryptKeeper) Encrypt(toEnc []byte) (string, error) {
-	iv := make([]byte, IVSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", err
-	}
-	gcmCipher, err := cipher.NewGCM(keeper.Cipher)
-	if err != nil {
-		return "", err
-	}
-	encrypted := gcmCipher.Seal(nil, iv, toEnc, nil)
-	tag := encrypted[len(encrypted)-GCMTagSize:]
-	encrypted = encrypted[:len(encrypted)-GCMTagSize]
-	return setIV(encrypted, iv, tag), nil
+	return sealEnvelope(keeper, toEnc, nil)
+}
+
+func (keeper *CryptKeeper) EncryptWithAssociatedData(toEnc []byte, associatedData []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, associatedData)
 }
 
 func (keeper *CryptKeeper) EncryptPayload(payload *map[string]interface{}, whitelist *[]string) (*map[string]interface{}, error) {
-	uniqueKeys := &map[string]bool{}
-	for _, key := range *whitelist {
-		if _, ok := (*uniqueKeys)[key]; !ok {
-			(*uniqueKeys)[key] = true
-		}
-	}
-	toEncrypt := &map[string]interface{}{}
-	finalPayload := &map[string]interface{}{}
-	for key, value := range *payload {
-		if _, ok := (*uniqueKeys)[key]; ok {
-			(*finalPayload)[key] = value
-		} else {
-			(*toEncrypt)[key] = value
-		}
-	}
-	if len(*toEncrypt) > 0 {
-		jsonstr, err := json.Marshal(*toEncrypt)
-		if err != nil {
-			return nil, err
-		}
-		encrypted, err := keeper.Encrypt(jsonstr)
-		if err != nil {
-			return nil, err
-		}
-		(*finalPayload)["ENCRYPTED_PAYLOAD"] = encrypted
-	}
-	return finalPayload, nil
+	return encryptPayload(keeper.Encrypt, payload, whitelist)
+}
+
+func (keeper *CryptKeeper) EncryptPayloadWithAssociatedData(payload *map[string]interface{}, whitelist *[]string, associatedData []byte) (*map[string]interface{}, error) {
+	return encryptPayload(bindEncrypt(keeper.EncryptWithAssociatedData, associatedData), payload, whitelist)
 }
 
 func (keeper *CryptKeeper) Decrypt(value string) ([]byte, error) {
-	toDecrypt, iv, tag := getIV(value)
-	gcmDecipher, err := cipher.NewGCM(keeper.Cipher)
-	if err != nil {
-		return []byte{}, err
-	}
-	decrypted, err := gcmDecipher.Open(nil, iv, append(toDecrypt, tag...), nil)
-	if err != nil {
-		return []byte{}, err
-	}
-	return decrypted, nil
+	return openEnvelope(keeper, value, nil)
+}
+
+func (keeper *CryptKeeper) DecryptWithAssociatedData(value string, associatedData []byte) ([]byte, error) {
+	return openEnvelope(keeper, value, associatedData)
 }
 
 func (keeper *CryptKeeper) DecryptPayload(payload *map[string]interface{}) (*map[string]interface{}, error) {
-	if _, ok := (*payload)["ENCRYPTED_PAYLOAD"]; !ok {
-		return payload, nil
-	}
-	toDecrypt := (*payload)["ENCRYPTED_PAYLOAD"]
-	decrypted, err := keeper.Decrypt(toDecrypt.(string))
-	if err != nil {
-		return nil, err
+	return decryptPayload(keeper.Decrypt, payload)
+}
+
+func (keeper *CryptKeeper) DecryptPayloadWithAssociatedData(payload *map[string]interface{}, associatedData []byte) (*map[string]interface{}, error) {
+	return decryptPayload(bindDecrypt(keeper.DecryptWithAssociatedData, associatedData), payload)
+}
+
+func (keeper *CryptKeeper) EncryptDeterministic(toEnc []byte) (string, error) {
+	return encryptDeterministic(keeper, toEnc)
+}
+
+func (keeper *CryptKeeper) DecryptDeterministic(value string) ([]byte, error) {
+	return decryptDeterministic(keeper, value)
+}
+
+func (keeper *CryptKeeper) BlindIndex(value []byte) (string, error) {
+	return blindIndex(keeper, value)
+}
+
+// payloadEncrypter is implemented by keepers that encrypt the fields of a payload differently
+// from single tokens, such as EnvelopeCryptKeeper sharing a data key between them.
+type payloadEncrypter interface {
+	payloadEncrypt(associatedData []byte) func([]byte) (string, error)
+}
+
+// encryptFunc returns the function keeper encrypts the fields of a payload with.
+func encryptFunc(keeper CryptKeeperInterface, associatedData []byte) func([]byte) (string, error) {
+	if encrypter, ok := keeper.(payloadEncrypter); ok {
+		return encrypter.payloadEncrypt(associatedData)
 	}
-	result := &map[string]interface{}{}
-	err = json.Unmarshal(decrypted, result)
-	if err != nil {
-		return nil, err
+	return bindEncrypt(keeper.EncryptWithAssociatedData, associatedData)
+}
+
+func bindEncrypt(encrypt func([]byte, []byte) (string, error), associatedData []byte) func([]byte) (string, error) {
+	return func(toEnc []byte) (string, error) {
+		return encrypt(toEnc, associatedData)
 	}
-	final := *payload
-	for key, value := range *result {
-		final[key] = value
+}
+
+func bindDecrypt(decrypt func(string, []byte) ([]byte, error), associatedData []byte) func(string) ([]byte, error) {
+	return func(value string) ([]byte, error) {
+		return decrypt(value, associatedData)
 	}
-	delete(final, "ENCRYPTED_PAYLOAD")
-	return &final, nil
 }
 
 func makeCipher(key string) (cipher.Block, error) {
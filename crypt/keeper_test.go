@@ -3,6 +3,7 @@ package crypt
 import (
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -20,15 +21,34 @@ func init() {
 func TestGetIV(t *testing.T) {
 	chance := Chance.New()
 	value := base64.StdEncoding.EncodeToString([]byte(chance.Word()))
-	iv := base64.StdEncoding.EncodeToString([]byte(chance.String()))
-	tag := base64.StdEncoding.EncodeToString([]byte(chance.String()))
-	val1, val2, val3 := getIV(value + TokenSeparator + iv + TokenSeparator + tag)
+	iv := base64.StdEncoding.EncodeToString([]byte(chance.StringN(IVSize)))
+	tag := base64.StdEncoding.EncodeToString([]byte(chance.StringN(GCMTagSize)))
+	val1, val2, val3, err := getIV(value + TokenSeparator + iv + TokenSeparator + tag)
 
+	assert.Nil(t, err, "should parse a well formed token")
 	assert.Equal(t, value, base64.StdEncoding.EncodeToString(val1), "should parse value out of string and return base64 encoded byte array")
 	assert.Equal(t, iv, base64.StdEncoding.EncodeToString(val2), "should parse value out of string and return base64 encoded byte array")
 	assert.Equal(t, tag, base64.StdEncoding.EncodeToString(val3), "should parse value out of string and return base64 encoded byte array")
 }
 
+func TestGetIVErrorHandling(t *testing.T) {
+	chance := Chance.New()
+	value := base64.StdEncoding.EncodeToString([]byte(chance.Word()))
+	iv := base64.StdEncoding.EncodeToString([]byte(chance.StringN(IVSize)))
+	tag := base64.StdEncoding.EncodeToString([]byte(chance.StringN(GCMTagSize)))
+
+	_, _, _, err := getIV(value + TokenSeparator + iv)
+	assert.True(t, errors.Is(err, ErrMalformedToken), "should reject tokens with missing segments")
+	_, _, _, err = getIV(value + TokenSeparator + iv + TokenSeparator + tag + TokenSeparator + value)
+	assert.True(t, errors.Is(err, ErrMalformedToken), "should reject tokens with a key id segment")
+	_, _, _, err = getIV(value + TokenSeparator + iv + TokenSeparator + tag + TokenSeparator + value + TokenSeparator + value)
+	assert.True(t, errors.Is(err, ErrMalformedToken), "should reject tokens with extra segments")
+	_, _, _, err = getIV("not base64!" + TokenSeparator + iv + TokenSeparator + tag)
+	assert.True(t, errors.Is(err, ErrMalformedToken), "should reject segments that are not base64")
+	_, _, _, err = getIV(value + TokenSeparator + tag + TokenSeparator + tag)
+	assert.True(t, errors.Is(err, ErrMalformedToken), "should reject an iv of the wrong size")
+}
+
 func TestSetIV(t *testing.T) {
 	chance := Chance.New()
 	value, _ := base64.StdEncoding.DecodeString(chance.Word())
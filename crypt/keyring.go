@@ -0,0 +1,205 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrUnknownKeyID   = errors.New("token was encrypted with an unknown key id")
+	ErrDuplicateKeyID = errors.New("key id is already present in the keyring")
+	ErrInvalidKeyID   = errors.New("key id must be non-empty and at most 65535 bytes long")
+)
+
+// Key is an AES key with the identifier that gets stamped into every token it encrypts.
+// Value is base64 encoded, the same format accepted by MakeCryptKeeper.
+type Key struct {
+	ID    string
+	Value string
+}
+
+// KeyringCryptKeeper encrypts with a single active key and decrypts with the active key
+// or any of the retired keys, selecting the key from the id recorded in the token.
+type KeyringCryptKeeper struct {
+	mu       sync.RWMutex
+	activeID string
+	ciphers  map[string]cipher.Block
+	// order holds the active key first followed by retired keys, newest first.
+	// It is the order keys are tried in for legacy tokens that carry no key id.
+	order []string
+}
+
+func validateKeyID(id string) error {
+	if id == "" || len(id) > maxFieldLength {
+		return ErrInvalidKeyID
+	}
+	return nil
+}
+
+func (keeper *KeyringCryptKeeper) addKey(key Key) error {
+	if err := validateKeyID(key.ID); err != nil {
+		return err
+	}
+	if _, ok := keeper.ciphers[key.ID]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicateKeyID, key.ID)
+	}
+	block, err := makeCipher(key.Value)
+	if err != nil {
+		return err
+	}
+	keeper.ciphers[key.ID] = block
+	return nil
+}
+
+// ActiveKeyID returns the id of the key new tokens are encrypted with.
+func (keeper *KeyringCryptKeeper) ActiveKeyID() string {
+	keeper.mu.RLock()
+	defer keeper.mu.RUnlock()
+	return keeper.activeID
+}
+
+// KeyIDs returns the ids of all keys in the keyring, active key first.
+func (keeper *KeyringCryptKeeper) KeyIDs() []string {
+	keeper.mu.RLock()
+	defer keeper.mu.RUnlock()
+	return append([]string{}, keeper.order...)
+}
+
+// Rotate makes key the active key. The previously active key is retired and remains
+// available for decryption.
+func (keeper *KeyringCryptKeeper) Rotate(key Key) error {
+	keeper.mu.Lock()
+	defer keeper.mu.Unlock()
+	if err := keeper.addKey(key); err != nil {
+		return err
+	}
+	keeper.activeID = key.ID
+	keeper.order = append([]string{key.ID}, keeper.order...)
+	return nil
+}
+
+// activate makes the key with id, which must already be in the keyring, the active key.
+func (keeper *KeyringCryptKeeper) activate(id string) error {
+	keeper.mu.Lock()
+	defer keeper.mu.Unlock()
+	if _, ok := keeper.ciphers[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKeyID, id)
+	}
+	order := []string{id}
+	for _, other := range keeper.order {
+		if other != id {
+			order = append(order, other)
+		}
+	}
+	keeper.activeID = id
+	keeper.order = order
+	return nil
+}
+
+// AddRetiredKey adds a key that is only used for decryption. It is tried after all
+// keys already in the keyring when decrypting legacy tokens.
+func (keeper *KeyringCryptKeeper) AddRetiredKey(key Key) error {
+	keeper.mu.Lock()
+	defer keeper.mu.Unlock()
+	if err := keeper.addKey(key); err != nil {
+		return err
+	}
+	keeper.order = append(keeper.order, key.ID)
+	return nil
+}
+
+func (keeper *KeyringCryptKeeper) sealingKey() (*envelope, cipher.Block, error) {
+	keeper.mu.RLock()
+	defer keeper.mu.RUnlock()
+	return &envelope{keyID: keeper.activeID}, keeper.ciphers[keeper.activeID], nil
+}
+
+func (keeper *KeyringCryptKeeper) openingKeys(env *envelope) ([]cipher.Block, error) {
+	keeper.mu.RLock()
+	defer keeper.mu.RUnlock()
+	if env.keyID != "" {
+		block, ok := keeper.ciphers[env.keyID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKeyID, env.keyID)
+		}
+		return []cipher.Block{block}, nil
+	}
+	blocks := make([]cipher.Block, 0, len(keeper.order))
+	for _, id := range keeper.order {
+		blocks = append(blocks, keeper.ciphers[id])
+	}
+	return blocks, nil
+}
+
+func (keeper *KeyringCryptKeeper) Encrypt(toEnc []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, nil)
+}
+
+func (keeper *KeyringCryptKeeper) EncryptWithAssociatedData(toEnc []byte, associatedData []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, associatedData)
+}
+
+func (keeper *KeyringCryptKeeper) EncryptPayload(payload *map[string]interface{}, whitelist *[]string) (*map[string]interface{}, error) {
+	return encryptPayload(keeper.Encrypt, payload, whitelist)
+}
+
+func (keeper *KeyringCryptKeeper) EncryptPayloadWithAssociatedData(payload *map[string]interface{}, whitelist *[]string, associatedData []byte) (*map[string]interface{}, error) {
+	return encryptPayload(bindEncrypt(keeper.EncryptWithAssociatedData, associatedData), payload, whitelist)
+}
+
+func (keeper *KeyringCryptKeeper) Decrypt(value string) ([]byte, error) {
+	return openEnvelope(keeper, value, nil)
+}
+
+func (keeper *KeyringCryptKeeper) DecryptWithAssociatedData(value string, associatedData []byte) ([]byte, error) {
+	return openEnvelope(keeper, value, associatedData)
+}
+
+func (keeper *KeyringCryptKeeper) DecryptPayload(payload *map[string]interface{}) (*map[string]interface{}, error) {
+	return decryptPayload(keeper.Decrypt, payload)
+}
+
+func (keeper *KeyringCryptKeeper) DecryptPayloadWithAssociatedData(payload *map[string]interface{}, associatedData []byte) (*map[string]interface{}, error) {
+	return decryptPayload(bindDecrypt(keeper.DecryptWithAssociatedData, associatedData), payload)
+}
+
+func (keeper *KeyringCryptKeeper) EncryptDeterministic(toEnc []byte) (string, error) {
+	return encryptDeterministic(keeper, toEnc)
+}
+
+func (keeper *KeyringCryptKeeper) DecryptDeterministic(value string) ([]byte, error) {
+	return decryptDeterministic(keeper, value)
+}
+
+func (keeper *KeyringCryptKeeper) BlindIndex(value []byte) (string, error) {
+	return blindIndex(keeper, value)
+}
+
+// BlindIndexes returns the blind index of value under every key in the keyring, active key
+// first, so that values indexed before a rotation can still be looked up.
+func (keeper *KeyringCryptKeeper) BlindIndexes(value []byte) []string {
+	keeper.mu.RLock()
+	defer keeper.mu.RUnlock()
+	indexes := make([]string, 0, len(keeper.order))
+	for _, id := range keeper.order {
+		indexes = append(indexes, blindIndexWith(keeper.ciphers[id], value))
+	}
+	return indexes
+}
+
+// MakeKeyringCryptKeeper creates a keeper that encrypts with active and can also decrypt
+// tokens produced by any of the retired keys. Retired keys should be given newest first.
+func MakeKeyringCryptKeeper(active Key, retired ...Key) (*KeyringCryptKeeper, error) {
+	keeper := &KeyringCryptKeeper{ciphers: map[string]cipher.Block{}}
+	if err := keeper.Rotate(active); err != nil {
+		return nil, err
+	}
+	for _, key := range retired {
+		if err := keeper.AddRetiredKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return keeper, nil
+}
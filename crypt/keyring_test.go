@@ -0,0 +1,153 @@
+package crypt
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	Chance "github.com/ZeFort/chance"
+	"github.com/stretchr/testify/assert"
+)
+
+var TestRetiredSecretKey string
+
+func init() {
+	hexbytes, _ := hex.DecodeString("6368616e676520746869732070617373776f726420746f206120736563726566")
+	TestRetiredSecretKey = base64.StdEncoding.EncodeToString(hexbytes)
+}
+
+func TestMakeKeyringCryptKeeper(t *testing.T) {
+	keeper, err := MakeKeyringCryptKeeper(Key{"v2", TestSecretKey}, Key{"v1", TestRetiredSecretKey})
+	assert.Nil(t, err, "No error is thrown")
+	assert.Equal(t, "v2", keeper.ActiveKeyID(), "first key should be active")
+	assert.Equal(t, []string{"v2", "v1"}, keeper.KeyIDs(), "should list active key first")
+
+	_, err = MakeKeyringCryptKeeper(Key{"v1", "abc"})
+	assert.NotNil(t, err, "Error is thrown due to invalid secret key")
+	_, err = MakeKeyringCryptKeeper(Key{"", TestSecretKey})
+	assert.True(t, errors.Is(err, ErrInvalidKeyID), "Error is thrown due to empty key id")
+	_, err = MakeKeyringCryptKeeper(Key{"v1", TestSecretKey}, Key{"v1", TestRetiredSecretKey})
+	assert.True(t, errors.Is(err, ErrDuplicateKeyID), "Error is thrown due to duplicate key id")
+}
+
+func TestKeyringEncryptStampsKeyID(t *testing.T) {
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	encrypted, err := keeper.Encrypt([]byte(Chance.New().Word()))
+	if err != nil {
+		panic(err)
+	}
+	env, err := parseToken(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", env.keyID, "should stamp the active key id into the token")
+
+	keyID, err := TokenKeyID(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", keyID, "should return the key id of the token")
+	stream := encryptStream(keeper, []byte("value"), testChunkSize)
+	keyID, err = StreamKeyID(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", keyID, "should return the key id of the stream")
+	_, err = StreamKeyID(stream[:streamFixedHeader])
+	assert.True(t, errors.Is(err, ErrStreamMalformed), "should fail on a truncated stream header")
+}
+
+func TestKeyringRotateAndDecrypt(t *testing.T) {
+	chance := Chance.New()
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestRetiredSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(chance.Word())
+	oldToken, err := keeper.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+
+	err = keeper.Rotate(Key{"v2", TestSecretKey})
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", keeper.ActiveKeyID(), "rotated key should be active")
+
+	newToken, err := keeper.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+	env, _ := parseToken(newToken)
+	assert.Equal(t, "v2", env.keyID, "should encrypt with the rotated key")
+
+	decrypted, err := keeper.Decrypt(oldToken)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens of retired keys")
+	decrypted, err = keeper.Decrypt(newToken)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens of the active key")
+}
+
+func TestKeyringDecryptUnknownKeyID(t *testing.T) {
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	other, err := MakeKeyringCryptKeeper(Key{"v9", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	encrypted, err := other.Encrypt([]byte(Chance.New().Word()))
+	if err != nil {
+		panic(err)
+	}
+	_, err = keeper.Decrypt(encrypted)
+	assert.True(t, errors.Is(err, ErrUnknownKeyID), "should not decrypt tokens of unknown key ids")
+}
+
+func TestKeyringDecryptLegacyToken(t *testing.T) {
+	chance := Chance.New()
+	legacy, err := MakeCryptKeeper(TestRetiredSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(chance.Word())
+	encrypted := legacyEncrypt(legacy.Cipher, toEncrypt)
+
+	keeper, err := MakeKeyringCryptKeeper(Key{"v2", TestSecretKey}, Key{"v1", TestRetiredSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	decrypted, err := keeper.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should try every key for legacy tokens")
+
+	keeper, err = MakeKeyringCryptKeeper(Key{"v2", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	_, err = keeper.Decrypt(encrypted)
+	assert.NotNil(t, err, "should fail when no key matches a legacy token")
+}
+
+func TestKeyringEncryptAndDecryptPayload(t *testing.T) {
+	chance := Chance.New()
+	keeper, err := MakeKeyringCryptKeeper(Key{"v1", TestSecretKey})
+	if err != nil {
+		panic(err)
+	}
+	payload := &map[string]interface{}{
+		"should-encrypt":     chance.String(),
+		"should-not-encrypt": chance.Word(),
+	}
+	encrypted, err := keeper.EncryptPayload(payload, &[]string{"should-not-encrypt"})
+	if err != nil {
+		panic(err)
+	}
+	env, _ := parseToken((*encrypted)["ENCRYPTED_PAYLOAD"].(string))
+	assert.Equal(t, "v1", env.keyID, "should stamp the key id into the encrypted payload")
+
+	keeper.Rotate(Key{"v2", TestRetiredSecretKey})
+	decrypted, err := keeper.DecryptPayload(encrypted)
+	assert.Nil(t, err)
+	_, ok := (*decrypted)["should-encrypt"]
+	assert.Equal(t, true, ok, "should have \"should-encrypt\" field")
+}
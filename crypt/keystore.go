@@ -0,0 +1,180 @@
+package crypt
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrKeyDestroyed    = errors.New("key was destroyed")
+	ErrSubjectNotFound = errors.New("no key exists for subject")
+)
+
+// KeyStore holds the wrapped data keys of subjects for SubjectCryptKeeper, which names them by
+// subject id, a keyed hash of the subject, rather than by the subject itself. Implementations
+// must be safe for concurrent use.
+type KeyStore interface {
+	// GetKey returns the wrapped key of subject, ErrSubjectNotFound if it has none or
+	// ErrKeyDestroyed if its key was destroyed.
+	GetKey(subject string) ([]byte, error)
+	// CreateKey stores key for subject unless it already has one, and returns the key the
+	// subject ends up with. It returns ErrKeyDestroyed if the key of subject was destroyed.
+	CreateKey(subject string, key []byte) ([]byte, error)
+	// DestroyKey irrecoverably removes the key of subject. Later calls for subject must
+	// return ErrKeyDestroyed.
+	DestroyKey(subject string) error
+}
+
+// MemoryKeyStore is a KeyStore held in memory, intended for tests.
+type MemoryKeyStore struct {
+	mu        sync.Mutex
+	keys      map[string][]byte
+	destroyed map[string]bool
+}
+
+func (store *MemoryKeyStore) GetKey(subject string) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.destroyed[subject] {
+		return nil, ErrKeyDestroyed
+	}
+	key, ok := store.keys[subject]
+	if !ok {
+		return nil, ErrSubjectNotFound
+	}
+	return append([]byte{}, key...), nil
+}
+
+func (store *MemoryKeyStore) CreateKey(subject string, key []byte) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.destroyed[subject] {
+		return nil, ErrKeyDestroyed
+	}
+	if existing, ok := store.keys[subject]; ok {
+		return append([]byte{}, existing...), nil
+	}
+	store.keys[subject] = append([]byte{}, key...)
+	return key, nil
+}
+
+func (store *MemoryKeyStore) DestroyKey(subject string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if key, ok := store.keys[subject]; ok {
+		for i := range key {
+			key[i] = 0
+		}
+		delete(store.keys, subject)
+	}
+	store.destroyed[subject] = true
+	return nil
+}
+
+func MakeMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: map[string][]byte{}, destroyed: map[string]bool{}}
+}
+
+// FileKeyStore is a KeyStore keeping one file per subject in a directory. Destroyed keys are
+// overwritten and leave an empty file behind as a tombstone, named after the subject id. Overwriting a file does not
+// guarantee the old contents are erased from every storage medium, which is why keys should
+// be stored wrapped, as SubjectCryptKeeper does.
+type FileKeyStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (store *FileKeyStore) path(subject string) string {
+	return filepath.Join(store.dir, base64.RawURLEncoding.EncodeToString([]byte(subject))+".key")
+}
+
+// withoutPath drops the path from file errors, as the file names encode the names of keys.
+func withoutPath(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return fmt.Errorf("key store %s failed: %w", pathErr.Op, pathErr.Err)
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return fmt.Errorf("key store %s failed: %w", linkErr.Op, linkErr.Err)
+	}
+	return err
+}
+
+func (store *FileKeyStore) GetKey(subject string) ([]byte, error) {
+	key, err := ioutil.ReadFile(store.path(subject))
+	if os.IsNotExist(err) {
+		return nil, ErrSubjectNotFound
+	}
+	if err != nil {
+		return nil, withoutPath(err)
+	}
+	if len(key) == 0 {
+		return nil, ErrKeyDestroyed
+	}
+	return key, nil
+}
+
+// CreateKey writes key to a temporary file and links it into place, so readers never see a
+// partly written key and an existing key or tombstone is never replaced.
+func (store *FileKeyStore) CreateKey(subject string, key []byte) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	file, err := ioutil.TempFile(store.dir, ".key-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(key)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = os.Link(file.Name(), store.path(subject))
+	if os.IsExist(err) {
+		return store.GetKey(subject)
+	}
+	if err != nil {
+		return nil, withoutPath(err)
+	}
+	return key, nil
+}
+
+func (store *FileKeyStore) DestroyKey(subject string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	file, err := os.OpenFile(store.path(subject), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return withoutPath(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return withoutPath(err)
+	}
+	if _, err := file.WriteAt(make([]byte, info.Size()), 0); err != nil {
+		return withoutPath(err)
+	}
+	if err := file.Truncate(0); err != nil {
+		return withoutPath(err)
+	}
+	return withoutPath(file.Sync())
+}
+
+// MakeFileKeyStore creates a FileKeyStore in dir, creating the directory if needed.
+func MakeFileKeyStore(dir string) (*FileKeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating key store directory: %w", err)
+	}
+	return &FileKeyStore{dir: dir}, nil
+}
@@ -0,0 +1,412 @@
+package crypt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// EncryptedPayloadField holds everything in a payload that is not kept in cleartext.
+	EncryptedPayloadField = "ENCRYPTED_PAYLOAD"
+	// EncryptedFieldsField lists the paths of fields that were encrypted individually in place.
+	EncryptedFieldsField = "ENCRYPTED_FIELDS"
+)
+
+var ErrMalformedPayload = errors.New("encrypted payload does not match the payload structure")
+
+// PayloadSelectors decide how EncryptPayloadWithSelectors treats each field of a payload.
+// Fields matched by Encrypt are replaced by their own token in place. Fields matched by Clear
+// stay in cleartext, and everything else is moved into the ENCRYPTED_PAYLOAD field.
+type PayloadSelectors struct {
+	Clear   []string
+	Encrypt []string
+}
+
+// pathEntry is a value moved into ENCRYPTED_PAYLOAD together with the path it was taken from.
+type pathEntry struct {
+	Path  []interface{} `json:"path"`
+	Value interface{}   `json:"value"`
+}
+
+// keepNode marks the parts of a payload that stay in cleartext.
+type keepNode struct {
+	all      bool
+	children map[interface{}]*keepNode
+}
+
+func (node *keepNode) add(path payloadPath) {
+	for _, step := range path {
+		if node.all {
+			return
+		}
+		if node.children == nil {
+			node.children = map[interface{}]*keepNode{}
+		}
+		child, ok := node.children[step]
+		if !ok {
+			child = &keepNode{}
+			node.children[step] = child
+		}
+		node = child
+	}
+	node.all = true
+	node.children = nil
+}
+
+// split separates value into the cleartext skeleton kept by node and the entries to encrypt.
+// Array elements that are not kept are replaced by null so that indices stay stable.
+func (node *keepNode) split(value interface{}, path payloadPath, removed *[]pathEntry) interface{} {
+	switch container := value.(type) {
+	case map[string]interface{}:
+		kept := map[string]interface{}{}
+		for key, child := range container {
+			if childNode, ok := node.children[key]; ok {
+				kept[key] = childNode.keep(child, path.child(key), removed)
+			} else {
+				*removed = append(*removed, pathEntry{path.child(key), child})
+			}
+		}
+		return kept
+	case []interface{}:
+		kept := make([]interface{}, len(container))
+		for index, child := range container {
+			if childNode, ok := node.children[index]; ok {
+				kept[index] = childNode.keep(child, path.child(index), removed)
+			} else {
+				*removed = append(*removed, pathEntry{path.child(index), child})
+			}
+		}
+		return kept
+	}
+	return value
+}
+
+func (node *keepNode) keep(value interface{}, path payloadPath, removed *[]pathEntry) interface{} {
+	if node.all {
+		return value
+	}
+	return node.split(value, path, removed)
+}
+
+func copyValue(value interface{}) interface{} {
+	switch container := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(container))
+		for key, child := range container {
+			copied[key] = copyValue(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(container))
+		for index, child := range container {
+			copied[index] = copyValue(child)
+		}
+		return copied
+	}
+	return value
+}
+
+func getPath(value interface{}, path payloadPath) (interface{}, error) {
+	for _, step := range path {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			key, ok := step.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrMalformedPayload, path)
+			}
+			if value, ok = container[key]; !ok {
+				return nil, fmt.Errorf("%w: %s", ErrMalformedPayload, path)
+			}
+		case []interface{}:
+			index, ok := step.(int)
+			if !ok || index < 0 || index >= len(container) {
+				return nil, fmt.Errorf("%w: %s", ErrMalformedPayload, path)
+			}
+			value = container[index]
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrMalformedPayload, path)
+		}
+	}
+	return value, nil
+}
+
+func setPath(root map[string]interface{}, path payloadPath, value interface{}) error {
+	if len(path) == 0 {
+		return fmt.Errorf("%w: empty path", ErrMalformedPayload)
+	}
+	parent, err := getPath(root, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		if key, ok := path[len(path)-1].(string); ok {
+			container[key] = value
+			return nil
+		}
+	case []interface{}:
+		if index, ok := path[len(path)-1].(int); ok && index >= 0 && index < len(container) {
+			container[index] = value
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrMalformedPayload, path)
+}
+
+// encryptFields replaces the values at paths with their own tokens and returns the paths
+// that were encrypted. Paths nested within another selected path are left to their ancestor.
+func encryptFields(encrypt func([]byte) (string, error), payload map[string]interface{}, paths []payloadPath) ([]string, error) {
+	selected := &keepNode{}
+	for _, path := range paths {
+		selected.add(path)
+	}
+	encrypted := []string{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		if !selected.selects(path) || seen[path.String()] {
+			continue
+		}
+		seen[path.String()] = true
+		value, err := getPath(payload, path)
+		if err != nil {
+			return nil, err
+		}
+		jsonstr, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		token, err := encrypt(jsonstr)
+		if err != nil {
+			return nil, err
+		}
+		if err := setPath(payload, path, token); err != nil {
+			return nil, err
+		}
+		encrypted = append(encrypted, path.String())
+	}
+	return encrypted, nil
+}
+
+// selects reports whether path itself, rather than one of its ancestors, is selected.
+func (node *keepNode) selects(path payloadPath) bool {
+	for _, step := range path {
+		if node.all {
+			return false
+		}
+		node = node.children[step]
+	}
+	return node.all
+}
+
+// encryptPayload keeps the fields of whitelist in cleartext. Whitelist entries are top-level
+// keys taken literally, as they were before selectors existed, unless they start with "$" as in
+// "$.user.address.zip", which makes them selectors.
+func encryptPayload(encrypt func([]byte) (string, error), payload *map[string]interface{}, whitelist *[]string) (*map[string]interface{}, error) {
+	clear := make([]string, 0, len(*whitelist))
+	for _, entry := range *whitelist {
+		if !strings.HasPrefix(entry, "$") {
+			entry = payloadPath{entry}.String()
+		}
+		clear = append(clear, entry)
+	}
+	return encryptPayloadWithSelectors(encrypt, payload, &PayloadSelectors{Clear: clear})
+}
+
+func encryptPayloadWithSelectors(encrypt func([]byte) (string, error), payload *map[string]interface{}, selectors *PayloadSelectors) (*map[string]interface{}, error) {
+	source := copyValue(*payload).(map[string]interface{})
+	clearPaths, err := selectPaths(source, selectors.Clear)
+	if err != nil {
+		return nil, err
+	}
+	fieldPaths, err := selectPaths(source, selectors.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+	encryptedFields, err := encryptFields(encrypt, source, fieldPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := &keepNode{}
+	for _, path := range append(clearPaths, fieldPaths...) {
+		kept.add(path)
+	}
+	removed := []pathEntry{}
+	finalPayload := kept.keep(source, payloadPath{}, &removed).(map[string]interface{})
+	if len(encryptedFields) > 0 {
+		finalPayload[EncryptedFieldsField] = encryptedFields
+	}
+	if len(removed) == 0 {
+		return &finalPayload, nil
+	}
+
+	// Payloads that only lose top-level keys keep the original flat format, which is a JSON
+	// object of those keys. Anything else is stored as a list of path and value entries.
+	var toEncrypt interface{} = removed
+	flat := map[string]interface{}{}
+	for _, entry := range removed {
+		if len(entry.Path) != 1 {
+			flat = nil
+			break
+		}
+		flat[entry.Path[0].(string)] = entry.Value
+	}
+	if flat != nil {
+		toEncrypt = flat
+	}
+	jsonstr, err := json.Marshal(toEncrypt)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encrypt(jsonstr)
+	if err != nil {
+		return nil, err
+	}
+	finalPayload[EncryptedPayloadField] = encrypted
+	return &finalPayload, nil
+}
+
+func decodePath(raw []interface{}) (payloadPath, error) {
+	path := payloadPath{}
+	for _, step := range raw {
+		switch v := step.(type) {
+		case string:
+			path = append(path, v)
+		case float64:
+			path = append(path, int(v))
+		case json.Number:
+			index, err := v.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid path step %v", ErrMalformedPayload, step)
+			}
+			path = append(path, int(index))
+		default:
+			return nil, fmt.Errorf("%w: invalid path step %v", ErrMalformedPayload, step)
+		}
+	}
+	return path, nil
+}
+
+func restoreEncryptedPayload(decrypt func(string) ([]byte, error), unmarshal func([]byte, interface{}) error, final map[string]interface{}, toDecrypt interface{}) error {
+	token, ok := toDecrypt.(string)
+	if !ok {
+		return fmt.Errorf("%w: %s is not a string", ErrMalformedPayload, EncryptedPayloadField)
+	}
+	decrypted, err := decrypt(token)
+	if err != nil {
+		return err
+	}
+	var result interface{}
+	if err := unmarshal(decrypted, &result); err != nil {
+		return err
+	}
+	switch restored := result.(type) {
+	case map[string]interface{}:
+		for key, value := range restored {
+			final[key] = value
+		}
+	case []interface{}:
+		for _, raw := range restored {
+			entry, ok := raw.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%w: invalid entry", ErrMalformedPayload)
+			}
+			steps, ok := entry["path"].([]interface{})
+			if !ok {
+				return fmt.Errorf("%w: invalid entry path", ErrMalformedPayload)
+			}
+			path, err := decodePath(steps)
+			if err != nil {
+				return err
+			}
+			if err := setPath(final, path, entry["value"]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unexpected %s contents", ErrMalformedPayload, EncryptedPayloadField)
+	}
+	return nil
+}
+
+func restoreEncryptedFields(decrypt func(string) ([]byte, error), unmarshal func([]byte, interface{}) error, final map[string]interface{}, fields interface{}) error {
+	var paths []string
+	switch v := fields.(type) {
+	case []string:
+		paths = v
+	case []interface{}:
+		for _, raw := range v {
+			path, ok := raw.(string)
+			if !ok {
+				return fmt.Errorf("%w: %s must list paths", ErrMalformedPayload, EncryptedFieldsField)
+			}
+			paths = append(paths, path)
+		}
+	default:
+		return fmt.Errorf("%w: %s must list paths", ErrMalformedPayload, EncryptedFieldsField)
+	}
+	for _, raw := range paths {
+		path, err := parsePath(raw)
+		if err != nil {
+			return err
+		}
+		value, err := getPath(final, path)
+		if err != nil {
+			return err
+		}
+		token, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%w: %s is not a token", ErrMalformedPayload, raw)
+		}
+		decrypted, err := decrypt(token)
+		if err != nil {
+			return err
+		}
+		var restored interface{}
+		if err := unmarshal(decrypted, &restored); err != nil {
+			return err
+		}
+		if err := setPath(final, path, restored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decryptPayload(decrypt func(string) ([]byte, error), payload *map[string]interface{}) (*map[string]interface{}, error) {
+	return decryptPayloadWith(decrypt, json.Unmarshal, payload)
+}
+
+// decryptPayloadWith is decryptPayload with the function used to decode encrypted values.
+func decryptPayloadWith(decrypt func(string) ([]byte, error), unmarshal func([]byte, interface{}) error, payload *map[string]interface{}) (*map[string]interface{}, error) {
+	toDecrypt, hasPayload := (*payload)[EncryptedPayloadField]
+	fields, hasFields := (*payload)[EncryptedFieldsField]
+	if !hasPayload && !hasFields {
+		return payload, nil
+	}
+	final := *payload
+	if hasPayload {
+		if err := restoreEncryptedPayload(decrypt, unmarshal, final, toDecrypt); err != nil {
+			return nil, err
+		}
+		delete(final, EncryptedPayloadField)
+	}
+	if hasFields {
+		if err := restoreEncryptedFields(decrypt, unmarshal, final, fields); err != nil {
+			return nil, err
+		}
+		delete(final, EncryptedFieldsField)
+	}
+	return &final, nil
+}
+
+// EncryptPayloadWithSelectors encrypts payload as described by selectors. It is the selector
+// based counterpart of EncryptPayload: a whitelist is the same as selectors.Clear, except that
+// whitelist entries not starting with "$" name top-level keys literally, while every entry of
+// selectors.Clear is a selector. The result is decrypted with DecryptPayload, or with
+// DecryptPayloadWithAssociatedData when associatedData is not empty.
+func EncryptPayloadWithSelectors(keeper CryptKeeperInterface, payload *map[string]interface{}, selectors *PayloadSelectors, associatedData []byte) (*map[string]interface{}, error) {
+	return encryptPayloadWithSelectors(encryptFunc(keeper, associatedData), payload, selectors)
+}
@@ -0,0 +1,162 @@
+package crypt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPayload = `{
+	"id": "order-1",
+	"user": {"name": "Jane", "email": "jane@example.com", "address": {"zip": "10001", "city": "New York"}},
+	"items": [
+		{"sku": "a-1", "card": "4111111111111111", "qty": 1},
+		{"sku": "b-2", "card": "5500000000000004", "qty": 2}
+	],
+	"tags": ["x", "y", "z"],
+	"a.b": true
+}`
+
+func makeTestPayload() *map[string]interface{} {
+	payload := &map[string]interface{}{}
+	if err := json.Unmarshal([]byte(testPayload), payload); err != nil {
+		panic(err)
+	}
+	return payload
+}
+
+func TestEncryptPayloadWithNestedSelectors(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	selectors := &PayloadSelectors{Clear: []string{"id", "user.address.city", "items[*].sku", "tags[1]", "['a.b']"}}
+	encrypted, err := EncryptPayloadWithSelectors(crypter, makeTestPayload(), selectors, nil)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, "order-1", (*encrypted)["id"], "should keep top-level fields in cleartext")
+	assert.Equal(t, map[string]interface{}{"address": map[string]interface{}{"city": "New York"}}, (*encrypted)["user"],
+		"should keep only the selected nested fields")
+	assert.Equal(t, []interface{}{map[string]interface{}{"sku": "a-1"}, map[string]interface{}{"sku": "b-2"}}, (*encrypted)["items"],
+		"should keep the selected fields of every array element")
+	assert.Equal(t, []interface{}{nil, "y", nil}, (*encrypted)["tags"], "should keep array indices stable")
+	assert.Equal(t, true, (*encrypted)["a.b"], "should select quoted member names")
+	assert.IsType(t, "", (*encrypted)[EncryptedPayloadField], "should have an encrypted payload")
+
+	decrypted, err := crypter.DecryptPayload(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, makeTestPayload(), decrypted, "should restore the original payload")
+}
+
+func TestEncryptPayloadFieldsInPlace(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	selectors := &PayloadSelectors{
+		Clear:   []string{"id", "user", "items", "tags"},
+		Encrypt: []string{"user.email", "items[*].card", "items[0]"},
+	}
+	encrypted, err := EncryptPayloadWithSelectors(crypter, makeTestPayload(), selectors, nil)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, []string{"user.email", "items[1].card", "items[0]"}, (*encrypted)[EncryptedFieldsField],
+		"should record the encrypted paths, leaving nested paths to their ancestor")
+	user := (*encrypted)["user"].(map[string]interface{})
+	assert.Equal(t, "Jane", user["name"], "should keep unselected siblings in cleartext")
+	assert.NotEqual(t, "jane@example.com", user["email"], "should encrypt the selected field")
+	assert.IsType(t, "", (*encrypted)["items"].([]interface{})[0], "should encrypt a whole array element")
+
+	// Round trip through JSON as payloads usually are stored.
+	stored, err := json.Marshal(encrypted)
+	if err != nil {
+		panic(err)
+	}
+	loaded := &map[string]interface{}{}
+	if err := json.Unmarshal(stored, loaded); err != nil {
+		panic(err)
+	}
+	decrypted, err := crypter.DecryptPayload(loaded)
+	assert.Nil(t, err)
+	assert.Equal(t, makeTestPayload(), decrypted, "should restore the original payload")
+}
+
+func TestEncryptPayloadDoesNotModifyInput(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	payload := makeTestPayload()
+	_, err = EncryptPayloadWithSelectors(crypter, payload, &PayloadSelectors{Encrypt: []string{"user.email"}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, makeTestPayload(), payload, "should not modify the payload")
+}
+
+func TestEncryptPayloadKeepsFlatFormat(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	encrypted, err := crypter.EncryptPayload(makeTestPayload(), &[]string{"id", "tags"})
+	if err != nil {
+		panic(err)
+	}
+	decrypted, err := crypter.Decrypt((*encrypted)[EncryptedPayloadField].(string))
+	if err != nil {
+		panic(err)
+	}
+	blob := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(decrypted, &blob), "should encrypt a JSON object of the removed top-level fields")
+	assert.Equal(t, []string{"a.b", "items", "user"}, sortedKeys(blob))
+}
+
+func TestEncryptPayloadInvalidSelector(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	_, err = EncryptPayloadWithSelectors(crypter, makeTestPayload(), &PayloadSelectors{Clear: []string{"items[one]"}}, nil)
+	assert.True(t, errors.Is(err, ErrInvalidSelector), "should reject invalid selectors")
+	_, err = crypter.EncryptPayload(makeTestPayload(), &[]string{"$.user..name"})
+	assert.True(t, errors.Is(err, ErrInvalidSelector), "should reject invalid whitelist selectors")
+}
+
+func TestEncryptPayloadLiteralWhitelist(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	encrypted, err := crypter.EncryptPayload(makeTestPayload(), &[]string{"id", "user.name", "items[one]", "a.b"})
+	assert.Nil(t, err, "should not parse whitelist entries missing from the payload")
+	assert.Equal(t, []string{EncryptedPayloadField, "a.b", "id"}, sortedKeys(*encrypted),
+		"should only keep top-level keys named by the whitelist")
+
+	encrypted, err = crypter.EncryptPayload(makeTestPayload(), &[]string{"id", "$.user.name"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "Jane"}, (*encrypted)["user"], "should select nested fields with \"$.\"")
+}
+
+func TestDecryptMalformedPayload(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	encrypted, err := EncryptPayloadWithSelectors(crypter, makeTestPayload(), &PayloadSelectors{Clear: []string{"user.name"}}, nil)
+	if err != nil {
+		panic(err)
+	}
+	delete(*encrypted, "user")
+	_, err = crypter.DecryptPayload(encrypted)
+	assert.True(t, errors.Is(err, ErrMalformedPayload), "should fail when the cleartext structure was changed")
+
+	_, err = crypter.DecryptPayload(&map[string]interface{}{EncryptedFieldsField: []interface{}{"id"}, "id": 1})
+	assert.True(t, errors.Is(err, ErrMalformedPayload), "should fail when an encrypted field is not a token")
+
+	_, err = crypter.DecryptPayload(&map[string]interface{}{EncryptedPayloadField: base64.StdEncoding.EncodeToString([]byte("x"))})
+	assert.NotNil(t, err, "should fail on an invalid encrypted payload")
+}
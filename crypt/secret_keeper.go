@@ -0,0 +1,123 @@
+package crypt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SecretSource returns the current version of a secret: the id of the version, empty for
+// secrets without versions, and the base64 encoded key it holds. secrets.KeySource adapts the
+// fetch functions of the secrets package, such as secrets.FetchSecretFromAWSSecretManager.
+type SecretSource interface {
+	SecretKey(secretName string) (version string, value string, err error)
+}
+
+// SecretSourceFunc is a function used as a SecretSource.
+type SecretSourceFunc func(secretName string) (string, string, error)
+
+func (fetch SecretSourceFunc) SecretKey(secretName string) (string, string, error) {
+	return fetch(secretName)
+}
+
+var ErrSecretValueChanged = errors.New("secret value changed without a new version")
+
+const (
+	// DefaultSecretReloadInterval is the interval of Watch when it is given none.
+	DefaultSecretReloadInterval = time.Minute
+	// unversioned is the key id of secrets that do not have a version.
+	unversioned = "unversioned"
+)
+
+// SecretCryptKeeper is a keyring whose keys are the versions of a secret. Reload makes a new
+// version of the secret the active key, keeping prior versions available for decryption.
+type SecretCryptKeeper struct {
+	*KeyringCryptKeeper
+	secretName string
+	source     SecretSource
+	mu         sync.Mutex
+	values     map[string]string
+}
+
+// fetchKey fetches the current version of the secret as a key.
+func fetchKey(source SecretSource, secretName string) (Key, error) {
+	version, value, err := source.SecretKey(secretName)
+	if err != nil {
+		return Key{}, err
+	}
+	if version == "" {
+		version = unversioned
+	}
+	return Key{ID: version, Value: value}, nil
+}
+
+// Reload fetches the secret and, if its version is not the active key, makes it the active key.
+// Versions seen before are activated again rather than added, so rolling a secret back works.
+func (keeper *SecretCryptKeeper) Reload() error {
+	key, err := fetchKey(keeper.source, keeper.secretName)
+	if err != nil {
+		return err
+	}
+	keeper.mu.Lock()
+	defer keeper.mu.Unlock()
+	if value, ok := keeper.values[key.ID]; ok {
+		if value != key.Value {
+			return fmt.Errorf("%w: %s version %s", ErrSecretValueChanged, keeper.secretName, key.ID)
+		}
+		if key.ID == keeper.ActiveKeyID() {
+			return nil
+		}
+		return keeper.activate(key.ID)
+	}
+	if err := keeper.Rotate(key); err != nil {
+		return err
+	}
+	keeper.values[key.ID] = key.Value
+	return nil
+}
+
+// Watch reloads the secret every interval, DefaultSecretReloadInterval if it is not positive,
+// until ctx is done. Reload errors are passed to onError, if not nil, and the current keys
+// stay in use.
+func (keeper *SecretCryptKeeper) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		interval = DefaultSecretReloadInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := keeper.Reload(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// MakeSecretCryptKeeper creates a keeper from the current version of the secret named secretName,
+// for example:
+//
+//	keeper, err := crypt.MakeSecretCryptKeeper(secrets.DetermineSecretName(), secrets.KeySource(secrets.FetchSecretFromAWSSecretManager))
+func MakeSecretCryptKeeper(secretName string, source SecretSource) (*SecretCryptKeeper, error) {
+	key, err := fetchKey(source, secretName)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := MakeKeyringCryptKeeper(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretCryptKeeper{
+		KeyringCryptKeeper: keyring,
+		secretName:         secretName,
+		source:             source,
+		values:             map[string]string{key.ID: key.Value},
+	}, nil
+}
@@ -0,0 +1,101 @@
+package crypt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	Chance "github.com/ZeFort/chance"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSecretSource struct {
+	mu      sync.Mutex
+	version string
+	value   string
+	err     error
+}
+
+func (source *fakeSecretSource) set(version string, value string) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	source.version, source.value = version, value
+}
+
+func (source *fakeSecretSource) SecretKey(secretName string) (string, string, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	return source.version, source.value, source.err
+}
+
+func TestSecretCryptKeeperReload(t *testing.T) {
+	source := &fakeSecretSource{}
+	source.set("1", TestSecretKey)
+	keeper, err := MakeSecretCryptKeeper("service.ENCRYPTION_KEY", source)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, "1", keeper.ActiveKeyID(), "should use the secret version as the key id")
+	toEncrypt := []byte(Chance.New().String())
+	before, err := keeper.Encrypt(toEncrypt)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Nil(t, keeper.Reload())
+	assert.Equal(t, []string{"1"}, keeper.KeyIDs(), "should not change keys while the version is the same")
+
+	source.set("2", TestRetiredSecretKey)
+	assert.Nil(t, keeper.Reload())
+	assert.Equal(t, []string{"2", "1"}, keeper.KeyIDs(), "should make the new version active")
+	decrypted, err := keeper.Decrypt(before)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens of prior versions")
+
+	source.set("1", TestSecretKey)
+	assert.Nil(t, keeper.Reload())
+	assert.Equal(t, []string{"1", "2"}, keeper.KeyIDs(), "should activate a version seen before")
+
+	source.set("1", TestRetiredSecretKey)
+	assert.True(t, errors.Is(keeper.Reload(), ErrSecretValueChanged), "should refuse a changed value with the same version")
+	assert.Equal(t, "1", keeper.ActiveKeyID())
+}
+
+func TestSecretCryptKeeperWatch(t *testing.T) {
+	source := &fakeSecretSource{}
+	source.set("v1", TestSecretKey)
+	keeper, err := MakeSecretCryptKeeper("service.ENCRYPTION_KEY", source)
+	if err != nil {
+		panic(err)
+	}
+	errs := make(chan error, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keeper.Watch(ctx, time.Millisecond, func(err error) { errs <- err })
+	// A zero interval falls back to the default rather than panicking
+	keeper.Watch(ctx, 0, nil)
+
+	source.set("v2", TestRetiredSecretKey)
+	assert.Eventually(t, func() bool { return keeper.ActiveKeyID() == "v2" }, time.Second, time.Millisecond,
+		"should pick up a new version of the secret")
+
+	source.mu.Lock()
+	source.err = errors.New("secret manager unavailable")
+	source.mu.Unlock()
+	assert.NotNil(t, <-errs, "should report reload errors")
+	assert.Equal(t, "v2", keeper.ActiveKeyID(), "should keep the current keys when a reload fails")
+}
+
+func TestMakeSecretCryptKeeperErrorHandling(t *testing.T) {
+	source := &fakeSecretSource{err: errors.New("secret not found")}
+	_, err := MakeSecretCryptKeeper("service.ENCRYPTION_KEY", source)
+	assert.NotNil(t, err, "should return fetch errors")
+
+	source = &fakeSecretSource{}
+	source.set("", TestSecretKey)
+	keeper, err := MakeSecretCryptKeeper("service.ENCRYPTION_KEY", source)
+	assert.Nil(t, err)
+	assert.Equal(t, unversioned, keeper.ActiveKeyID(), "should accept secrets without a version")
+}
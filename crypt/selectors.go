@@ -0,0 +1,238 @@
+package crypt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Selectors pick fields out of a JSON payload with a small JSONPath-like syntax:
+//
+//	user.address.zip     nested object members
+//	items[0].id          array elements by index
+//	items[*].id          every element of an array
+//	*.id                 every member of an object
+//	['a.b']              members whose names contain '.', '[', ']' or '\''
+//
+// A leading "$." is optional, except in the whitelists of EncryptPayload, where entries without
+// it are top-level keys taken literally. A selector that names a top-level key verbatim always
+// selects that key.
+
+var ErrInvalidSelector = errors.New("invalid payload selector")
+
+type stepKind int
+
+const (
+	stepKey stepKind = iota
+	stepIndex
+	stepAny
+)
+
+type selectorStep struct {
+	kind  stepKind
+	key   string
+	index int
+}
+
+type selector []selectorStep
+
+func invalidSelector(raw string, reason string) error {
+	return fmt.Errorf("%w %q: %s", ErrInvalidSelector, raw, reason)
+}
+
+func parseSelector(raw string) (selector, error) {
+	rest := raw
+	if strings.HasPrefix(rest, "$.") {
+		rest = rest[2:]
+	} else if strings.HasPrefix(rest, "$[") {
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return nil, invalidSelector(raw, "empty selector")
+	}
+	steps := selector{}
+	expectKey := true
+	for len(rest) > 0 {
+		switch {
+		case rest[0] == '[':
+			step, consumed, err := parseBracket(raw, rest)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+			rest = rest[consumed:]
+			expectKey = false
+		case rest[0] == '.':
+			if expectKey {
+				return nil, invalidSelector(raw, "empty member name")
+			}
+			rest = rest[1:]
+			expectKey = true
+			if rest == "" {
+				return nil, invalidSelector(raw, "trailing '.'")
+			}
+		default:
+			if !expectKey {
+				return nil, invalidSelector(raw, "expected '.' or '['")
+			}
+			end := strings.IndexAny(rest, ".[]")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, invalidSelector(raw, "unexpected ']'")
+			}
+			name := rest[:end]
+			if name == "*" {
+				steps = append(steps, selectorStep{kind: stepAny})
+			} else {
+				steps = append(steps, selectorStep{kind: stepKey, key: name})
+			}
+			rest = rest[end:]
+			expectKey = false
+		}
+	}
+	return steps, nil
+}
+
+func parseBracket(raw string, rest string) (selectorStep, int, error) {
+	if strings.HasPrefix(rest, "['") {
+		var name strings.Builder
+		for i := 2; i < len(rest); i++ {
+			switch rest[i] {
+			case '\\':
+				if i+1 == len(rest) {
+					return selectorStep{}, 0, invalidSelector(raw, "unterminated escape")
+				}
+				i++
+				name.WriteByte(rest[i])
+			case '\'':
+				if i+1 == len(rest) || rest[i+1] != ']' {
+					return selectorStep{}, 0, invalidSelector(raw, "expected ']' after quoted name")
+				}
+				return selectorStep{kind: stepKey, key: name.String()}, i + 2, nil
+			default:
+				name.WriteByte(rest[i])
+			}
+		}
+		return selectorStep{}, 0, invalidSelector(raw, "unterminated quoted name")
+	}
+	end := strings.IndexByte(rest, ']')
+	if end == -1 {
+		return selectorStep{}, 0, invalidSelector(raw, "unterminated '['")
+	}
+	inner := rest[1:end]
+	if inner == "*" {
+		return selectorStep{kind: stepAny}, end + 1, nil
+	}
+	index, err := strconv.Atoi(inner)
+	if err != nil || index < 0 {
+		return selectorStep{}, 0, invalidSelector(raw, "array index must be a non-negative integer or '*'")
+	}
+	return selectorStep{kind: stepIndex, index: index}, end + 1, nil
+}
+
+// payloadPath is a concrete location in a payload: a sequence of member names and array indices.
+type payloadPath []interface{}
+
+func (path payloadPath) String() string {
+	var out strings.Builder
+	for i, step := range path {
+		switch v := step.(type) {
+		case int:
+			out.WriteString("[" + strconv.Itoa(v) + "]")
+		case string:
+			if v == "" || v == "*" || strings.HasPrefix(v, "$") || strings.ContainsAny(v, ".[]'\\") {
+				out.WriteString("['" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(v) + "']")
+			} else {
+				if i > 0 {
+					out.WriteString(".")
+				}
+				out.WriteString(v)
+			}
+		}
+	}
+	return out.String()
+}
+
+func (path payloadPath) child(step interface{}) payloadPath {
+	return append(append(payloadPath{}, path...), step)
+}
+
+// expand returns the concrete paths within value matched by the selector.
+func (sel selector) expand(value interface{}, prefix payloadPath) []payloadPath {
+	if len(sel) == 0 {
+		return []payloadPath{prefix}
+	}
+	step, rest := sel[0], sel[1:]
+	paths := []payloadPath{}
+	switch container := value.(type) {
+	case map[string]interface{}:
+		switch step.kind {
+		case stepKey:
+			if child, ok := container[step.key]; ok {
+				paths = append(paths, rest.expand(child, prefix.child(step.key))...)
+			}
+		case stepAny:
+			keys := make([]string, 0, len(container))
+			for key := range container {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				paths = append(paths, rest.expand(container[key], prefix.child(key))...)
+			}
+		}
+	case []interface{}:
+		switch step.kind {
+		case stepIndex:
+			if step.index < len(container) {
+				paths = append(paths, rest.expand(container[step.index], prefix.child(step.index))...)
+			}
+		case stepAny:
+			for index, child := range container {
+				paths = append(paths, rest.expand(child, prefix.child(index))...)
+			}
+		}
+	}
+	return paths
+}
+
+// selectPaths returns the concrete paths in payload matched by any of the raw selectors.
+func selectPaths(payload map[string]interface{}, raws []string) ([]payloadPath, error) {
+	paths := []payloadPath{}
+	for _, raw := range raws {
+		if _, ok := payload[raw]; ok {
+			paths = append(paths, payloadPath{raw})
+			continue
+		}
+		sel, err := parseSelector(raw)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, sel.expand(payload, payloadPath{})...)
+	}
+	return paths, nil
+}
+
+// parsePath parses a concrete path as written by payloadPath.String.
+func parsePath(raw string) (payloadPath, error) {
+	sel, err := parseSelector(raw)
+	if err != nil {
+		return nil, err
+	}
+	path := payloadPath{}
+	for _, step := range sel {
+		switch step.kind {
+		case stepKey:
+			path = append(path, step.key)
+		case stepIndex:
+			path = append(path, step.index)
+		default:
+			return nil, invalidSelector(raw, "wildcards are not allowed in a path")
+		}
+	}
+	return path, nil
+}
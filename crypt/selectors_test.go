@@ -0,0 +1,71 @@
+package crypt
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestParseSelector(t *testing.T) {
+	sel, err := parseSelector("$.items[2].tags[*]")
+	assert.Nil(t, err)
+	assert.Equal(t, selector{
+		{kind: stepKey, key: "items"},
+		{kind: stepIndex, index: 2},
+		{kind: stepKey, key: "tags"},
+		{kind: stepAny},
+	}, sel)
+
+	sel, err = parseSelector(`*['it\'s.a'].x`)
+	assert.Nil(t, err)
+	assert.Equal(t, selector{{kind: stepAny}, {kind: stepKey, key: "it's.a"}, {kind: stepKey, key: "x"}}, sel)
+
+	for _, raw := range []string{"", "$.", "a.", ".a", "a..b", "a[", "a[-1]", "a[x]", "a]b", "a['b", "a['b'c]", "a[0]b"} {
+		_, err := parseSelector(raw)
+		assert.True(t, errors.Is(err, ErrInvalidSelector), "should reject %q", raw)
+	}
+}
+
+func TestPayloadPathString(t *testing.T) {
+	for _, path := range []payloadPath{
+		{"user", "email"},
+		{"items", 0, "card"},
+		{"a.b", "c"},
+		{"$x", `it's\`},
+		{"*", ""},
+	} {
+		parsed, err := parsePath(path.String())
+		assert.Nil(t, err)
+		assert.Equal(t, path, parsed, "should parse %s back to the same path", path)
+	}
+	_, err := parsePath("items[*]")
+	assert.True(t, errors.Is(err, ErrInvalidSelector), "should reject wildcards in paths")
+}
+
+func TestSelectPaths(t *testing.T) {
+	payload := map[string]interface{}{
+		"a.b":   1,
+		"items": []interface{}{map[string]interface{}{"id": 1}, map[string]interface{}{"id": 2}, "x"},
+		"user":  map[string]interface{}{"name": "n", "zip": "z"},
+	}
+	paths, err := selectPaths(payload, []string{"a.b", "items[*].id", "user.*", "missing.field", "items[7]"})
+	assert.Nil(t, err)
+	assert.Equal(t, []payloadPath{
+		{"a.b"},
+		{"items", 0, "id"},
+		{"items", 1, "id"},
+		{"user", "name"},
+		{"user", "zip"},
+	}, paths, "should expand selectors to the paths present in the payload")
+}
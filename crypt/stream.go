@@ -0,0 +1,333 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streams are encrypted in fixed size chunks with AES-GCM under a random per-stream key.
+// The stream key is encrypted with the keeper and stored in the stream header:
+//
+//	magic "CKS" | version (1 byte) | chunk size (4 bytes) | key token length (2 bytes) |
+//	key token | nonce prefix (7 bytes)
+//
+// Each chunk is sealed with the nonce prefix | chunk counter (4 bytes) | final flag (1 byte)
+// and the header as additional data, so reordered, dropped or truncated chunks and a
+// missing final chunk are all detected.
+const (
+	StreamVersion1    byte = 1
+	DefaultChunkSize       = 64 * 1024
+	maxChunkSize           = 16 * 1024 * 1024
+	streamKeySize          = 32
+	streamNoncePrefix      = 7
+	streamFixedHeader      = 3 + 1 + 4 + 2
+	streamFinalChunk  byte = 1
+)
+
+var (
+	streamMagic = []byte("CKS")
+
+	ErrStreamMalformed = errors.New("encrypted stream header is malformed")
+	ErrStreamTruncated = errors.New("encrypted stream is truncated")
+	ErrStreamCorrupt   = errors.New("encrypted stream chunk failed authentication")
+	ErrStreamTooLong   = errors.New("encrypted stream exceeds the maximum number of chunks")
+	ErrStreamClosed    = errors.New("encrypted stream writer is closed")
+)
+
+type streamCipher struct {
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+}
+
+func newStreamCipher(key []byte, header []byte, prefix []byte) (*streamCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &streamCipher{aead: aead, header: header, prefix: prefix}, nil
+}
+
+func (sc *streamCipher) nonce(final bool) []byte {
+	nonce := make([]byte, IVSize)
+	copy(nonce, sc.prefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefix:], sc.counter)
+	if final {
+		nonce[IVSize-1] = streamFinalChunk
+	}
+	return nonce
+}
+
+func (sc *streamCipher) advance() error {
+	if sc.counter == 1<<32-1 {
+		return ErrStreamTooLong
+	}
+	sc.counter++
+	return nil
+}
+
+type encryptWriter struct {
+	w         io.Writer
+	sc        *streamCipher
+	chunkSize int
+	buf       []byte
+	closed    bool
+	err       error
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it onto w.
+// Close must be called to write the final chunk; it does not close w.
+func NewEncryptWriter(keeper CryptKeeperInterface, w io.Writer) (io.WriteCloser, error) {
+	return NewEncryptWriterSize(keeper, w, DefaultChunkSize)
+}
+
+// NewEncryptWriterSize is NewEncryptWriter with a chunk size other than DefaultChunkSize.
+func NewEncryptWriterSize(keeper CryptKeeperInterface, w io.Writer, chunkSize int) (io.WriteCloser, error) {
+	return newEncryptWriter(keeper, w, chunkSize, nil)
+}
+
+// NewEncryptWriterWithAssociatedData is NewEncryptWriter with the stream bound to associatedData.
+// The same associated data must be given to NewDecryptReaderWithAssociatedData.
+func NewEncryptWriterWithAssociatedData(keeper CryptKeeperInterface, w io.Writer, associatedData []byte) (io.WriteCloser, error) {
+	return newEncryptWriter(keeper, w, DefaultChunkSize, associatedData)
+}
+
+func newEncryptWriter(keeper CryptKeeperInterface, w io.Writer, chunkSize int, associatedData []byte) (io.WriteCloser, error) {
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("chunk size must be between 1 and %d bytes", maxChunkSize)
+	}
+	key := make([]byte, streamKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, streamNoncePrefix)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	// Binding the stream key binds every chunk, as they are authenticated with that key.
+	token, err := keeper.EncryptWithAssociatedData(key, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	if len(token) > maxFieldLength {
+		return nil, fmt.Errorf("%w: stream key token is too long", ErrStreamMalformed)
+	}
+
+	header := make([]byte, streamFixedHeader, streamFixedHeader+len(token)+streamNoncePrefix)
+	copy(header, streamMagic)
+	header[3] = StreamVersion1
+	binary.BigEndian.PutUint32(header[4:8], uint32(chunkSize))
+	binary.BigEndian.PutUint16(header[8:10], uint16(len(token)))
+	header = append(header, token...)
+	header = append(header, prefix...)
+
+	sc, err := newStreamCipher(key, header, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, sc: sc, chunkSize: chunkSize, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (ew *encryptWriter) flush(final bool) error {
+	sealed := ew.sc.aead.Seal(nil, ew.sc.nonce(final), ew.buf, ew.sc.header)
+	if _, err := ew.w.Write(sealed); err != nil {
+		return err
+	}
+	ew.buf = ew.buf[:0]
+	if final {
+		return nil
+	}
+	return ew.sc.advance()
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, ErrStreamClosed
+	}
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only written once more data arrives, so that the final
+		// chunk written by Close is never empty unless the whole stream is.
+		if len(ew.buf) == ew.chunkSize {
+			if ew.err = ew.flush(false); ew.err != nil {
+				return written, ew.err
+			}
+		}
+		n := ew.chunkSize - len(ew.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		ew.buf = append(ew.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	if ew.err != nil {
+		return ew.err
+	}
+	return ew.flush(true)
+}
+
+type decryptReader struct {
+	r     *bufio.Reader
+	sc    *streamCipher
+	chunk []byte
+	plain []byte
+	done  bool
+	err   error
+}
+
+// IsStream reports whether header, the first bytes of a ciphertext, starts an encrypted stream
+// rather than a token. Tokens are base64 encoded, so they never start with the stream version.
+func IsStream(header []byte) bool {
+	return len(header) >= len(streamMagic)+1 && bytes.Equal(header[:len(streamMagic)], streamMagic) &&
+		header[len(streamMagic)] == StreamVersion1
+}
+
+// NewDecryptReader reads the stream header from r and returns a reader of the decrypted
+// stream. Reads return an error rather than io.EOF if the stream was truncated or tampered with.
+func NewDecryptReader(keeper CryptKeeperInterface, r io.Reader) (io.Reader, error) {
+	return newDecryptReader(keeper, r, nil)
+}
+
+// NewDecryptReaderWithAssociatedData decrypts a stream written by NewEncryptWriterWithAssociatedData.
+func NewDecryptReaderWithAssociatedData(keeper CryptKeeperInterface, r io.Reader, associatedData []byte) (io.Reader, error) {
+	return newDecryptReader(keeper, r, associatedData)
+}
+
+// readStreamHeader reads the stream header from r and returns it with the chunk size.
+func readStreamHeader(r io.Reader) ([]byte, int, error) {
+	fixed := make([]byte, streamFixedHeader)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrStreamMalformed, err.Error())
+	}
+	if !bytes.Equal(fixed[:3], streamMagic) {
+		return nil, 0, fmt.Errorf("%w: missing stream magic", ErrStreamMalformed)
+	}
+	if fixed[3] != StreamVersion1 {
+		return nil, 0, fmt.Errorf("%w: %d", ErrUnknownVersion, fixed[3])
+	}
+	chunkSize := int(binary.BigEndian.Uint32(fixed[4:8]))
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return nil, 0, fmt.Errorf("%w: invalid chunk size %d", ErrStreamMalformed, chunkSize)
+	}
+	rest := make([]byte, int(binary.BigEndian.Uint16(fixed[8:10]))+streamNoncePrefix)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrStreamMalformed, err.Error())
+	}
+	return append(fixed, rest...), chunkSize, nil
+}
+
+// StreamKeyID returns the id of the key the stream key in header, the first bytes of a stream,
+// was encrypted with, or "" if it records none.
+func StreamKeyID(header []byte) (string, error) {
+	header, _, err := readStreamHeader(bytes.NewReader(header))
+	if err != nil {
+		return "", err
+	}
+	return TokenKeyID(string(streamToken(header)))
+}
+
+// streamToken returns the key token of a stream header.
+func streamToken(header []byte) []byte {
+	return header[streamFixedHeader : len(header)-streamNoncePrefix]
+}
+
+func newDecryptReader(keeper CryptKeeperInterface, r io.Reader, associatedData []byte) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, chunkSize, err := readStreamHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	token, prefix := streamToken(header), header[len(header)-streamNoncePrefix:]
+	key, err := keeper.DecryptWithAssociatedData(string(token), associatedData)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != streamKeySize {
+		return nil, fmt.Errorf("%w: invalid stream key", ErrStreamMalformed)
+	}
+	sc, err := newStreamCipher(key, header, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, sc: sc, chunk: make([]byte, chunkSize+GCMTagSize)}, nil
+}
+
+func (dr *decryptReader) readChunk() error {
+	n, err := io.ReadFull(dr.r, dr.chunk)
+	final := false
+	switch {
+	case err == io.EOF:
+		return ErrStreamTruncated
+	case err == io.ErrUnexpectedEOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := dr.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < GCMTagSize {
+		return ErrStreamTruncated
+	}
+	plain, err := dr.sc.aead.Open(nil, dr.sc.nonce(final), dr.chunk[:n], dr.sc.header)
+	if err != nil {
+		// A chunk that only opens as a non-final chunk means the stream ended early.
+		if final {
+			if _, err := dr.sc.aead.Open(nil, dr.sc.nonce(false), dr.chunk[:n], dr.sc.header); err == nil {
+				return ErrStreamTruncated
+			}
+		}
+		return ErrStreamCorrupt
+	}
+	dr.plain = plain
+	if final {
+		dr.done = true
+		return nil
+	}
+	return dr.sc.advance()
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		dr.err = dr.readChunk()
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
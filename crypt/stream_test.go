@@ -0,0 +1,185 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testChunkSize = 16
+
+func encryptStream(keeper CryptKeeperInterface, plain []byte, chunkSize int) []byte {
+	out := &bytes.Buffer{}
+	writer, err := NewEncryptWriterSize(keeper, out, chunkSize)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := writer.Write(plain); err != nil {
+		panic(err)
+	}
+	if err := writer.Close(); err != nil {
+		panic(err)
+	}
+	return out.Bytes()
+}
+
+func decryptStream(keeper CryptKeeperInterface, encrypted []byte) ([]byte, error) {
+	reader, err := NewDecryptReader(keeper, bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func randomBytes(size int) []byte {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func streamHeaderSize(encrypted []byte) int {
+	return streamFixedHeader + int(encrypted[8])<<8 + int(encrypted[9]) + streamNoncePrefix
+}
+
+func TestEncryptAndDecryptStream(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	for _, size := range []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize + 1, 5 * testChunkSize} {
+		plain := randomBytes(size)
+		decrypted, err := decryptStream(crypter, encryptStream(crypter, plain, testChunkSize))
+		assert.Nil(t, err)
+		assert.Equal(t, plain, decrypted, "should decrypt a stream of %d bytes", size)
+	}
+}
+
+func TestEncryptStreamInSmallWrites(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	plain := randomBytes(3*testChunkSize + 5)
+	out := &bytes.Buffer{}
+	writer, err := NewEncryptWriterSize(crypter, out, testChunkSize)
+	if err != nil {
+		panic(err)
+	}
+	for i := range plain {
+		writer.Write(plain[i : i+1])
+	}
+	writer.Close()
+	_, err = writer.Write(plain)
+	assert.Equal(t, ErrStreamClosed, err, "should not write after close")
+
+	decrypted, err := decryptStream(crypter, out.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, plain, decrypted, "should decrypt a stream written byte by byte")
+}
+
+func TestDecryptStreamTruncated(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	encrypted := encryptStream(crypter, randomBytes(3*testChunkSize), testChunkSize)
+	header := streamHeaderSize(encrypted)
+	sealedChunk := testChunkSize + GCMTagSize
+
+	_, err = decryptStream(crypter, encrypted[:header+sealedChunk])
+	assert.True(t, errors.Is(err, ErrStreamTruncated), "should detect streams truncated at a chunk boundary")
+
+	_, err = decryptStream(crypter, encrypted[:header])
+	assert.True(t, errors.Is(err, ErrStreamTruncated), "should detect streams without chunks")
+
+	_, err = decryptStream(crypter, encrypted[:header+sealedChunk+5])
+	assert.NotNil(t, err, "should detect streams truncated within a chunk")
+}
+
+func TestDecryptStreamReordered(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	encrypted := encryptStream(crypter, randomBytes(3*testChunkSize), testChunkSize)
+	header := streamHeaderSize(encrypted)
+	sealedChunk := testChunkSize + GCMTagSize
+	first := encrypted[header : header+sealedChunk]
+	second := encrypted[header+sealedChunk : header+2*sealedChunk]
+
+	reordered := append([]byte{}, encrypted[:header]...)
+	reordered = append(reordered, second...)
+	reordered = append(reordered, first...)
+	reordered = append(reordered, encrypted[header+2*sealedChunk:]...)
+	_, err = decryptStream(crypter, reordered)
+	assert.True(t, errors.Is(err, ErrStreamCorrupt), "should detect reordered chunks")
+}
+
+func TestDecryptStreamErrorHandling(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	encrypted := encryptStream(crypter, randomBytes(testChunkSize), testChunkSize)
+
+	_, err = decryptStream(crypter, append([]byte("XYZ"), encrypted[3:]...))
+	assert.True(t, errors.Is(err, ErrStreamMalformed), "should reject streams without the magic")
+
+	_, err = decryptStream(crypter, encrypted[:5])
+	assert.True(t, errors.Is(err, ErrStreamMalformed), "should reject streams with an incomplete header")
+
+	other, err := MakeCryptKeeper(TestRetiredSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	_, err = decryptStream(other, encrypted)
+	assert.NotNil(t, err, "should fail to decrypt a stream with the wrong key")
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = decryptStream(crypter, tampered)
+	assert.True(t, errors.Is(err, ErrStreamCorrupt), "should detect tampered chunks")
+}
+
+func TestEncryptAndDecryptStreamWithAssociatedData(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	plain := randomBytes(3 * testChunkSize)
+	out := &bytes.Buffer{}
+	writer, err := NewEncryptWriterWithAssociatedData(crypter, out, []byte("exports/1"))
+	if err != nil {
+		panic(err)
+	}
+	writer.Write(plain)
+	writer.Close()
+
+	_, err = NewDecryptReaderWithAssociatedData(crypter, bytes.NewReader(out.Bytes()), []byte("exports/2"))
+	assert.NotNil(t, err, "should fail to decrypt a stream bound to other associated data")
+
+	reader, err := NewDecryptReaderWithAssociatedData(crypter, bytes.NewReader(out.Bytes()), []byte("exports/1"))
+	assert.Nil(t, err)
+	decrypted, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, decrypted, "should decrypt a stream with the same associated data")
+}
+
+func TestIsStream(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	token, err := crypter.Encrypt([]byte("value"))
+	assert.Nil(t, err)
+	assert.True(t, IsStream(encryptStream(crypter, []byte("value"), testChunkSize)), "should recognise streams")
+	assert.False(t, IsStream([]byte(token)), "should not take tokens for streams")
+	assert.False(t, IsStream([]byte("CKS")), "should not take a short header for a stream")
+}
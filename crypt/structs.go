@@ -0,0 +1,162 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Struct fields are treated according to their crypt tag:
+//
+//	crypt:"clear"    the field stays in cleartext
+//	crypt:"encrypt"  the field is moved into ENCRYPTED_PAYLOAD
+//
+// Untagged fields holding structs, pointers to structs or slices of structs are looked into,
+// so that tags on their fields apply. Any other untagged field is encrypted. Fields are named
+// as encoding/json names them.
+const StructTag = "crypt"
+
+var (
+	ErrInvalidStructTag = errors.New("invalid crypt struct tag")
+	ErrNotStruct        = errors.New("value is not a struct or a pointer to a struct")
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func joinSelector(prefix string, name string) string {
+	step := payloadPath{name}.String()
+	if prefix == "" || strings.HasPrefix(step, "[") {
+		return prefix + step
+	}
+	return prefix + "." + step
+}
+
+// marshalsItself reports whether values of t encode themselves, in which case their fields
+// are not looked into.
+func marshalsItself(t reflect.Type) bool {
+	return t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)
+}
+
+// structSelectors appends the selectors of the fields of t that are kept in cleartext.
+// visiting holds the struct types being looked into, to stop at recursive types.
+func structSelectors(t reflect.Type, prefix string, visiting map[reflect.Type]bool, clear *[]string) error {
+	if visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonTag := field.Tag.Get("json")
+		if jsonTag == "-" {
+			continue
+		}
+		name := strings.Split(jsonTag, ",")[0]
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			// encoding/json promotes the fields of embedded structs.
+			if err := structSelectors(fieldType, prefix, visiting, clear); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		selector := joinSelector(prefix, name)
+		switch tag := field.Tag.Get(StructTag); tag {
+		case "clear":
+			*clear = append(*clear, selector)
+		case "encrypt":
+		case "":
+			if fieldType.Kind() == reflect.Slice || fieldType.Kind() == reflect.Array {
+				fieldType = fieldType.Elem()
+				selector += "[*]"
+				if fieldType.Kind() == reflect.Ptr {
+					fieldType = fieldType.Elem()
+				}
+			}
+			if fieldType.Kind() == reflect.Struct && !marshalsItself(fieldType) {
+				if err := structSelectors(fieldType, selector, visiting, clear); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("%w: %q on field %s.%s", ErrInvalidStructTag, tag, t.Name(), field.Name)
+		}
+	}
+	return nil
+}
+
+// StructSelectors returns the payload selectors described by the crypt tags of the type of v.
+func StructSelectors(v interface{}) (*PayloadSelectors, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, ErrNotStruct
+	}
+	selectors := &PayloadSelectors{Clear: []string{}}
+	if err := structSelectors(t, "", map[reflect.Type]bool{}, &selectors.Clear); err != nil {
+		return nil, err
+	}
+	return selectors, nil
+}
+
+func unmarshalNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// EncryptStruct encrypts v, a struct or a pointer to a struct, into a payload as
+// EncryptPayload would, with the fields to keep in cleartext chosen by their crypt tags.
+func EncryptStruct(keeper CryptKeeperInterface, v interface{}) (*map[string]interface{}, error) {
+	selectors, err := StructSelectors(v)
+	if err != nil {
+		return nil, err
+	}
+	jsonstr, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Numbers are kept as json.Number so that integers are not rounded through float64.
+	payload := map[string]interface{}{}
+	if err := unmarshalNumbers(jsonstr, &payload); err != nil {
+		return nil, err
+	}
+	return encryptPayloadWithSelectors(encryptFunc(keeper, nil), &payload, selectors)
+}
+
+// DecryptStruct decrypts a payload produced by EncryptStruct into v, which must be a pointer
+// to a struct of the type that was encrypted. The payload is not modified.
+func DecryptStruct(keeper CryptKeeperInterface, payload *map[string]interface{}, v interface{}) error {
+	if t := reflect.TypeOf(v); t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return ErrNotStruct
+	}
+	copied := copyValue(*payload).(map[string]interface{})
+	decrypted, err := decryptPayloadWith(keeper.Decrypt, unmarshalNumbers, &copied)
+	if err != nil {
+		return err
+	}
+	jsonstr, err := json.Marshal(decrypted)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonstr, v)
+}
@@ -0,0 +1,93 @@
+package crypt
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testAddress struct {
+	Street string `json:"street" crypt:"encrypt"`
+	City   string `json:"city" crypt:"clear"`
+}
+
+type testLineItem struct {
+	SKU   string  `json:"sku" crypt:"clear"`
+	Price float64 `json:"price"`
+}
+
+type testAudit struct {
+	CreatedAt time.Time `json:"created_at" crypt:"clear"`
+}
+
+type testOrder struct {
+	testAudit
+	ID       int64          `json:"id" crypt:"clear"`
+	Customer string         `json:"customer" crypt:"encrypt"`
+	Card     string         `json:"card"`
+	Total    int64          `json:"total"`
+	Address  *testAddress   `json:"address"`
+	Items    []testLineItem `json:"items"`
+	Notes    map[string]int `json:"notes,omitempty" crypt:"encrypt"`
+	Parent   *testOrder     `json:"parent,omitempty"`
+	Ignored  string         `json:"-" crypt:"clear"`
+	internal string
+}
+
+func TestStructSelectors(t *testing.T) {
+	selectors, err := StructSelectors(&testOrder{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"created_at", "id", "address.city", "items[*].sku"}, selectors.Clear,
+		"should keep fields tagged clear, including nested and embedded fields")
+
+	_, err = StructSelectors("order")
+	assert.True(t, errors.Is(err, ErrNotStruct), "should only accept structs")
+
+	_, err = StructSelectors(struct {
+		Field string `crypt:"secret"`
+	}{})
+	assert.True(t, errors.Is(err, ErrInvalidStructTag), "should reject unknown tags")
+}
+
+func TestEncryptAndDecryptStruct(t *testing.T) {
+	crypter, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	order := &testOrder{
+		testAudit: testAudit{CreatedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		ID:        9007199254740993,
+		Customer:  "Jane",
+		Card:      "4111111111111111",
+		Total:     9007199254740995,
+		Address:   &testAddress{Street: "1 Main St", City: "Springfield"},
+		Items:     []testLineItem{{SKU: "a-1", Price: 9.99}, {SKU: "b-2", Price: 20}},
+		Notes:     map[string]int{"gift": 1},
+		Ignored:   "not encoded",
+	}
+	encrypted, err := EncryptStruct(crypter, order)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, json.Number("9007199254740993"), (*encrypted)["id"],
+		"should keep clear fields without rounding integers")
+	assert.Equal(t, map[string]interface{}{"city": "Springfield"}, (*encrypted)["address"])
+	_, ok := (*encrypted)["customer"]
+	assert.False(t, ok, "should encrypt fields tagged encrypt")
+	_, ok = (*encrypted)["card"]
+	assert.False(t, ok, "should encrypt untagged fields")
+
+	decrypted := &testOrder{}
+	err = DecryptStruct(crypter, encrypted, decrypted)
+	assert.Nil(t, err)
+	order.Ignored = ""
+	assert.Equal(t, order, decrypted, "should decode into the original types")
+	_, ok = (*encrypted)[EncryptedPayloadField]
+	assert.True(t, ok, "should not modify the payload")
+
+	err = DecryptStruct(crypter, encrypted, *decrypted)
+	assert.True(t, errors.Is(err, ErrNotStruct), "should require a pointer to a struct")
+}
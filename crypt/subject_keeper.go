@@ -0,0 +1,230 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	ErrSubjectMismatch = errors.New("token was encrypted for another subject")
+	ErrInvalidSubject  = errors.New("subject must be non-empty")
+)
+
+// SubjectCryptKeeper encrypts the data of each subject, such as a user, with a data key of
+// its own kept in a KeyStore. Destroying the key of a subject renders all of its tokens
+// unreadable without rewriting them: decrypting them returns ErrKeyDestroyed.
+//
+// Subjects are personal data, so neither tokens nor the key store hold them: both hold a
+// subject id instead, an HMAC-SHA256 of the subject under an index key kept in the key store.
+// Data keys and the index key are wrapped by the master keeper, data keys bound to their
+// subject id, before they are stored. Tokens record their subject id so that any token can be
+// decrypted with Decrypt.
+type SubjectCryptKeeper struct {
+	master CryptKeeperInterface
+	store  KeyStore
+	mutex  sync.Mutex
+	index  []byte
+}
+
+// subjectIndexKey is the name the index key is stored under. Subject ids are base64 encoded,
+// so they never collide with it.
+const subjectIndexKey = ".subject-index"
+
+// storedKey returns the key stored under name, unwrapped by the master keeper. If create is set
+// and name has no key, a new one is created.
+func (keeper *SubjectCryptKeeper) storedKey(name string, create bool) ([]byte, error) {
+	wrapped, err := keeper.store.GetKey(name)
+	if errors.Is(err, ErrSubjectNotFound) && create {
+		key := make([]byte, DataKeySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		token, err := keeper.master.EncryptWithAssociatedData(key, []byte(name))
+		if err != nil {
+			return nil, err
+		}
+		// Another process may have created a key for name first, in which case that key is used.
+		wrapped, err = keeper.store.CreateKey(name, []byte(token))
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := keeper.master.DecryptWithAssociatedData(string(wrapped), []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != DataKeySize {
+		return nil, ErrInvalidDataKeySize
+	}
+	return key, nil
+}
+
+// subjectID returns the id tokens and the key store hold in place of subject.
+func (keeper *SubjectCryptKeeper) subjectID(subject string) (string, error) {
+	keeper.mutex.Lock()
+	defer keeper.mutex.Unlock()
+	if keeper.index == nil {
+		index, err := keeper.storedKey(subjectIndexKey, true)
+		if err != nil {
+			return "", err
+		}
+		keeper.index = index
+	}
+	mac := hmac.New(sha256.New, keeper.index)
+	mac.Write([]byte(subject))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (keeper *SubjectCryptKeeper) subjectKey(subjectID string, create bool) (cipher.Block, error) {
+	dataKey, err := keeper.storedKey(subjectID, create)
+	if err != nil {
+		return nil, err
+	}
+	return aes.NewCipher(dataKey)
+}
+
+func (keeper *SubjectCryptKeeper) sealingKey() (*envelope, cipher.Block, error) {
+	return nil, nil, fmt.Errorf("%w: use ForSubject to encrypt", ErrInvalidSubject)
+}
+
+func (keeper *SubjectCryptKeeper) openingKeys(env *envelope) ([]cipher.Block, error) {
+	if env.subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject id", ErrInvalidSubject)
+	}
+	block, err := keeper.subjectKey(env.subject, false)
+	if err != nil {
+		return nil, err
+	}
+	return []cipher.Block{block}, nil
+}
+
+// Decrypt decrypts a token of any subject.
+func (keeper *SubjectCryptKeeper) Decrypt(value string) ([]byte, error) {
+	return openEnvelope(keeper, value, nil)
+}
+
+func (keeper *SubjectCryptKeeper) DecryptWithAssociatedData(value string, associatedData []byte) ([]byte, error) {
+	return openEnvelope(keeper, value, associatedData)
+}
+
+func (keeper *SubjectCryptKeeper) DecryptPayload(payload *map[string]interface{}) (*map[string]interface{}, error) {
+	return decryptPayload(keeper.Decrypt, payload)
+}
+
+func (keeper *SubjectCryptKeeper) DecryptPayloadWithAssociatedData(payload *map[string]interface{}, associatedData []byte) (*map[string]interface{}, error) {
+	return decryptPayload(bindDecrypt(keeper.DecryptWithAssociatedData, associatedData), payload)
+}
+
+// DestroySubject destroys the data key of subject. Tokens of subject can not be decrypted
+// afterwards, and no new data can be encrypted for it.
+func (keeper *SubjectCryptKeeper) DestroySubject(subject string) error {
+	if err := validateSubject(subject); err != nil {
+		return err
+	}
+	subjectID, err := keeper.subjectID(subject)
+	if err != nil {
+		return err
+	}
+	return keeper.store.DestroyKey(subjectID)
+}
+
+// ForSubject returns a keeper that encrypts with the data key of subject, creating the key
+// on first use. It only decrypts tokens of subject.
+func (keeper *SubjectCryptKeeper) ForSubject(subject string) (CryptKeeperInterface, error) {
+	if err := validateSubject(subject); err != nil {
+		return nil, err
+	}
+	subjectID, err := keeper.subjectID(subject)
+	if err != nil {
+		return nil, err
+	}
+	return &subjectKeeper{parent: keeper, subjectID: subjectID}, nil
+}
+
+func validateSubject(subject string) error {
+	if subject == "" {
+		return ErrInvalidSubject
+	}
+	return nil
+}
+
+// subjectKeeper is the keeper returned by ForSubject.
+type subjectKeeper struct {
+	parent    *SubjectCryptKeeper
+	subjectID string
+}
+
+func (keeper *subjectKeeper) sealingKey() (*envelope, cipher.Block, error) {
+	block, err := keeper.parent.subjectKey(keeper.subjectID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &envelope{subject: keeper.subjectID}, block, nil
+}
+
+func (keeper *subjectKeeper) openingKeys(env *envelope) ([]cipher.Block, error) {
+	if env.subject != keeper.subjectID {
+		return nil, ErrSubjectMismatch
+	}
+	return keeper.parent.openingKeys(env)
+}
+
+func (keeper *subjectKeeper) Encrypt(toEnc []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, nil)
+}
+
+func (keeper *subjectKeeper) EncryptWithAssociatedData(toEnc []byte, associatedData []byte) (string, error) {
+	return sealEnvelope(keeper, toEnc, associatedData)
+}
+
+func (keeper *subjectKeeper) EncryptPayload(payload *map[string]interface{}, whitelist *[]string) (*map[string]interface{}, error) {
+	return encryptPayload(keeper.Encrypt, payload, whitelist)
+}
+
+func (keeper *subjectKeeper) EncryptPayloadWithAssociatedData(payload *map[string]interface{}, whitelist *[]string, associatedData []byte) (*map[string]interface{}, error) {
+	return encryptPayload(bindEncrypt(keeper.EncryptWithAssociatedData, associatedData), payload, whitelist)
+}
+
+func (keeper *subjectKeeper) Decrypt(value string) ([]byte, error) {
+	return openEnvelope(keeper, value, nil)
+}
+
+func (keeper *subjectKeeper) DecryptWithAssociatedData(value string, associatedData []byte) ([]byte, error) {
+	return openEnvelope(keeper, value, associatedData)
+}
+
+func (keeper *subjectKeeper) DecryptPayload(payload *map[string]interface{}) (*map[string]interface{}, error) {
+	return decryptPayload(keeper.Decrypt, payload)
+}
+
+func (keeper *subjectKeeper) DecryptPayloadWithAssociatedData(payload *map[string]interface{}, associatedData []byte) (*map[string]interface{}, error) {
+	return decryptPayload(bindDecrypt(keeper.DecryptWithAssociatedData, associatedData), payload)
+}
+
+func (keeper *subjectKeeper) EncryptDeterministic(toEnc []byte) (string, error) {
+	return encryptDeterministic(keeper, toEnc)
+}
+
+func (keeper *subjectKeeper) DecryptDeterministic(value string) ([]byte, error) {
+	return decryptDeterministic(keeper, value)
+}
+
+func (keeper *subjectKeeper) BlindIndex(value []byte) (string, error) {
+	return blindIndex(keeper, value)
+}
+
+// MakeSubjectCryptKeeper creates a keeper for per-subject data keys kept in store and wrapped
+// by master.
+func MakeSubjectCryptKeeper(master CryptKeeperInterface, store KeyStore) *SubjectCryptKeeper {
+	return &SubjectCryptKeeper{master: master, store: store}
+}
@@ -0,0 +1,156 @@
+package crypt
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	Chance "github.com/ZeFort/chance"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestSubjectKeeper(store KeyStore) *SubjectCryptKeeper {
+	master, err := MakeCryptKeeper(TestSecretKey)
+	if err != nil {
+		panic(err)
+	}
+	return MakeSubjectCryptKeeper(master, store)
+}
+
+func TestSubjectCryptKeeper(t *testing.T) {
+	chance := Chance.New()
+	keeper := makeTestSubjectKeeper(MakeMemoryKeyStore())
+	alice, err := keeper.ForSubject("user-alice")
+	if err != nil {
+		panic(err)
+	}
+	bob, err := keeper.ForSubject("user-bob")
+	if err != nil {
+		panic(err)
+	}
+	toEncrypt := []byte(chance.String())
+	encrypted, err := alice.Encrypt(toEncrypt)
+	assert.Nil(t, err)
+	env, err := parseToken(encrypted)
+	assert.Nil(t, err)
+	aliceID, err := keeper.subjectID("user-alice")
+	assert.Nil(t, err)
+	assert.Equal(t, aliceID, env.subject, "should record the subject id")
+	assert.NotContains(t, env.subject, "alice", "should not record the subject")
+
+	decrypted, err := alice.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens of the subject")
+	decrypted, err = keeper.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, toEncrypt, decrypted, "should decrypt tokens of any subject with the parent keeper")
+	_, err = bob.Decrypt(encrypted)
+	assert.True(t, errors.Is(err, ErrSubjectMismatch), "should not decrypt tokens of another subject")
+
+	_, err = keeper.ForSubject("")
+	assert.True(t, errors.Is(err, ErrInvalidSubject), "should reject an empty subject")
+}
+
+func TestSubjectCryptKeeperDestroy(t *testing.T) {
+	chance := Chance.New()
+	keeper := makeTestSubjectKeeper(MakeMemoryKeyStore())
+	alice, _ := keeper.ForSubject("user-alice")
+	bob, _ := keeper.ForSubject("user-bob")
+	payload := &map[string]interface{}{"id": chance.Word(), "email": chance.String()}
+	alicePayload, err := alice.EncryptPayload(payload, &[]string{"id"})
+	if err != nil {
+		panic(err)
+	}
+	aliceToken, err := alice.Encrypt([]byte(chance.String()))
+	if err != nil {
+		panic(err)
+	}
+	bobToken, err := bob.Encrypt([]byte(chance.String()))
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Nil(t, keeper.DestroySubject("user-alice"))
+	_, err = alice.Decrypt(aliceToken)
+	assert.True(t, errors.Is(err, ErrKeyDestroyed), "should report destroyed keys")
+	_, err = keeper.Decrypt(aliceToken)
+	assert.True(t, errors.Is(err, ErrKeyDestroyed), "should report destroyed keys to the parent keeper")
+	_, err = keeper.DecryptPayload(alicePayload)
+	assert.True(t, errors.Is(err, ErrKeyDestroyed), "should report destroyed keys when decrypting payloads")
+	_, err = alice.Encrypt([]byte(chance.String()))
+	assert.True(t, errors.Is(err, ErrKeyDestroyed), "should not encrypt for a destroyed subject")
+
+	_, err = keeper.Decrypt(bobToken)
+	assert.Nil(t, err, "should still decrypt tokens of other subjects")
+}
+
+func TestFileKeyStore(t *testing.T) {
+	store, err := MakeFileKeyStore(t.TempDir())
+	if err != nil {
+		panic(err)
+	}
+	_, err = store.GetKey("user/1")
+	assert.True(t, errors.Is(err, ErrSubjectNotFound))
+
+	key, err := store.CreateKey("user/1", []byte("first"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("first"), key)
+	key, err = store.CreateKey("user/1", []byte("second"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("first"), key, "should keep the key a subject already has")
+
+	assert.Nil(t, store.DestroyKey("user/1"))
+	_, err = store.GetKey("user/1")
+	assert.True(t, errors.Is(err, ErrKeyDestroyed), "should report destroyed keys")
+	_, err = store.CreateKey("user/1", []byte("third"))
+	assert.True(t, errors.Is(err, ErrKeyDestroyed), "should not recreate destroyed keys")
+
+	keeper := makeTestSubjectKeeper(store)
+	subject, _ := keeper.ForSubject("user/2")
+	encrypted, err := subject.Encrypt([]byte("hello"))
+	assert.Nil(t, err)
+	decrypted, err := makeTestSubjectKeeper(store).Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), decrypted, "should persist subject keys")
+
+	_, err = keeper.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Nil(t, keeper.DestroySubject("user/2"))
+	_, err = keeper.Decrypt(encrypted)
+	assert.NotContains(t, err.Error(), "user/2", "should keep subjects out of errors")
+	files, err := ioutil.ReadDir(store.dir)
+	assert.Nil(t, err)
+	for _, file := range files {
+		assert.NotContains(t, file.Name(), base64.RawURLEncoding.EncodeToString([]byte("user/2")), "should keep subjects out of file names")
+	}
+}
+
+func TestFileKeyStoreConcurrentCreate(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		// Every store stands for another process sharing the directory
+		store, err := MakeFileKeyStore(dir)
+		if err != nil {
+			panic(err)
+		}
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.CreateKey("user/1", []byte(fmt.Sprint("key-", i)))
+			assert.Nil(t, err)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := store.GetKey("user/1")
+			assert.False(t, errors.Is(err, ErrKeyDestroyed), "should never see a partly created key")
+		}()
+	}
+	wg.Wait()
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1, "should not leave temporary files behind")
+}
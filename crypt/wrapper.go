@@ -0,0 +1,95 @@
+package crypt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// KeyWrapper encrypts and decrypts the data keys used by EnvelopeCryptKeeper with a key
+// encryption key that never leaves the wrapper, such as a KMS key.
+type KeyWrapper interface {
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// KMSKeyWrapper wraps data keys with an AWS KMS key. EncryptionContext, if set, must be the
+// same when unwrapping.
+type KMSKeyWrapper struct {
+	Client            kmsiface.KMSAPI
+	KeyID             string
+	EncryptionContext map[string]string
+}
+
+func (wrapper *KMSKeyWrapper) encryptionContext() map[string]*string {
+	if len(wrapper.EncryptionContext) == 0 {
+		return nil
+	}
+	return aws.StringMap(wrapper.EncryptionContext)
+}
+
+func (wrapper *KMSKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	output, err := wrapper.Client.Encrypt(&kms.EncryptInput{
+		KeyId:             aws.String(wrapper.KeyID),
+		Plaintext:         dataKey,
+		EncryptionContext: wrapper.encryptionContext(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.CiphertextBlob, nil
+}
+
+func (wrapper *KMSKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	output, err := wrapper.Client.Decrypt(&kms.DecryptInput{
+		KeyId:             aws.String(wrapper.KeyID),
+		CiphertextBlob:    wrapped,
+		EncryptionContext: wrapper.encryptionContext(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Plaintext, nil
+}
+
+// MakeKMSKeyWrapper creates a KeyWrapper for the KMS key with id keyID, which may also be
+// a key ARN or alias.
+func MakeKMSKeyWrapper(client kmsiface.KMSAPI, keyID string) *KMSKeyWrapper {
+	return &KMSKeyWrapper{Client: client, KeyID: keyID}
+}
+
+// FileKeyWrapper wraps data keys with a local AES key. It is intended for tests and local
+// development, where no KMS is available.
+type FileKeyWrapper struct {
+	keeper *CryptKeeper
+}
+
+func (wrapper *FileKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	wrapped, err := wrapper.keeper.Encrypt(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(wrapped), nil
+}
+
+func (wrapper *FileKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return wrapper.keeper.Decrypt(string(wrapped))
+}
+
+// MakeFileKeyWrapper creates a KeyWrapper from a file holding a base64 encoded AES key,
+// in the same format accepted by MakeCryptKeeper.
+func MakeFileKeyWrapper(path string) (*FileKeyWrapper, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key encryption key: %w", err)
+	}
+	keeper, err := MakeCryptKeeper(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, err
+	}
+	return &FileKeyWrapper{keeper: keeper}, nil
+}
@@ -7,10 +7,12 @@ require (
 	github.com/ZeFort/chance v0.0.0-20150129172704-bd0104b650ee
 	github.com/aws/aws-sdk-go v1.43.26
 	github.com/fatih/structs v1.1.0
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/pkg/errors v0.9.1
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/stretchr/testify v1.8.1
 	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.6.0
 )
 
 require (
@@ -0,0 +1,60 @@
+package rekey
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint records the progress of a rekey run so that an interrupted run can resume.
+// Objects are rekeyed in key order, so every object up to LastKey has been handled.
+type Checkpoint struct {
+	Prefix    string   `json:"prefix"`
+	LastKey   string   `json:"lastKey"`
+	Rekeyed   int      `json:"rekeyed"`
+	Skipped   int      `json:"skipped"`
+	Failed    []string `json:"failed"`
+	Completed bool     `json:"completed"`
+}
+
+// LoadCheckpoint reads the checkpoint at path. A missing file yields an empty checkpoint.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Checkpoint{Failed: []string{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint file %s: %w", path, err)
+	}
+	if checkpoint.Failed == nil {
+		checkpoint.Failed = []string{}
+	}
+	return checkpoint, nil
+}
+
+// Save writes the checkpoint to path, replacing the previous checkpoint atomically.
+func (checkpoint *Checkpoint) Save(path string) error {
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
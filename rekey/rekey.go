@@ -0,0 +1,184 @@
+package rekey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/diptamay/go-commons/crypt"
+	"github.com/diptamay/go-commons/metrics"
+	"github.com/diptamay/go-commons/s3buckets"
+)
+
+const (
+	MetricRekeyed = "rekey.objects.rekeyed"
+	MetricSkipped = "rekey.objects.skipped"
+	MetricFailed  = "rekey.objects.failed"
+	MetricTiming  = "rekey.objects.time"
+)
+
+var (
+	ErrPrefixMismatch = errors.New("checkpoint was written for another prefix")
+	ErrObjectsFailed  = errors.New("some objects could not be rekeyed")
+)
+
+// Bucket is the object storage a rekey run reads from and writes to.
+type Bucket interface {
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Rekey re-encrypts the object at key from old to the new keeper, keeping its metadata and
+	// tags. Any object old decrypts is re-encrypted, so objects already rekeyed are written
+	// again when both keepers share a key. It returns false, without writing the object, if old
+	// can not decrypt it but the new keeper can.
+	Rekey(ctx context.Context, key string, old crypt.CryptKeeperInterface) (bool, error)
+}
+
+// S3Bucket adapts an s3buckets.Bucket, whose crypter is the new keeper. Objects uploaded with
+// UploadStream are rekeyed as streams, without holding them in memory.
+type S3Bucket struct {
+	Bucket *s3buckets.Bucket
+}
+
+func (bucket S3Bucket) List(ctx context.Context, prefix string) ([]string, error) {
+	return bucket.Bucket.GetObjects(ctx, &prefix)
+}
+
+func (bucket S3Bucket) Rekey(ctx context.Context, key string, old crypt.CryptKeeperInterface) (bool, error) {
+	err := bucket.Bucket.Reencrypt(ctx, key, old)
+	if !errors.Is(err, s3buckets.ErrDecryptFail) {
+		return err == nil, err
+	}
+	// The object may have been rekeyed by a run interrupted before its checkpoint was saved.
+	// Opening a stream only decrypts its header, and objects that are not streams are small.
+	if body, streamErr := bucket.Bucket.DownloadStream(ctx, key); streamErr == nil {
+		body.Close()
+		return false, nil
+	}
+	if _, newErr := bucket.Bucket.Download(ctx, key, nil); newErr == nil {
+		return false, nil
+	}
+	return false, err
+}
+
+// Rekeyer re-encrypts the objects under a prefix from the old key to the new key.
+type Rekeyer struct {
+	Bucket Bucket
+	// Old decrypts objects that have not been rekeyed yet.
+	Old crypt.CryptKeeperInterface
+	// CheckpointFile, if set, is where progress is recorded and resumed from.
+	CheckpointFile string
+	Metrics        metrics.Metrics
+}
+
+func (rekeyer *Rekeyer) save(checkpoint *Checkpoint) error {
+	if rekeyer.CheckpointFile == "" {
+		return nil
+	}
+	return checkpoint.Save(rekeyer.CheckpointFile)
+}
+
+// Run rekeys every object under prefix, resuming from the checkpoint file if there is one.
+// Objects that fail are recorded in the checkpoint and the run carries on; Run then returns
+// ErrObjectsFailed. Objects stored without client-side encryption are left alone.
+func (rekeyer *Rekeyer) Run(ctx context.Context, prefix string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{Prefix: prefix, Failed: []string{}}
+	if rekeyer.CheckpointFile != "" {
+		loaded, err := LoadCheckpoint(rekeyer.CheckpointFile)
+		if err != nil {
+			return nil, err
+		}
+		if loaded.LastKey != "" || loaded.Completed {
+			if loaded.Prefix != prefix {
+				return nil, fmt.Errorf("%w: %q", ErrPrefixMismatch, loaded.Prefix)
+			}
+			checkpoint = loaded
+		}
+	}
+	m := rekeyer.Metrics
+	if m == nil {
+		m = metrics.NewEmptyMetrics()
+	}
+	tags := map[string]string{"prefix": prefix}
+
+	handle := func(key string) {
+		start := time.Now()
+		rekeyed, err := rekeyer.Bucket.Rekey(ctx, key, rekeyer.Old)
+		switch {
+		case err != nil:
+			log.Println("error rekeying object", key, err)
+			checkpoint.Failed = append(checkpoint.Failed, key)
+			m.IncrNoLogTags(MetricFailed, tags)
+		case rekeyed:
+			checkpoint.Rekeyed++
+			m.IncrNoLogTags(MetricRekeyed, tags)
+		default:
+			checkpoint.Skipped++
+			m.IncrNoLogTags(MetricSkipped, tags)
+		}
+		m.TimingNoLogTags(MetricTiming, time.Since(start), tags)
+	}
+
+	// Objects that failed in a previous run are retried first.
+	failed := checkpoint.Failed
+	checkpoint.Failed = []string{}
+	for i, key := range failed {
+		if err := ctx.Err(); err != nil {
+			checkpoint.Failed = append(checkpoint.Failed, failed[i:]...)
+			return checkpoint, err
+		}
+		handle(key)
+		if err := rekeyer.save(checkpoint); err != nil {
+			return checkpoint, err
+		}
+	}
+
+	keys, err := rekeyer.Bucket.List(ctx, prefix)
+	if err != nil {
+		return checkpoint, err
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if checkpoint.LastKey != "" && key <= checkpoint.LastKey {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return checkpoint, err
+		}
+		if !s3buckets.IsPlaintextObject(key) {
+			handle(key)
+		}
+		checkpoint.LastKey = key
+		if err := rekeyer.save(checkpoint); err != nil {
+			return checkpoint, err
+		}
+	}
+	checkpoint.Completed = true
+	if err := rekeyer.save(checkpoint); err != nil {
+		return checkpoint, err
+	}
+	if len(checkpoint.Failed) > 0 {
+		return checkpoint, fmt.Errorf("%w: %d objects", ErrObjectsFailed, len(checkpoint.Failed))
+	}
+	return checkpoint, nil
+}
+
+// RekeyToken re-encrypts a token from the old keeper to the new keeper.
+func RekeyToken(old crypt.CryptKeeperInterface, new crypt.CryptKeeperInterface, token string) (string, error) {
+	decrypted, err := old.Decrypt(token)
+	if err != nil {
+		return "", err
+	}
+	return new.Encrypt(decrypted)
+}
+
+// RekeyPayload re-encrypts a payload from the old keeper to the new keeper, keeping the fields
+// selected by selectors in cleartext as crypt.EncryptPayloadWithSelectors does.
+func RekeyPayload(old crypt.CryptKeeperInterface, new crypt.CryptKeeperInterface, payload *map[string]interface{}, selectors *crypt.PayloadSelectors) (*map[string]interface{}, error) {
+	decrypted, err := old.DecryptPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.EncryptPayloadWithSelectors(new, decrypted, selectors, nil)
+}
@@ -0,0 +1,172 @@
+package rekey
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/diptamay/go-commons/crypt"
+	"github.com/diptamay/go-commons/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func makeKeeper(hexKey string) *crypt.CryptKeeper {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		panic(err)
+	}
+	keeper, err := crypt.MakeCryptKeeper(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		panic(err)
+	}
+	return keeper
+}
+
+var (
+	oldKeeper = makeKeeper("6368616e676520746869732070617373776f726420746f206120736563726574")
+	newKeeper = makeKeeper("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+)
+
+// memoryBucket stores objects encrypted bound to their keys, like s3buckets does.
+type memoryBucket struct {
+	objects  map[string]string
+	failKeys map[string]bool
+	uploads  []string
+	onUpload func(key string)
+}
+
+func (bucket *memoryBucket) put(keeper crypt.CryptKeeperInterface, key string, contents string) {
+	encrypted, err := keeper.EncryptWithAssociatedData([]byte(contents), []byte(key))
+	if err != nil {
+		panic(err)
+	}
+	bucket.objects[key] = encrypted
+}
+
+func (bucket *memoryBucket) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	for key := range bucket.objects {
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (bucket *memoryBucket) download(key string, crypter crypt.CryptKeeperInterface) ([]byte, error) {
+	return crypter.DecryptWithAssociatedData(bucket.objects[key], []byte(key))
+}
+
+func (bucket *memoryBucket) Rekey(ctx context.Context, key string, old crypt.CryptKeeperInterface) (bool, error) {
+	contents, err := bucket.download(key, old)
+	if err != nil {
+		if _, newErr := bucket.download(key, newKeeper); newErr == nil {
+			return false, nil
+		}
+		return false, err
+	}
+	if bucket.failKeys[key] {
+		return false, errors.New("upload failed")
+	}
+	bucket.put(newKeeper, key, string(contents))
+	bucket.uploads = append(bucket.uploads, key)
+	if bucket.onUpload != nil {
+		bucket.onUpload(key)
+	}
+	return true, nil
+}
+
+func makeBucket() *memoryBucket {
+	bucket := &memoryBucket{objects: map[string]string{}, failKeys: map[string]bool{}}
+	bucket.put(oldKeeper, "docs/a", "a")
+	bucket.put(oldKeeper, "docs/b", "b")
+	bucket.put(newKeeper, "docs/c", "c")
+	bucket.put(oldKeeper, "other/d", "d")
+	bucket.objects["docs/debug.enc.json"] = "{}"
+	return bucket
+}
+
+func TestRun(t *testing.T) {
+	bucket := makeBucket()
+	m := &mocks.MockMetrics{}
+	tags := map[string]string{"prefix": "docs/"}
+	m.On("IncrNoLogTags", MetricRekeyed, tags).Twice()
+	m.On("IncrNoLogTags", MetricSkipped, tags).Once()
+	m.On("TimingNoLogTags", MetricTiming, mock.Anything, tags).Times(3)
+	rekeyer := &Rekeyer{Bucket: bucket, Old: oldKeeper, Metrics: m}
+
+	result, err := rekeyer.Run(context.Background(), "docs/")
+	assert.Nil(t, err)
+	m.AssertExpectations(t)
+	assert.Equal(t, 2, result.Rekeyed, "should rekey objects encrypted with the old key")
+	assert.Equal(t, 1, result.Skipped, "should skip objects already encrypted with the new key")
+	assert.True(t, result.Completed)
+	assert.Equal(t, []string{"docs/a", "docs/b"}, bucket.uploads)
+	for _, key := range []string{"docs/a", "docs/b", "docs/c"} {
+		contents, err := bucket.download(key, newKeeper)
+		assert.Nil(t, err)
+		assert.Equal(t, key[len(key)-1:], string(contents), "should keep the contents of %s", key)
+	}
+	assert.Equal(t, "{}", bucket.objects["docs/debug.enc.json"], "should leave objects without client-side encryption alone")
+	_, err = bucket.download("other/d", oldKeeper)
+	assert.Nil(t, err, "should only rekey objects under the prefix")
+}
+
+func TestRunResumesFromCheckpoint(t *testing.T) {
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	bucket := makeBucket()
+	bucket.failKeys["docs/b"] = true
+	ctx, cancel := context.WithCancel(context.Background())
+	bucket.onUpload = func(key string) { cancel() }
+	rekeyer := &Rekeyer{Bucket: bucket, Old: oldKeeper, CheckpointFile: checkpointFile}
+
+	_, err := rekeyer.Run(ctx, "docs/")
+	assert.True(t, errors.Is(err, context.Canceled))
+	checkpoint, err := LoadCheckpoint(checkpointFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "docs/a", checkpoint.LastKey, "should record progress")
+	assert.False(t, checkpoint.Completed)
+
+	bucket.onUpload = nil
+	result, err := rekeyer.Run(context.Background(), "docs/")
+	assert.True(t, errors.Is(err, ErrObjectsFailed), "should report objects that failed")
+	assert.Equal(t, []string{"docs/b"}, result.Failed)
+	assert.Equal(t, []string{"docs/a"}, bucket.uploads, "should not rekey objects again after resuming")
+
+	delete(bucket.failKeys, "docs/b")
+	result, err = rekeyer.Run(context.Background(), "docs/")
+	assert.Nil(t, err, "should retry objects that failed before")
+	assert.Empty(t, result.Failed)
+	assert.Equal(t, 2, result.Rekeyed)
+
+	other := &Rekeyer{Bucket: bucket, Old: oldKeeper, CheckpointFile: checkpointFile}
+	_, err = other.Run(context.Background(), "other/")
+	assert.True(t, errors.Is(err, ErrPrefixMismatch), "should not resume a checkpoint of another prefix")
+}
+
+func TestRekeyTokenAndPayload(t *testing.T) {
+	token, err := oldKeeper.Encrypt([]byte("secret"))
+	if err != nil {
+		panic(err)
+	}
+	rekeyed, err := RekeyToken(oldKeeper, newKeeper, token)
+	assert.Nil(t, err)
+	decrypted, err := newKeeper.Decrypt(rekeyed)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret"), decrypted)
+
+	payload, err := oldKeeper.EncryptPayload(&map[string]interface{}{"id": "1", "email": "a@example.com"}, &[]string{"id"})
+	if err != nil {
+		panic(err)
+	}
+	rekeyedPayload, err := RekeyPayload(oldKeeper, newKeeper, payload, &crypt.PayloadSelectors{Clear: []string{"id"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "1", (*rekeyedPayload)["id"])
+	decryptedPayload, err := newKeeper.DecryptPayload(rekeyedPayload)
+	assert.Nil(t, err)
+	assert.Equal(t, "a@example.com", (*decryptedPayload)["email"])
+}
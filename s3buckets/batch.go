@@ -0,0 +1,150 @@
+package s3buckets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diptamay/go-commons/metrics"
+)
+
+const (
+	// DefaultWorkers is the number of objects UploadAll and DownloadAll transfer at once.
+	DefaultWorkers = 8
+
+	MetricTransferred = "s3buckets.objects.transferred"
+	MetricFailed      = "s3buckets.objects.failed"
+	MetricBytes       = "s3buckets.objects.bytes"
+	MetricTiming      = "s3buckets.objects.time"
+)
+
+// BatchError reports the objects UploadAll or DownloadAll could not transfer, by their key.
+type BatchError struct {
+	Errors map[string]error
+}
+
+func (err *BatchError) Error() string {
+	keys := make([]string, 0, len(err.Errors))
+	for key := range err.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	failures := make([]string, len(keys))
+	for i, key := range keys {
+		failures[i] = fmt.Sprintf("%s: %s", key, err.Errors[key].Error())
+	}
+	return fmt.Sprintf("error transferring %d objects: %s", len(keys), strings.Join(failures, "; "))
+}
+
+func (bucket *Bucket) metrics() metrics.Metrics {
+	if bucket.Metrics != nil {
+		return bucket.Metrics
+	}
+	return metrics.NewEmptyMetrics()
+}
+
+// transferAll calls transfer for every key with up to Workers keys at once. Keys that are not
+// started before ctx is done fail with the error of ctx.
+func (bucket *Bucket) transferAll(ctx context.Context, operation string, keys []string, transfer func(key string) (int, error)) map[string]error {
+	workers := bucket.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	m := bucket.metrics()
+	tags := map[string]string{"bucket": bucket.Name, "operation": operation}
+	errs := map[string]error{}
+	var mutex sync.Mutex
+	pending := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range pending {
+				start := time.Now()
+				size, err := transfer(key)
+				m.TimingNoLogTags(MetricTiming, time.Since(start), tags)
+				if err != nil {
+					m.IncrNoLogTags(MetricFailed, tags)
+					mutex.Lock()
+					errs[key] = err
+					mutex.Unlock()
+					continue
+				}
+				m.IncrNoLogTags(MetricTransferred, tags)
+				m.HistogramNoLogTags(MetricBytes, float64(size), tags)
+			}
+		}()
+	}
+	for i, key := range keys {
+		if ctx.Err() == nil {
+			select {
+			case pending <- key:
+				continue
+			case <-ctx.Done():
+			}
+		}
+		mutex.Lock()
+		for _, skipped := range keys[i:] {
+			errs[skipped] = ctx.Err()
+		}
+		mutex.Unlock()
+		break
+	}
+	close(pending)
+	wg.Wait()
+	return errs
+}
+
+// UploadAll uploads the contents of filekeys, keyed by object key, with up to Workers uploads
+// at once, and returns the locations of the uploaded objects keyed by object key. If some
+// objects can not be uploaded, the others are still uploaded and a *BatchError is returned.
+func (bucket *Bucket) UploadAll(ctx context.Context, filekeys *map[string]string) (*map[string]string, error) {
+	keys := make([]string, 0, len(*filekeys))
+	for key := range *filekeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	locations := make(map[string]string, len(keys))
+	var mutex sync.Mutex
+	errs := bucket.transferAll(ctx, "upload", keys, func(key string) (int, error) {
+		contents := (*filekeys)[key]
+		location, err := bucket.Upload(ctx, key, []byte(contents), nil)
+		if err != nil {
+			return 0, err
+		}
+		mutex.Lock()
+		locations[key] = location
+		mutex.Unlock()
+		return len(contents), nil
+	})
+	if len(errs) > 0 {
+		return &locations, &BatchError{Errors: errs}
+	}
+	return &locations, nil
+}
+
+// DownloadAll downloads and decrypts the objects of filekeys with up to Workers downloads at
+// once, and returns their contents keyed by object key. If some objects can not be downloaded,
+// the others are returned along with a *BatchError.
+func (bucket *Bucket) DownloadAll(ctx context.Context, filekeys *[]string) (*map[string]string, error) {
+	contents := make(map[string]string, len(*filekeys))
+	var mutex sync.Mutex
+	errs := bucket.transferAll(ctx, "download", *filekeys, func(key string) (int, error) {
+		downloaded, err := bucket.Download(ctx, key, nil)
+		if err != nil {
+			return 0, err
+		}
+		mutex.Lock()
+		contents[key] = string(downloaded)
+		mutex.Unlock()
+		return len(downloaded), nil
+	})
+	if len(errs) > 0 {
+		return &contents, &BatchError{Errors: errs}
+	}
+	return &contents, nil
+}
@@ -0,0 +1,103 @@
+package s3buckets
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/diptamay/go-commons/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockSlowUploader records the most uploads it was running at once.
+type MockSlowUploader struct {
+	mutex   sync.Mutex
+	running int
+	most    int
+	onStart func()
+}
+
+func (m *MockSlowUploader) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	m.mutex.Lock()
+	m.running++
+	if m.running > m.most {
+		m.most = m.running
+	}
+	onStart := m.onStart
+	m.mutex.Unlock()
+	if onStart != nil {
+		onStart()
+	}
+	time.Sleep(5 * time.Millisecond)
+	m.mutex.Lock()
+	m.running--
+	m.mutex.Unlock()
+	return &s3manager.UploadOutput{Location: *input.Key}, nil
+}
+
+func TestUploadAllAndDownloadAll(t *testing.T) {
+	objects := makeMemoryObjects()
+	m := &mocks.MockMetrics{}
+	uploads := map[string]string{"operation": "upload", "bucket": "go-test"}
+	downloads := map[string]string{"operation": "download", "bucket": "go-test"}
+	m.On("IncrNoLogTags", MetricTransferred, uploads).Times(3)
+	m.On("HistogramNoLogTags", MetricBytes, float64(1), uploads).Times(3)
+	m.On("TimingNoLogTags", MetricTiming, mock.Anything, uploads).Times(3)
+	m.On("IncrNoLogTags", MetricTransferred, downloads).Times(3)
+	m.On("IncrNoLogTags", MetricFailed, downloads).Once()
+	m.On("IncrNoLogTags", MetricOperationFailed, downloads).Once()
+	m.On("HistogramNoLogTags", MetricBytes, float64(1), downloads).Times(3)
+	m.On("TimingNoLogTags", MetricTiming, mock.Anything, downloads).Times(4)
+	bucket := &Bucket{Name: "go-test", Uploader: objects, Downloader: objects, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), Metrics: m}
+
+	locations, err := bucket.UploadAll(context.Background(), &map[string]string{"c": "3", "a": "1", "b": "2"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"a": "a", "b": "b", "c": "c"}, *locations, "should return the locations by key")
+
+	contents, err := bucket.DownloadAll(context.Background(), &[]string{"a", "b", "c", "missing"})
+	assert.Equal(t, map[string]string{"a": "1", "b": "2", "c": "3"}, *contents, "should return the objects that were downloaded")
+	var batchErr *BatchError
+	assert.True(t, errors.As(err, &batchErr))
+	assert.Equal(t, []string{"missing"}, keysOf(batchErr.Errors), "should report the errors by key")
+	m.AssertExpectations(t)
+}
+
+func keysOf(errs map[string]error) []string {
+	keys := []string{}
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestUploadAllWorkers(t *testing.T) {
+	uploader := &MockSlowUploader{}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), Workers: 3}
+	files := map[string]string{}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		files[key] = key
+	}
+	locations, err := bucket.UploadAll(context.Background(), &files)
+	assert.Nil(t, err)
+	assert.Equal(t, files, *locations)
+	assert.LessOrEqual(t, uploader.most, 3, "should upload at most Workers objects at once")
+	assert.Greater(t, uploader.most, 1, "should upload objects concurrently")
+}
+
+func TestUploadAllCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	uploader := &MockSlowUploader{onStart: cancel}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), Workers: 1}
+
+	locations, err := bucket.UploadAll(ctx, &map[string]string{"a": "1", "b": "2", "c": "3"})
+	assert.Equal(t, map[string]string{"a": "a"}, *locations, "should finish the uploads that were started")
+	var batchErr *BatchError
+	assert.True(t, errors.As(err, &batchErr))
+	assert.Equal(t, context.Canceled, batchErr.Errors["b"], "should not start uploads once cancelled")
+	assert.Equal(t, context.Canceled, batchErr.Errors["c"])
+}
@@ -0,0 +1,473 @@
+package s3buckets
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/diptamay/go-commons/crypt"
+	"github.com/diptamay/go-commons/metrics"
+)
+
+// objectHeaderSize is the number of bytes Copy reads from the start of an encrypted object to
+// tell whether it is bound to its key, enough for the headers of tokens and streams.
+const objectHeaderSize = 4096
+
+// Bucket is a client of a single S3 bucket whose objects are encrypted with Crypter. A process
+// can use any number of buckets, each with its own session and crypter.
+type Bucket struct {
+	Name string
+	// LocalstackAddress is set for buckets on localstack, where Initialize creates missing buckets.
+	LocalstackAddress string
+	Client            s3iface.S3API
+	Uploader          UploaderInterface
+	Downloader        DownloaderInterface
+	Crypter           crypt.CryptKeeperInterface
+	// PartSize and Concurrency configure the multipart uploads and ranged parallel downloads of
+	// UploadStream and DownloadStream. They default to the s3manager defaults; parts of uploads
+	// can not be smaller than s3manager.MinUploadPartSize.
+	PartSize    int64
+	Concurrency int
+	// Workers is the number of objects UploadAll and DownloadAll transfer at once, DefaultWorkers
+	// if not set.
+	Workers int
+	Metrics metrics.Metrics
+	// Retry is the retry policy of every operation. Operations are attempted once if it is not set.
+	Retry RetryPolicy
+	// Breaker, if set, stops calls to the bucket while it keeps failing.
+	Breaker *CircuitBreaker
+	// UploadOptions, if set, are the options of Upload and UploadStream.
+	UploadOptions *UploadOptions
+	// RejectUnboundObjects stops Download from decrypting objects uploaded before ciphertexts
+	// were bound to their keys. Such objects can be moved to any key and still decrypt, so it
+	// can be set once the objects of the bucket have been rewritten, for example with rekey.
+	RejectUnboundObjects bool
+}
+
+// MakeBucket creates a client of the bucket of bucketCfg and checks that the bucket exists,
+// creating it on localstack.
+func MakeBucket(ctx context.Context, bucketCfg *S3BucketConfig, crypter crypt.CryptKeeperInterface) (*Bucket, error) {
+	awsSession, err := getS3BucketSession(bucketCfg)
+	if err != nil {
+		return nil, err
+	}
+	bucket := &Bucket{
+		Name:              aws.StringValue(bucketCfg.Name),
+		LocalstackAddress: aws.StringValue(bucketCfg.S3LocalstackAddress),
+		Client:            s3.New(awsSession),
+		Uploader:          s3manager.NewUploader(awsSession),
+		Downloader:        s3manager.NewDownloader(awsSession),
+		Crypter:           crypter,
+		Retry:             DefaultRetryPolicy,
+	}
+	if err := bucket.Initialize(ctx); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// Initialize checks that the bucket exists. Missing buckets are created on localstack.
+func (bucket *Bucket) Initialize(ctx context.Context) error {
+	log.Println("Checking if  bucket ", bucket.Name, " exists")
+
+	headBucketErr := bucket.do(ctx, "head_bucket", func() error {
+		_, err := bucket.Client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(bucket.Name),
+		})
+		return err
+	})
+
+	if headBucketErr != nil && bucket.LocalstackAddress != "" {
+		log.Println("Using localstack, and bucket does not exist, so creating new bucket ", bucket.Name)
+		createErr := bucket.do(ctx, "create_bucket", func() error {
+			_, err := makeS3Bucket(ctx, bucket.Client, aws.String(bucket.Name))
+			return err
+		})
+		if createErr != nil {
+			log.Println("creating bucket failed,", bucket.Name, createErr.Error())
+			return createErr
+		}
+		log.Println("created bucket,", bucket.Name)
+	} else if headBucketErr != nil {
+		return headBucketErr
+	}
+	return nil
+}
+
+// Upload encrypts contents, bound to the object key, and uploads them to filekey with the
+// UploadOptions of the bucket and tags, if not nil.
+func (bucket *Bucket) Upload(ctx context.Context, filekey string, contents []byte, tags *string) (string, error) {
+	return bucket.UploadWithOptions(ctx, filekey, contents, bucket.uploadOptions(tags))
+}
+
+// UploadWithOptions encrypts contents, bound to the object key, and uploads them to filekey
+// with options instead of the UploadOptions of the bucket.
+func (bucket *Bucket) UploadWithOptions(ctx context.Context, filekey string, contents []byte, options *UploadOptions) (string, error) {
+	if err := options.validate(); err != nil {
+		return "", err
+	}
+	// The object key is bound to the ciphertext so that it can not be moved to another key
+	encrypted, err := bucket.Crypter.EncryptWithAssociatedData(contents, []byte(filekey))
+	if err != nil {
+		return "", err
+	}
+	var result *s3manager.UploadOutput
+	err = bucket.do(ctx, "upload", func() error {
+		s3Input := &s3manager.UploadInput{
+			Bucket: aws.String(bucket.Name),
+			Key:    aws.String(filekey),
+			Body:   bytes.NewReader([]byte(encrypted)),
+		}
+		options.apply(s3Input, tokenKeyID(encrypted))
+
+		// We give control to a timeout to the http client
+		var err error
+		result, err = bucket.Uploader.UploadWithContext(ctx, s3Input)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.Location, nil
+}
+
+// UploadStream encrypts contents with the chunked stream format while it is being uploaded in
+// parts, so at most Concurrency parts of the object are held in memory. Uploads are only
+// retried if contents is an io.Seeker, as it is read again from where it started.
+func (bucket *Bucket) UploadStream(ctx context.Context, filekey string, contents io.Reader, tags *string) (string, error) {
+	return bucket.UploadStreamWithOptions(ctx, filekey, contents, bucket.uploadOptions(tags))
+}
+
+// UploadStreamWithOptions is UploadStream with options instead of the UploadOptions of the
+// bucket.
+func (bucket *Bucket) UploadStreamWithOptions(ctx context.Context, filekey string, contents io.Reader, options *UploadOptions) (string, error) {
+	if err := options.validate(); err != nil {
+		return "", err
+	}
+	attempts := 1
+	var start int64
+	seeker, ok := contents.(io.Seeker)
+	if ok {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return "", err
+		}
+		attempts = bucket.Retry.MaxAttempts
+	}
+	var result *s3manager.UploadOutput
+	attempt := 0
+	err := bucket.doAttempts(ctx, "upload_stream", attempts, func() error {
+		attempt++
+		if attempt > 1 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		var err error
+		result, err = bucket.uploadStream(ctx, filekey, contents, options)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.Location, nil
+}
+
+func (bucket *Bucket) uploadStream(ctx context.Context, filekey string, contents io.Reader, options *UploadOptions) (*s3manager.UploadOutput, error) {
+	reader, writer := io.Pipe()
+	// Closing the reader unblocks the encrypting goroutine if the upload stops early
+	defer reader.Close()
+	// The stream header is written when the encrypter is created, and read for the key id the
+	// stream is encrypted with before the upload starts
+	header := &bytes.Buffer{}
+	sink := &redirectWriter{header}
+	encrypter, err := crypt.NewEncryptWriterWithAssociatedData(bucket.Crypter, sink, []byte(filekey))
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := crypt.StreamKeyID(header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	sink.Writer = writer
+	go func() {
+		if _, err := io.Copy(encrypter, contents); err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+		writer.CloseWithError(encrypter.Close())
+	}()
+
+	s3Input := &s3manager.UploadInput{
+		Bucket: aws.String(bucket.Name),
+		Key:    aws.String(filekey),
+		Body:   io.MultiReader(header, reader),
+	}
+	options.apply(s3Input, keyID)
+
+	return bucket.Uploader.UploadWithContext(ctx, s3Input, bucket.configureUploader)
+}
+
+// Download downloads and decrypts the object at filekey. crypterOldKey, if not nil, decrypts
+// the object instead of the crypter of the bucket.
+func (bucket *Bucket) Download(ctx context.Context, filekey string, crypterOldKey crypt.CryptKeeperInterface) ([]byte, error) {
+	var writer *aws.WriteAtBuffer
+	err := bucket.do(ctx, "download", func() error {
+		writer = &aws.WriteAtBuffer{}
+		_, err := bucket.Downloader.DownloadWithContext(ctx, writer, &s3.GetObjectInput{
+			Bucket: aws.String(bucket.Name),
+			Key:    aws.String(filekey),
+		})
+		return err
+	})
+
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if IsPlaintextObject(filekey) {
+		return writer.Bytes(), nil
+	}
+
+	decrypter := bucket.Crypter
+	if crypterOldKey != nil {
+		decrypter = crypterOldKey
+	}
+	content, err := decryptObject(decrypter, filekey, string(writer.Bytes()), !bucket.RejectUnboundObjects)
+	if err != nil {
+		return []byte{}, ErrDecryptFail
+	}
+	return content, nil
+}
+
+type decryptedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// DownloadStream returns the object body decrypted on the fly. The object is downloaded in
+// ranges of PartSize, up to Concurrency of them in parallel. The caller must close the body.
+func (bucket *Bucket) DownloadStream(ctx context.Context, filekey string) (io.ReadCloser, error) {
+	body, err := bucket.openRanged(ctx, filekey)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := crypt.NewDecryptReaderWithAssociatedData(bucket.Crypter, body, []byte(filekey))
+	if err != nil {
+		body.Close()
+		return nil, ErrDecryptFail
+	}
+	return &decryptedBody{reader, body}, nil
+}
+
+// Copy copies the object at sourceKey to targetKey within the bucket, with the content
+// settings, user metadata, tags, server side encryption and storage class of the source.
+// Plaintext objects and objects encrypted without being bound to their key are copied on the
+// server. Bound objects only decrypt at the key they were encrypted for, so they are decrypted
+// and encrypted again for targetKey instead: this fails with ErrDecryptFail if the crypter of
+// the bucket can not decrypt them, and holds objects that are not streams in memory.
+func (bucket *Bucket) Copy(ctx context.Context, sourceKey string, targetKey string) error {
+	var err error
+	if IsPlaintextObject(sourceKey) {
+		err = bucket.copyObject(ctx, sourceKey, targetKey)
+	} else {
+		err = bucket.copyEncrypted(ctx, sourceKey, targetKey)
+	}
+	if err != nil {
+		log.Println("Something went wrong with copying ", err)
+		return err
+	}
+	return nil
+}
+
+func (bucket *Bucket) copyObject(ctx context.Context, sourceKey string, targetKey string) error {
+	// The name of the source bucket and key name of the source object, separated by a slash (/)
+	source := fmt.Sprint(bucket.Name, "/", sourceKey)
+	return bucket.do(ctx, "copy", func() error {
+		_, err := bucket.Client.CopyObjectWithContext(ctx,
+			&s3.CopyObjectInput{
+				Bucket:     aws.String(bucket.Name),
+				Key:        aws.String(targetKey),
+				CopySource: aws.String(source),
+			})
+		return err
+	})
+}
+
+// copyEncrypted copies the object on the server unless its ciphertext is bound to sourceKey,
+// in which case it is rewritten for targetKey.
+func (bucket *Bucket) copyEncrypted(ctx context.Context, sourceKey string, targetKey string) error {
+	var header []byte
+	err := bucket.do(ctx, "get_header", func() error {
+		output, err := bucket.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket.Name),
+			Key:    aws.String(sourceKey),
+			Range:  aws.String(fmt.Sprintf("bytes=0-%d", objectHeaderSize-1)),
+		})
+		if isInvalidRange(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+		header, err = ioutil.ReadAll(io.LimitReader(output.Body, objectHeaderSize))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Empty objects hold no ciphertext to bind. Objects whose header can not be read are
+	// rewritten, which reads them in full
+	if len(header) == 0 {
+		return bucket.copyObject(ctx, sourceKey, targetKey)
+	}
+	if bound, err := crypt.IsBound(header); err == nil && !bound {
+		return bucket.copyObject(ctx, sourceKey, targetKey)
+	}
+	return bucket.rewrite(ctx, sourceKey, targetKey, bucket.Crypter)
+}
+
+// Reencrypt decrypts the object at filekey with crypterOldKey and writes it back encrypted with
+// the crypter of the bucket, keeping its content settings, user metadata and tags. Streams stay
+// streams and are not held in memory. It returns ErrDecryptFail, without writing the object,
+// if crypterOldKey can not decrypt it.
+func (bucket *Bucket) Reencrypt(ctx context.Context, filekey string, crypterOldKey crypt.CryptKeeperInterface) error {
+	return bucket.rewrite(ctx, filekey, filekey, crypterOldKey)
+}
+
+// rewrite decrypts the object at sourceKey with decrypter and uploads it to targetKey encrypted
+// with the crypter of the bucket.
+func (bucket *Bucket) rewrite(ctx context.Context, sourceKey string, targetKey string, decrypter crypt.CryptKeeperInterface) error {
+	options, err := bucket.objectOptions(ctx, sourceKey)
+	if err != nil {
+		return err
+	}
+	body, err := bucket.openRanged(ctx, sourceKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	reader := bufio.NewReader(body)
+	header, err := reader.Peek(4)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !crypt.IsStream(header) {
+		encrypted, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		contents, err := decryptObject(decrypter, sourceKey, string(encrypted), !bucket.RejectUnboundObjects)
+		if err != nil {
+			return ErrDecryptFail
+		}
+		_, err = bucket.UploadWithOptions(ctx, targetKey, contents, options)
+		return err
+	}
+	decrypted, err := crypt.NewDecryptReaderWithAssociatedData(decrypter, reader, []byte(sourceKey))
+	if err != nil {
+		return ErrDecryptFail
+	}
+	// The source is read once, so the upload can not be retried; its parts are retried instead.
+	// An upload to the source key only replaces it once every part of the source was read.
+	return bucket.doAttempts(ctx, "rewrite", 1, func() error {
+		_, err := bucket.uploadStream(ctx, targetKey, decrypted, options)
+		return err
+	})
+}
+
+// Delete deletes the object at filekey and waits until it no longer exists.
+func (bucket *Bucket) Delete(ctx context.Context, filekey string) error {
+	err := bucket.do(ctx, "delete", func() error {
+		_, err := bucket.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket.Name), Key: aws.String(filekey)})
+		return err
+	})
+	if err != nil {
+		log.Println("Something went wrong with deletion", err)
+		return err
+	}
+
+	return bucket.Client.WaitUntilObjectNotExistsWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket.Name),
+		Key:    aws.String(filekey),
+	})
+}
+
+// listObjects calls include for every object under prefix.
+func (bucket *Bucket) listObjects(ctx context.Context, prefix *string, include func(*s3.Object) bool) ([]string, error) {
+	query := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket.Name),
+		Prefix: prefix,
+	}
+
+	truncatedListing := true
+	var result []string
+
+	for truncatedListing {
+		var response *s3.ListObjectsV2Output
+		err := bucket.do(ctx, "list", func() error {
+			var err error
+			response, err = bucket.Client.ListObjectsV2WithContext(ctx, query)
+			return err
+		})
+
+		if err != nil {
+			log.Println("error fetching list of objects in s3bucket", err)
+			return result, err
+		}
+
+		for _, file := range response.Contents {
+			if include(file) {
+				result = append(result, *file.Key)
+			}
+		}
+
+		// Set continuation token
+		query.ContinuationToken = response.NextContinuationToken
+		truncatedListing = *response.IsTruncated
+	}
+
+	return result, nil
+}
+
+// GetObjects returns the keys of all objects under prefix.
+func (bucket *Bucket) GetObjects(ctx context.Context, prefix *string) ([]string, error) {
+	return bucket.listObjects(ctx, prefix, func(*s3.Object) bool { return true })
+}
+
+// GetKeysPerInterval returns the keys of the objects under prefix that were last modified
+// between startTime and endTime, inclusive.
+func (bucket *Bucket) GetKeysPerInterval(ctx context.Context, prefix *string, startTime time.Time, endTime time.Time) ([]string, error) {
+	return bucket.listObjects(ctx, prefix, func(file *s3.Object) bool {
+		fileTime := *file.LastModified
+		return fileTime.Equal(startTime) || fileTime.Equal(endTime) ||
+			(fileTime.After(startTime) && fileTime.Before(endTime))
+	})
+}
+
+// DoesExist reports whether any object exists under prefix.
+func (bucket *Bucket) DoesExist(ctx context.Context, prefix string) (bool, error) {
+	var resp *s3.ListObjectsV2Output
+	err := bucket.do(ctx, "list", func() error {
+		var err error
+		resp, err = bucket.Client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket.Name),
+			Prefix: aws.String(prefix),
+		})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.Contents) > 0, nil
+}
@@ -0,0 +1,245 @@
+package s3buckets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/diptamay/go-commons/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryObjects is an uploader, downloader and S3 client keeping objects in memory, keyed by
+// bucket and key.
+type memoryObjects struct {
+	s3iface.S3API
+	mutex   sync.Mutex
+	objects map[string][]byte
+	inputs  map[string]*s3manager.UploadInput
+}
+
+func makeMemoryObjects() *memoryObjects {
+	return &memoryObjects{objects: map[string][]byte{}, inputs: map[string]*s3manager.UploadInput{}}
+}
+
+func (objects *memoryObjects) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	objects.mutex.Lock()
+	defer objects.mutex.Unlock()
+	objects.objects[*input.Bucket+"/"+*input.Key] = body
+	objects.inputs[*input.Bucket+"/"+*input.Key] = input
+	return &s3manager.UploadOutput{Location: *input.Key}, nil
+}
+
+func (objects *memoryObjects) DownloadWithContext(ctx aws.Context, writer io.WriterAt, input *s3.GetObjectInput, opts ...func(*s3manager.Downloader)) (int64, error) {
+	objects.mutex.Lock()
+	body, ok := objects.objects[*input.Bucket+"/"+*input.Key]
+	objects.mutex.Unlock()
+	if !ok {
+		return 0, io.ErrUnexpectedEOF
+	}
+	written, err := writer.WriteAt(body, 0)
+	return int64(written), err
+}
+
+func (objects *memoryObjects) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	objects.mutex.Lock()
+	body, ok := objects.objects[*input.Bucket+"/"+*input.Key]
+	objects.mutex.Unlock()
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+	if start >= len(body) {
+		return nil, awserr.NewRequestFailure(awserr.New("InvalidRange", "The requested range is not satisfiable", nil), http.StatusRequestedRangeNotSatisfiable, "")
+	}
+	if end >= len(body) {
+		end = len(body) - 1
+	}
+	return &s3.GetObjectOutput{
+		Body:         ioutil.NopCloser(bytes.NewReader(body[start : end+1])),
+		ContentRange: aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(body))),
+	}, nil
+}
+
+func (objects *memoryObjects) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	objects.mutex.Lock()
+	defer objects.mutex.Unlock()
+	upload, ok := objects.inputs[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentType: upload.ContentType, Metadata: upload.Metadata}, nil
+}
+
+func (objects *memoryObjects) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	objects.mutex.Lock()
+	defer objects.mutex.Unlock()
+	body, ok := objects.objects[*input.CopySource]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	objects.objects[*input.Bucket+"/"+*input.Key] = body
+	objects.inputs[*input.Bucket+"/"+*input.Key] = objects.inputs[*input.CopySource]
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (objects *memoryObjects) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	objects.mutex.Lock()
+	defer objects.mutex.Unlock()
+	output := &s3.GetObjectTaggingOutput{}
+	tags, _ := url.ParseQuery(aws.StringValue(objects.inputs[*input.Bucket+"/"+*input.Key].Tagging))
+	for key := range tags {
+		output.TagSet = append(output.TagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(tags.Get(key))})
+	}
+	return output, nil
+}
+
+func makeTestCrypter(key string) crypt.CryptKeeperInterface {
+	crypter, err := crypt.MakeCryptKeeper(base64.StdEncoding.EncodeToString([]byte(key)))
+	if err != nil {
+		panic(err)
+	}
+	return crypter
+}
+
+func TestBucketsAreIndependent(t *testing.T) {
+	objects := makeMemoryObjects()
+	exports := &Bucket{Name: "exports", Uploader: objects, Downloader: objects, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef")}
+	reports := &Bucket{Name: "reports", Uploader: objects, Downloader: objects, Crypter: makeTestCrypter("fedcba9876543210fedcba9876543210")}
+	ctx := context.Background()
+
+	_, err := exports.Upload(ctx, "key", []byte("export"), nil)
+	assert.Nil(t, err)
+	_, err = reports.Upload(ctx, "key", []byte("report"), nil)
+	assert.Nil(t, err)
+	assert.Contains(t, objects.objects, "exports/key", "should upload to the bucket of the client")
+	assert.Contains(t, objects.objects, "reports/key", "should upload to the bucket of the client")
+
+	contents, err := exports.Download(ctx, "key", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("export"), contents)
+	contents, err = reports.Download(ctx, "key", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("report"), contents)
+
+	_, err = reports.Download(ctx, "key", exports.Crypter)
+	assert.Equal(t, ErrDecryptFail, err, "should decrypt with the crypter of each bucket")
+}
+
+func TestCopyEncryptedObject(t *testing.T) {
+	objects := makeMemoryObjects()
+	bucket := &Bucket{Name: "go-test", Client: objects, Uploader: objects, Downloader: objects, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef")}
+	ctx := context.Background()
+	options := &UploadOptions{ContentType: "application/json", Metadata: map[string]string{"tenant": "acme"}, Tagging: aws.String("key=value")}
+	_, err := bucket.UploadWithOptions(ctx, "source", []byte("value"), options)
+	assert.Nil(t, err)
+
+	objects.objects["go-test/moved"] = objects.objects["go-test/source"]
+	_, err = bucket.Download(ctx, "moved", nil)
+	assert.Equal(t, ErrDecryptFail, err, "should not decrypt objects moved to another key")
+
+	assert.Nil(t, bucket.Copy(ctx, "source", "target"))
+	contents, err := bucket.Download(ctx, "target", nil)
+	assert.Nil(t, err, "should encrypt copies for their own key")
+	assert.Equal(t, []byte("value"), contents)
+	target := objects.inputs["go-test/target"]
+	assert.Equal(t, "application/json", *target.ContentType, "should keep the content type")
+	assert.Equal(t, map[string]*string{"tenant": aws.String("acme")}, target.Metadata, "should keep the metadata")
+	assert.Equal(t, "key=value", *target.Tagging, "should keep the tags")
+}
+
+func TestCopyEncryptedStream(t *testing.T) {
+	objects := makeMemoryObjects()
+	bucket := &Bucket{Name: "go-test", Client: objects, Uploader: objects, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), PartSize: 1024}
+	ctx := context.Background()
+	value := bytes.Repeat([]byte("0123456789"), 1000)
+	_, err := bucket.UploadStream(ctx, "source", bytes.NewReader(value), nil)
+	assert.Nil(t, err)
+
+	assert.Nil(t, bucket.Copy(ctx, "source", "target"))
+	assert.True(t, crypt.IsStream(objects.objects["go-test/target"]), "should copy streams as streams")
+	body, err := bucket.DownloadStream(ctx, "target")
+	assert.Nil(t, err)
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	assert.Nil(t, err)
+	assert.Equal(t, value, contents, "should encrypt copies of streams for their own key")
+}
+
+func TestCopyEmptyObject(t *testing.T) {
+	objects := makeMemoryObjects()
+	bucket := &Bucket{Name: "go-test", Client: objects, Uploader: objects, Downloader: objects, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef")}
+	objects.objects["go-test/source"] = []byte{}
+	objects.inputs["go-test/source"] = &s3manager.UploadInput{}
+
+	assert.Nil(t, bucket.Copy(context.Background(), "source", "target"), "should copy empty objects on the server")
+	assert.Equal(t, []byte{}, objects.objects["go-test/target"])
+}
+
+func TestReencrypt(t *testing.T) {
+	objects := makeMemoryObjects()
+	old := &Bucket{Name: "go-test", Client: objects, Uploader: objects, Downloader: objects, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), PartSize: 1024}
+	bucket := &Bucket{Name: "go-test", Client: objects, Uploader: objects, Downloader: objects, Crypter: makeTestCrypter("fedcba9876543210fedcba9876543210"), PartSize: 1024}
+	ctx := context.Background()
+	value := bytes.Repeat([]byte("0123456789"), 1000)
+	_, err := old.UploadWithOptions(ctx, "object", value, &UploadOptions{Metadata: map[string]string{"tenant": "acme"}, Tagging: aws.String("key=value")})
+	assert.Nil(t, err)
+	_, err = old.UploadStream(ctx, "stream", bytes.NewReader(value), aws.String("key=value"))
+	assert.Nil(t, err)
+
+	for _, key := range []string{"object", "stream"} {
+		assert.Nil(t, bucket.Reencrypt(ctx, key, old.Crypter))
+		assert.Equal(t, ErrDecryptFail, bucket.Reencrypt(ctx, key, old.Crypter), "should not decrypt %s with the old key again", key)
+		assert.Equal(t, "key=value", *objects.inputs["go-test/"+key].Tagging, "should keep the tags of %s", key)
+	}
+	contents, err := bucket.Download(ctx, "object", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, value, contents, "should encrypt objects with the new key")
+	assert.Equal(t, map[string]*string{"tenant": aws.String("acme")}, objects.inputs["go-test/object"].Metadata, "should keep the metadata")
+	assert.True(t, crypt.IsStream(objects.objects["go-test/stream"]), "should keep streams as streams")
+	body, err := bucket.DownloadStream(ctx, "stream")
+	assert.Nil(t, err)
+	defer body.Close()
+	contents, err = ioutil.ReadAll(body)
+	assert.Nil(t, err)
+	assert.Equal(t, value, contents, "should encrypt streams with the new key")
+}
+
+func TestBucketGetObjects(t *testing.T) {
+	bucket := &Bucket{Name: "go-test", Client: new(MockGetObjectS3API)}
+	keys, err := bucket.GetObjects(context.Background(), aws.String("prefix"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"key"}, keys)
+
+	exists, err := bucket.DoesExist(context.Background(), "prefix")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestPackageFunctionsNotInitialized(t *testing.T) {
+	_, err := GetBucketObjects(context.Background(), aws.String("prefix"))
+	assert.Equal(t, S3ClientIsNotInitializedError, err, "should not panic before InitializeS3Handlers")
+	assert.Equal(t, S3ClientIsNotInitializedError, DeleteObjFromS3(context.Background(), "key"))
+	_, err = DoesExist(context.Background(), "prefix")
+	assert.Equal(t, S3ClientIsNotInitializedError, err)
+}
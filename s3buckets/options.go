@@ -0,0 +1,220 @@
+package s3buckets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/diptamay/go-commons/crypt"
+)
+
+// MetadataCryptKeyID is the user metadata recording the id of the key an object was encrypted
+// with, for crypters with key ids such as crypt.KeyringCryptKeeper and crypt.SecretCryptKeeper.
+// It is reserved: uploads with user metadata of the same name are rejected.
+const MetadataCryptKeyID = "crypt-key-id"
+
+var ErrInvalidUploadOptions = errors.New("invalid upload options")
+
+// UploadOptions are the object settings of uploads. Settings that are not set are left to the
+// S3 bucket, such as its default encryption.
+type UploadOptions struct {
+	ContentType  string
+	CacheControl string
+	// Metadata is the user metadata of the object, except for MetadataCryptKeyID.
+	Metadata map[string]string
+	// Tagging is the tag set of the object, encoded as URL query parameters.
+	Tagging *string
+	// ServerSideEncryption is s3.ServerSideEncryptionAes256 for SSE-S3 or
+	// s3.ServerSideEncryptionAwsKms for SSE-KMS, with the key of SSEKMSKeyID if set.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+	// StorageClass is one of the s3.StorageClass values, such as s3.StorageClassStandardIa.
+	StorageClass string
+	// ObjectLockMode is s3.ObjectLockModeGovernance or s3.ObjectLockModeCompliance, retaining
+	// the object until ObjectLockRetainUntil. The bucket must have object lock enabled.
+	ObjectLockMode        string
+	ObjectLockRetainUntil time.Time
+	ObjectLockLegalHold   bool
+}
+
+// ObjectInfo is the metadata of an object returned by Head.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	VersionID    string
+	ContentType  string
+	CacheControl string
+	// Metadata is the user metadata of the object, with lower case keys.
+	Metadata map[string]string
+	// CryptKeyID is the id of the key the object was encrypted with, if it was recorded.
+	CryptKeyID            string
+	ServerSideEncryption  string
+	SSEKMSKeyID           string
+	StorageClass          string
+	ObjectLockMode        string
+	ObjectLockRetainUntil time.Time
+	ObjectLockLegalHold   bool
+}
+
+func (options *UploadOptions) validate() error {
+	if options.SSEKMSKeyID != "" && options.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("%w: SSEKMSKeyID requires aws:kms server side encryption", ErrInvalidUploadOptions)
+	}
+	if options.ObjectLockMode != "" && options.ObjectLockRetainUntil.IsZero() {
+		return fmt.Errorf("%w: ObjectLockMode requires ObjectLockRetainUntil", ErrInvalidUploadOptions)
+	}
+	for key := range options.Metadata {
+		// S3 metadata keys are case insensitive
+		if strings.EqualFold(key, MetadataCryptKeyID) {
+			return fmt.Errorf("%w: Metadata must not set the reserved %s", ErrInvalidUploadOptions, MetadataCryptKeyID)
+		}
+	}
+	return nil
+}
+
+// tokenKeyID returns the id of the key token was encrypted with, or "" for crypters without key
+// ids, including those whose tokens are not crypt envelopes.
+func tokenKeyID(token string) string {
+	keyID, err := crypt.TokenKeyID(token)
+	if err != nil {
+		return ""
+	}
+	return keyID
+}
+
+// apply sets the options on input, recording keyID, the id of the key the object was encrypted
+// with, in its metadata if not empty.
+func (options *UploadOptions) apply(input *s3manager.UploadInput, keyID string) {
+	metadata := map[string]*string{}
+	for key, value := range options.Metadata {
+		metadata[key] = aws.String(value)
+	}
+	if keyID != "" {
+		metadata[MetadataCryptKeyID] = aws.String(keyID)
+	}
+	if len(metadata) > 0 {
+		input.Metadata = metadata
+	}
+	if options.ContentType != "" {
+		input.ContentType = aws.String(options.ContentType)
+	}
+	if options.CacheControl != "" {
+		input.CacheControl = aws.String(options.CacheControl)
+	}
+	input.Tagging = options.Tagging
+	if options.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(options.ServerSideEncryption)
+	}
+	if options.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(options.SSEKMSKeyID)
+	}
+	if options.StorageClass != "" {
+		input.StorageClass = aws.String(options.StorageClass)
+	}
+	if options.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(options.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(options.ObjectLockRetainUntil)
+	}
+	if options.ObjectLockLegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+}
+
+// uploadOptions returns the UploadOptions of the bucket with tags, if not nil.
+func (bucket *Bucket) uploadOptions(tags *string) *UploadOptions {
+	options := &UploadOptions{}
+	if bucket.UploadOptions != nil {
+		*options = *bucket.UploadOptions
+	}
+	if tags != nil {
+		options.Tagging = tags
+	}
+	return options
+}
+
+// objectOptions returns the UploadOptions of the bucket with the content settings, user metadata,
+// tags, server side encryption and storage class of the object at filekey.
+func (bucket *Bucket) objectOptions(ctx context.Context, filekey string) (*UploadOptions, error) {
+	info, err := bucket.Head(ctx, filekey)
+	if err != nil {
+		return nil, err
+	}
+	var tagging *s3.GetObjectTaggingOutput
+	err = bucket.do(ctx, "get_tagging", func() error {
+		var err error
+		tagging, err = bucket.Client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+			Bucket: aws.String(bucket.Name),
+			Key:    aws.String(filekey),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	options := bucket.uploadOptions(nil)
+	options.ContentType = info.ContentType
+	options.CacheControl = info.CacheControl
+	options.Metadata = info.Metadata
+	// The key id is recorded again for the key the object is encrypted with now
+	delete(options.Metadata, MetadataCryptKeyID)
+	if info.ServerSideEncryption != "" {
+		options.ServerSideEncryption, options.SSEKMSKeyID = info.ServerSideEncryption, info.SSEKMSKeyID
+	}
+	if info.StorageClass != "" {
+		options.StorageClass = info.StorageClass
+	}
+	if len(tagging.TagSet) > 0 {
+		tags := url.Values{}
+		for _, tag := range tagging.TagSet {
+			tags.Add(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+		}
+		options.Tagging = aws.String(tags.Encode())
+	}
+	return options, nil
+}
+
+// Head returns the metadata of the object at filekey without downloading it.
+func (bucket *Bucket) Head(ctx context.Context, filekey string) (*ObjectInfo, error) {
+	var output *s3.HeadObjectOutput
+	err := bucket.do(ctx, "head", func() error {
+		var err error
+		output, err = bucket.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket.Name),
+			Key:    aws.String(filekey),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The SDK canonicalizes the metadata keys of responses as HTTP headers
+	metadata := make(map[string]string, len(output.Metadata))
+	for key, value := range output.Metadata {
+		metadata[strings.ToLower(key)] = aws.StringValue(value)
+	}
+	return &ObjectInfo{
+		Key:                   filekey,
+		Size:                  aws.Int64Value(output.ContentLength),
+		ETag:                  aws.StringValue(output.ETag),
+		LastModified:          aws.TimeValue(output.LastModified),
+		VersionID:             aws.StringValue(output.VersionId),
+		ContentType:           aws.StringValue(output.ContentType),
+		CacheControl:          aws.StringValue(output.CacheControl),
+		Metadata:              metadata,
+		CryptKeyID:            metadata[MetadataCryptKeyID],
+		ServerSideEncryption:  aws.StringValue(output.ServerSideEncryption),
+		SSEKMSKeyID:           aws.StringValue(output.SSEKMSKeyId),
+		StorageClass:          aws.StringValue(output.StorageClass),
+		ObjectLockMode:        aws.StringValue(output.ObjectLockMode),
+		ObjectLockRetainUntil: aws.TimeValue(output.ObjectLockRetainUntilDate),
+		ObjectLockLegalHold:   aws.StringValue(output.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn,
+	}, nil
+}
@@ -0,0 +1,150 @@
+package s3buckets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/diptamay/go-commons/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockRecordingUploader records the last upload input.
+type MockRecordingUploader struct {
+	input *s3manager.UploadInput
+}
+
+func (m *MockRecordingUploader) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	m.input = input
+	return &s3manager.UploadOutput{Location: *input.Key}, nil
+}
+
+type MockHeadObjectS3API struct {
+	s3iface.S3API
+	output *s3.HeadObjectOutput
+}
+
+func (m *MockHeadObjectS3API) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.output, nil
+}
+
+func makeTestKeyring(id string) *crypt.KeyringCryptKeeper {
+	keeper, err := crypt.MakeKeyringCryptKeeper(crypt.Key{ID: id, Value: base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))})
+	if err != nil {
+		panic(err)
+	}
+	return keeper
+}
+
+func TestUploadWithOptions(t *testing.T) {
+	uploader := &MockRecordingUploader{}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: makeTestKeyring("v2")}
+	retainUntil := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	options := &UploadOptions{
+		ContentType:           "application/json",
+		CacheControl:          "no-store",
+		Metadata:              map[string]string{"tenant": "acme"},
+		Tagging:               aws.String("key=value"),
+		ServerSideEncryption:  s3.ServerSideEncryptionAwsKms,
+		SSEKMSKeyID:           "alias/exports",
+		StorageClass:          s3.StorageClassStandardIa,
+		ObjectLockMode:        s3.ObjectLockModeCompliance,
+		ObjectLockRetainUntil: retainUntil,
+		ObjectLockLegalHold:   true,
+	}
+
+	_, err := bucket.UploadWithOptions(context.Background(), "key", []byte("contents"), options)
+	assert.Nil(t, err)
+	input := uploader.input
+	assert.Equal(t, "application/json", *input.ContentType)
+	assert.Equal(t, "no-store", *input.CacheControl)
+	assert.Equal(t, map[string]*string{"tenant": aws.String("acme"), MetadataCryptKeyID: aws.String("v2")}, input.Metadata,
+		"should record the key the object was encrypted with")
+	assert.Equal(t, "key=value", *input.Tagging)
+	assert.Equal(t, s3.ServerSideEncryptionAwsKms, *input.ServerSideEncryption)
+	assert.Equal(t, "alias/exports", *input.SSEKMSKeyId)
+	assert.Equal(t, s3.StorageClassStandardIa, *input.StorageClass)
+	assert.Equal(t, s3.ObjectLockModeCompliance, *input.ObjectLockMode)
+	assert.Equal(t, retainUntil, *input.ObjectLockRetainUntilDate)
+	assert.Equal(t, s3.ObjectLockLegalHoldStatusOn, *input.ObjectLockLegalHoldStatus)
+
+	_, err = bucket.UploadStreamWithOptions(context.Background(), "key", bytes.NewReader([]byte("contents")), options)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json", *uploader.input.ContentType, "should apply the options to streams")
+	assert.Equal(t, "v2", *uploader.input.Metadata[MetadataCryptKeyID], "should record the key the stream was encrypted with")
+}
+
+func TestUploadRecordsTokenKeyID(t *testing.T) {
+	uploader := &MockRecordingUploader{}
+	// The embedded interface hides ActiveKeyID, leaving the key id of the tokens
+	crypter := struct{ crypt.CryptKeeperInterface }{makeTestKeyring("v3")}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: crypter}
+
+	_, err := bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "v3", *uploader.input.Metadata[MetadataCryptKeyID], "should take the key id from the token")
+	_, err = bucket.UploadStream(context.Background(), "key", bytes.NewReader([]byte("contents")), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "v3", *uploader.input.Metadata[MetadataCryptKeyID], "should take the key id from the stream header")
+}
+
+func TestUploadDefaultOptions(t *testing.T) {
+	uploader := &MockRecordingUploader{}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"),
+		UploadOptions: &UploadOptions{ServerSideEncryption: s3.ServerSideEncryptionAes256, Tagging: aws.String("default=tag")}}
+
+	_, err := bucket.Upload(context.Background(), "key", []byte("contents"), aws.String("key=value"))
+	assert.Nil(t, err)
+	assert.Equal(t, s3.ServerSideEncryptionAes256, *uploader.input.ServerSideEncryption, "should use the options of the bucket")
+	assert.Equal(t, "key=value", *uploader.input.Tagging, "should prefer the tags of the upload")
+	assert.Nil(t, uploader.input.Metadata, "should not record a key id for crypters without one")
+	assert.Equal(t, "default=tag", *bucket.UploadOptions.Tagging, "should not change the options of the bucket")
+}
+
+func TestUploadInvalidOptions(t *testing.T) {
+	bucket := &Bucket{Name: "go-test", Uploader: &MockRecordingUploader{}, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef")}
+	for _, options := range []*UploadOptions{
+		{SSEKMSKeyID: "alias/exports"},
+		{ObjectLockMode: s3.ObjectLockModeGovernance},
+		{Metadata: map[string]string{"Crypt-Key-Id": "forged"}},
+	} {
+		_, err := bucket.UploadWithOptions(context.Background(), "key", []byte("contents"), options)
+		assert.True(t, errors.Is(err, ErrInvalidUploadOptions), "should reject %+v", options)
+	}
+}
+
+func TestHead(t *testing.T) {
+	lastModified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := &MockHeadObjectS3API{output: &s3.HeadObjectOutput{
+		ContentLength:        aws.Int64(42),
+		ContentType:          aws.String("application/json"),
+		ETag:                 aws.String(`"etag"`),
+		LastModified:         aws.Time(lastModified),
+		Metadata:             map[string]*string{"Crypt-Key-Id": aws.String("v2"), "Tenant": aws.String("acme")},
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+		SSEKMSKeyId:          aws.String("arn:aws:kms:us-east-1:123456789012:key/exports"),
+		StorageClass:         aws.String(s3.StorageClassStandardIa),
+		ObjectLockMode:       aws.String(s3.ObjectLockModeGovernance),
+	}}
+	bucket := &Bucket{Name: "go-test", Client: client}
+
+	info, err := bucket.Head(context.Background(), "key")
+	assert.Nil(t, err)
+	assert.Equal(t, "key", info.Key)
+	assert.Equal(t, int64(42), info.Size)
+	assert.Equal(t, lastModified, info.LastModified)
+	assert.Equal(t, "v2", info.CryptKeyID, "should return the key the object was encrypted with")
+	assert.Equal(t, map[string]string{"crypt-key-id": "v2", "tenant": "acme"}, info.Metadata)
+	assert.Equal(t, s3.ServerSideEncryptionAwsKms, info.ServerSideEncryption)
+	assert.Equal(t, s3.StorageClassStandardIa, info.StorageClass)
+	assert.Equal(t, s3.ObjectLockModeGovernance, info.ObjectLockMode)
+	assert.False(t, info.ObjectLockLegalHold)
+}
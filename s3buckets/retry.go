@@ -0,0 +1,239 @@
+package s3buckets
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	MetricRetried           = "s3buckets.operations.retried"
+	MetricOperationFailed   = "s3buckets.operations.failed"
+	MetricCircuitRejected   = "s3buckets.circuit.rejected"
+	MetricCircuitOpened     = "s3buckets.circuit.opened"
+	defaultRetryBaseDelay   = 100 * time.Millisecond
+	defaultRetryMaxDelay    = 5 * time.Second
+	defaultBreakerCooldown  = 30 * time.Second
+	defaultBreakerThreshold = 5
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// DefaultRetryPolicy is the retry policy of buckets created with MakeBucket.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: defaultRetryBaseDelay, MaxDelay: defaultRetryMaxDelay}
+
+// retryableCodes are the error codes of throttling, server errors and timeouts, besides the
+// throttling codes known to the SDK.
+var retryableCodes = map[string]bool{
+	"InternalError":                true,
+	"ServiceUnavailable":           true,
+	"SlowDown":                     true,
+	"RequestTimeout":               true,
+	"RequestTimeoutException":      true,
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+}
+
+// RetryPolicy configures how bucket operations are retried. The SDK retries single requests on
+// its own; the policy retries whole operations, such as multipart uploads, and applies to the
+// failures the SDK gave up on.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of an operation, including the first. Operations are
+	// not retried if it is less than 2.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled on every retry up to MaxDelay. The
+	// actual delay is picked at random up to that value.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Retryable reports whether an error is worth retrying, IsRetryable if not set.
+	Retryable func(error) bool
+}
+
+// delay returns the delay before the retry after attempt, with full jitter.
+func (policy *RetryPolicy) delay(attempt int) time.Duration {
+	base, max := policy.BaseDelay, policy.MaxDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if max <= 0 {
+		max = defaultRetryMaxDelay
+	}
+	delay := base << uint(attempt-1)
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func (policy *RetryPolicy) retryable(err error) bool {
+	if policy.Retryable != nil {
+		return policy.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// IsRetryable reports whether err is caused by throttling, a server error or a timeout.
+// Cancelled requests are not retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		status := requestFailure.StatusCode()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			return true
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		if awsErr.Code() == request.CanceledErrorCode {
+			return false
+		}
+		if request.IsErrorThrottle(awsErr) || retryableCodes[awsErr.Code()] {
+			return true
+		}
+		return awsErr.OrigErr() != nil && IsRetryable(awsErr.OrigErr())
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// CircuitBreaker stops calls to a bucket after Threshold consecutive retryable failures. After
+// Cooldown a single call is let through, which closes the breaker again if it succeeds. A trial
+// call that is never recorded is given up on after another Cooldown. The zero value is usable:
+// a Threshold below 1 defaults to 5 failures and a Cooldown of 0 to 30 seconds.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	mutex     sync.Mutex
+	failures  int
+	open      bool
+	openedAt  time.Time
+	trial     bool
+	trialAt   time.Time
+	now       func() time.Time
+}
+
+// MakeCircuitBreaker creates a breaker opening after threshold consecutive failures for
+// cooldown. A threshold below 1 defaults to 5 and a cooldown of 0 to 30 seconds.
+func MakeCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown, now: time.Now}
+}
+
+func (breaker *CircuitBreaker) clock() time.Time {
+	if breaker.now == nil {
+		return time.Now()
+	}
+	return breaker.now()
+}
+
+func (breaker *CircuitBreaker) threshold() int {
+	if breaker.Threshold < 1 {
+		return defaultBreakerThreshold
+	}
+	return breaker.Threshold
+}
+
+func (breaker *CircuitBreaker) cooldown() time.Duration {
+	if breaker.Cooldown <= 0 {
+		return defaultBreakerCooldown
+	}
+	return breaker.Cooldown
+}
+
+// Allow returns ErrCircuitOpen if calls are stopped.
+func (breaker *CircuitBreaker) Allow() error {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if !breaker.open {
+		return nil
+	}
+	now := breaker.clock()
+	since := breaker.openedAt
+	if breaker.trial {
+		since = breaker.trialAt
+	}
+	if now.Sub(since) < breaker.cooldown() {
+		return ErrCircuitOpen
+	}
+	breaker.trial = true
+	breaker.trialAt = now
+	return nil
+}
+
+// Record records the outcome of an allowed call and reports whether it opened the breaker.
+// Only retryable errors count as failures; other errors show that the bucket is reachable.
+func (breaker *CircuitBreaker) Record(err error) bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if !IsRetryable(err) {
+		breaker.failures = 0
+		breaker.open = false
+		breaker.trial = false
+		return false
+	}
+	breaker.failures++
+	if breaker.trial || (!breaker.open && breaker.failures >= breaker.threshold()) {
+		breaker.open = true
+		breaker.trial = false
+		breaker.openedAt = breaker.clock()
+		return true
+	}
+	return false
+}
+
+// do calls operation until it succeeds, fails with an error that is not retryable or runs out
+// of attempts, waiting between attempts as the retry policy of the bucket says.
+func (bucket *Bucket) do(ctx context.Context, name string, operation func() error) error {
+	return bucket.doAttempts(ctx, name, bucket.Retry.MaxAttempts, operation)
+}
+
+func (bucket *Bucket) doAttempts(ctx context.Context, name string, attempts int, operation func() error) error {
+	m := bucket.metrics()
+	tags := map[string]string{"bucket": bucket.Name, "operation": name}
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		if bucket.Breaker != nil {
+			if err = bucket.Breaker.Allow(); err != nil {
+				m.IncrNoLogTags(MetricCircuitRejected, tags)
+				break
+			}
+		}
+		err = operation()
+		if bucket.Breaker != nil && bucket.Breaker.Record(err) {
+			m.IncrNoLogTags(MetricCircuitOpened, tags)
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt >= attempts || ctx.Err() != nil || !bucket.Retry.retryable(err) {
+			break
+		}
+		m.IncrNoLogTags(MetricRetried, tags)
+		select {
+		case <-time.After(bucket.Retry.delay(attempt)):
+		case <-ctx.Done():
+			m.IncrNoLogTags(MetricOperationFailed, tags)
+			return err
+		}
+	}
+	m.IncrNoLogTags(MetricOperationFailed, tags)
+	return err
+}
@@ -0,0 +1,225 @@
+package s3buckets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/diptamay/go-commons/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockFlakyUploader fails the first failures uploads with err.
+type MockFlakyUploader struct {
+	*memoryObjects
+	failures int
+	err      error
+	calls    int
+}
+
+func (m *MockFlakyUploader) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	m.calls++
+	if m.calls <= m.failures {
+		// Like S3, the body is read before the request fails
+		ioutil.ReadAll(input.Body)
+		return nil, m.err
+	}
+	return m.memoryObjects.UploadWithContext(ctx, input, opts...)
+}
+
+var (
+	errThrottled   = awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "id")
+	errNotFound    = awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil), http.StatusNotFound, "id")
+	testRetryTimes = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	retryable := []error{
+		errThrottled,
+		awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error.", nil), http.StatusInternalServerError, "id"),
+		awserr.NewRequestFailure(awserr.New("RequestTimeout", "Your socket connection to the server was not read from or written to within the timeout period.", nil), http.StatusBadRequest, "id"),
+		awserr.New("Throttling", "Rate exceeded", nil),
+		awserr.New(request.ErrCodeRequestError, "send request failed", timeoutError{}),
+		awserr.New("MultipartUpload", "upload multipart failed", errThrottled),
+		timeoutError{},
+	}
+	for _, err := range retryable {
+		assert.True(t, IsRetryable(err), "should retry %v", err)
+	}
+	notRetryable := []error{
+		nil,
+		errNotFound,
+		awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "id"),
+		awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled),
+		context.DeadlineExceeded,
+		ErrDecryptFail,
+	}
+	for _, err := range notRetryable {
+		assert.False(t, IsRetryable(err), "should not retry %v", err)
+	}
+}
+
+func TestUploadRetries(t *testing.T) {
+	m := &mocks.MockMetrics{}
+	tags := map[string]string{"bucket": "go-test", "operation": "upload"}
+	m.On("IncrNoLogTags", MetricRetried, tags).Twice()
+	uploader := &MockFlakyUploader{memoryObjects: makeMemoryObjects(), failures: 2, err: errThrottled}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Downloader: uploader.memoryObjects, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), Metrics: m, Retry: testRetryTimes}
+
+	_, err := bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+	assert.Nil(t, err, "should retry throttled uploads")
+	assert.Equal(t, 3, uploader.calls)
+	contents, err := bucket.Download(context.Background(), "key", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("contents"), contents, "should upload the whole contents on retries")
+	m.AssertExpectations(t)
+
+	m = &mocks.MockMetrics{}
+	m.On("IncrNoLogTags", MetricOperationFailed, tags).Once()
+	bucket.Metrics = m
+	bucket.Uploader = &MockFlakyUploader{memoryObjects: makeMemoryObjects(), failures: 1, err: errNotFound}
+	_, err = bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+	assert.Equal(t, errNotFound, err, "should not retry errors that are not retryable")
+	assert.Equal(t, 1, bucket.Uploader.(*MockFlakyUploader).calls)
+	m.AssertExpectations(t)
+
+	bucket.Uploader = &MockFlakyUploader{memoryObjects: makeMemoryObjects(), failures: 5, err: errThrottled}
+	bucket.Metrics = nil
+	_, err = bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+	assert.Equal(t, errThrottled, err)
+	assert.Equal(t, 3, bucket.Uploader.(*MockFlakyUploader).calls, "should give up after MaxAttempts")
+}
+
+func TestRetryCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	uploader := &MockFlakyUploader{memoryObjects: makeMemoryObjects(), failures: 5, err: errThrottled}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), Retry: RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}}
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := bucket.Upload(ctx, "key", []byte("contents"), nil)
+	assert.Equal(t, errThrottled, err, "should stop waiting to retry when cancelled")
+	assert.Equal(t, 1, uploader.calls)
+}
+
+func TestUploadStreamRetries(t *testing.T) {
+	uploader := &MockFlakyUploader{memoryObjects: makeMemoryObjects(), failures: 1, err: errThrottled}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), Retry: testRetryTimes}
+
+	_, err := bucket.UploadStream(context.Background(), "key", bytes.NewReader([]byte("contents")), nil)
+	assert.Nil(t, err, "should retry streams that can be read again")
+	assert.Equal(t, 2, uploader.calls)
+	mockGetObject := &MockRangedGetObjectS3API{body: uploader.objects["go-test/key"], etag: "etag"}
+	bucket.Client = mockGetObject
+	body, err := bucket.DownloadStream(context.Background(), "key")
+	assert.Nil(t, err)
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("contents"), contents, "should upload the stream from its start on retries")
+
+	uploader.calls = 0
+	_, err = bucket.UploadStream(context.Background(), "key", ioutil.NopCloser(bytes.NewReader([]byte("contents"))), nil)
+	assert.Equal(t, errThrottled, err, "should not retry streams that can not be read again")
+	assert.Equal(t, 1, uploader.calls)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := MakeCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+	m := &mocks.MockMetrics{}
+	tags := map[string]string{"bucket": "go-test", "operation": "upload"}
+	m.On("IncrNoLogTags", MetricOperationFailed, tags).Times(5)
+	m.On("IncrNoLogTags", MetricCircuitOpened, tags).Twice()
+	m.On("IncrNoLogTags", MetricCircuitRejected, tags).Twice()
+	uploader := &MockFlakyUploader{memoryObjects: makeMemoryObjects(), failures: 3, err: errThrottled}
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), Breaker: breaker, Metrics: m}
+
+	for i := 0; i < 2; i++ {
+		_, err := bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+		assert.Equal(t, errThrottled, err)
+	}
+	_, err := bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+	assert.Equal(t, ErrCircuitOpen, err, "should stop calls after Threshold failures")
+	assert.Equal(t, 2, uploader.calls)
+
+	now = now.Add(time.Minute)
+	_, err = bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+	assert.Equal(t, errThrottled, err, "should let a call through after the cooldown")
+	_, err = bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+	assert.Equal(t, ErrCircuitOpen, err, "should open again if the trial call fails")
+
+	now = now.Add(time.Minute)
+	_, err = bucket.Upload(context.Background(), "key", []byte("contents"), nil)
+	assert.Nil(t, err, "should close once a trial call succeeds")
+	assert.Nil(t, breaker.Allow())
+	m.AssertExpectations(t)
+
+	breaker.Record(errThrottled)
+	breaker.Record(errNotFound)
+	breaker.Record(errThrottled)
+	assert.Nil(t, breaker.Allow(), "should only count consecutive failures")
+}
+
+func TestCircuitBreakerZeroValue(t *testing.T) {
+	breaker := &CircuitBreaker{}
+	for i := 1; i < defaultBreakerThreshold; i++ {
+		assert.False(t, breaker.Record(errThrottled), "should not open on the first failure without a Threshold")
+	}
+	assert.True(t, breaker.Record(errThrottled), "should open after the default threshold")
+	assert.Equal(t, ErrCircuitOpen, breaker.Allow())
+}
+
+func TestCircuitBreakerUnrecordedTrial(t *testing.T) {
+	now := time.Now()
+	breaker := &CircuitBreaker{Threshold: 1, Cooldown: time.Minute, now: func() time.Time { return now }}
+	breaker.Record(errThrottled)
+	now = now.Add(time.Minute)
+	assert.Nil(t, breaker.Allow(), "should let a trial call through after the cooldown")
+	assert.Equal(t, ErrCircuitOpen, breaker.Allow(), "should let a single trial call through")
+	now = now.Add(time.Minute)
+	assert.Nil(t, breaker.Allow(), "should give up on a trial call that is never recorded")
+}
+
+// MockFlakyCopyS3API fails the first failures copies with err.
+type MockFlakyCopyS3API struct {
+	MockCopyObjectS3BucketAPI
+	failures int
+	err      error
+	calls    int
+}
+
+func (m *MockFlakyCopyS3API) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	m.calls++
+	if m.calls <= m.failures {
+		return nil, m.err
+	}
+	return m.MockCopyObjectS3BucketAPI.CopyObjectWithContext(ctx, input, opts...)
+}
+
+func TestCopyRetries(t *testing.T) {
+	client := &MockFlakyCopyS3API{failures: 1, err: awserr.New(request.ErrCodeRequestError, "send request failed", timeoutError{})}
+	bucket := &Bucket{Name: "go-test", Client: client, Retry: testRetryTimes}
+	assert.Nil(t, bucket.Copy(context.Background(), "source", "target"), "should retry timed out copies")
+	assert.Equal(t, 2, client.calls)
+
+	client = &MockFlakyCopyS3API{failures: 1, err: errors.New("error in copyObject")}
+	bucket.Client = client
+	assert.NotNil(t, bucket.Copy(context.Background(), "source", "target"), "should not retry unknown errors")
+	assert.Equal(t, 1, client.calls)
+}
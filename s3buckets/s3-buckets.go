@@ -1,9 +1,7 @@
 package s3buckets
 
 import (
-	"bytes"
 	"context"
-	"fmt"
 	"io"
 	"log"
 	"os"
@@ -21,20 +19,27 @@ import (
 )
 
 type UploadFile func(ctx context.Context, filekey string, contents []byte, tags *string) (string, error)
-type UploadAllFiles func(ctx context.Context, filekeys *map[string]string) ([]string, error)
+type UploadAllFiles func(ctx context.Context, filekeys *map[string]string) (*map[string]string, error)
 type DownloadFile func(ctx context.Context, filekey string, crypterOldKey crypt.CryptKeeperInterface) ([]byte, error)
+type UploadFileStream func(ctx context.Context, filekey string, contents io.Reader, tags *string) (string, error)
+type DownloadFileStream func(ctx context.Context, filekey string) (io.ReadCloser, error)
 type DownloadAllFiles func(ctx context.Context, filekeys *[]string) (*map[string]string, error)
 type GetBucketObjectsTimeInterval func(ctx context.Context, prefix *string, startTime time.Time, endTime time.Time) ([]string, error)
 type CopyObjectInS3 func(ctx context.Context, filekey string, targetKey string) error
 type InitS3Bucket func(ctx context.Context, bucketCfg *S3BucketConfig) error
+type HeadObjectInS3 func(ctx context.Context, filekey string) (*ObjectInfo, error)
 
 var (
-	bucketName                    *string
 	S3Session                     *s3.S3
 	Upload                        UploadFile
 	Download                      DownloadFile
+	UploadStream                  UploadFileStream
+	DownloadStream                DownloadFileStream
 	GetKeysPerInterval            GetBucketObjectsTimeInterval
 	CopyKeysInBucket              CopyObjectInS3
+	UploadAll                     UploadAllFiles
+	DownloadAll                   DownloadAllFiles
+	Head                          HeadObjectInS3
 	InitializeS3Bucket            InitS3Bucket
 	S3ClientIsNotInitializedError = errors.New("S3 client is not initialized")
 	ErrDecryptFail                = errors.New("Decryption failed")
@@ -53,34 +58,6 @@ type DownloaderInterface interface {
 	DownloadWithContext(aws.Context, io.WriterAt, *s3.GetObjectInput, ...func(*s3manager.Downloader)) (int64, error)
 }
 
-func makeUploader(uploader UploaderInterface, crypter crypt.CryptKeeperInterface) UploadFile {
-	return func(ctx context.Context, filekey string, contents []byte, tags *string) (string, error) {
-		var encrypted []byte
-		var err error
-		encryptedBytes, err := crypter.Encrypt(contents)
-		encrypted = []byte(encryptedBytes)
-		if err != nil {
-			return "", err
-		}
-		s3Input := &s3manager.UploadInput{
-			Bucket: bucketName,
-			Key:    aws.String(filekey),
-			Body:   bytes.NewReader(encrypted),
-		}
-
-		if tags != nil {
-			s3Input.Tagging = tags
-		}
-
-		// We give control to a timeout to the http client
-		result, err := uploader.UploadWithContext(ctx, s3Input)
-		if err != nil {
-			return "", err
-		}
-		return result.Location, nil
-	}
-}
-
 func getS3BucketSession(bucketConfig *S3BucketConfig) (*session.Session, error) {
 	config := &aws.Config{
 		Region:     aws.String(helpers.GetAWSRegion()),
@@ -103,159 +80,60 @@ func getS3BucketSession(bucketConfig *S3BucketConfig) (*session.Session, error)
 	return session.NewSession(config)
 }
 
-func makeDownloader(downloader DownloaderInterface, crypter crypt.CryptKeeperInterface) DownloadFile {
-	return func(ctx context.Context, filekey string, crypterOldKey crypt.CryptKeeperInterface) ([]byte, error) {
-		writer := &aws.WriteAtBuffer{}
-		_, err := downloader.DownloadWithContext(ctx, writer, &s3.GetObjectInput{
-			Bucket: bucketName,
-			Key:    aws.String(filekey),
-		})
-
-		if err != nil {
-			return []byte{}, err
-		}
-
-		// For Debug documents that end with .enc.json - we do not decrypt as they are currently no encrypted with client-side encryption
-		if match, matcherr := regexp.MatchString(".+\\.enc\\.json$", filekey); matcherr == nil && match {
-			return writer.Bytes(), nil
-		}
-
-		if crypterOldKey != nil {
-			content, err := crypterOldKey.Decrypt(string(writer.Bytes()))
-			if err != nil {
-				return []byte{}, ErrDecryptFail
-			}
-			return content, nil
-		}
-		content, err := crypter.Decrypt(string(writer.Bytes()))
-		if err != nil {
-			return []byte{}, ErrDecryptFail
-		}
-		return content, nil
-	}
+// IsPlaintextObject reports whether the object is stored without client-side encryption.
+// For Debug documents that end with .enc.json - we do not decrypt as they are currently no encrypted with client-side encryption
+func IsPlaintextObject(filekey string) bool {
+	match, err := regexp.MatchString(".+\\.enc\\.json$", filekey)
+	return err == nil && match
 }
 
-func makeCopyObjectInS3(session s3iface.S3API) CopyObjectInS3 {
-	return func(ctx context.Context, sourceKey string, targetKey string) error {
-		// The name of the source bucket and key name of the source object, separated by a slash (/)
-		source := fmt.Sprint(*bucketName, "/", sourceKey)
-		_, err := session.CopyObjectWithContext(ctx,
-			&s3.CopyObjectInput{
-				Bucket:     bucketName,
-				Key:        aws.String(targetKey),
-				CopySource: aws.String(source),
-			})
-		if err != nil {
-			log.Println("Something went wrong with copying ", err)
-			return err
-		}
-		return nil
+// decryptObject decrypts contents bound to the object key. Objects uploaded before ciphertexts
+// were bound to their keys are decrypted without associated data if allowUnbound is set.
+func decryptObject(crypter crypt.CryptKeeperInterface, filekey string, contents string, allowUnbound bool) ([]byte, error) {
+	content, err := crypter.DecryptWithAssociatedData(contents, []byte(filekey))
+	if allowUnbound && errors.Is(err, crypt.ErrUnboundToken) {
+		return crypter.Decrypt(contents)
 	}
+	return content, err
 }
 
-func DeleteObjFromS3(ctx context.Context, obj string) error {
-	_, err := S3Session.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: bucketName, Key: aws.String(obj)})
-	if err != nil {
-		log.Println("Something went wrong with deletion", err)
-		return err
-	}
-
-	err = S3Session.WaitUntilObjectNotExists(&s3.HeadObjectInput{
-		Bucket: bucketName,
-		Key:    aws.String(obj),
-	})
+// defaultBucket is the bucket set up by InitializeS3Handlers for the package functions.
+var defaultBucket *Bucket
 
-	if err != nil {
-		return err
+func DeleteObjFromS3(ctx context.Context, obj string) error {
+	if defaultBucket == nil {
+		return S3ClientIsNotInitializedError
 	}
-
-	return nil
+	return defaultBucket.Delete(ctx, obj)
 }
 
 func GetBucketObjects(ctx context.Context, prefix *string) ([]string, error) {
-	query := &s3.ListObjectsV2Input{
-		Bucket: bucketName,
-		Prefix: prefix,
-	}
-
-	truncatedListing := true
-	var result []string
-
-	for truncatedListing {
-		response, err := S3Session.ListObjectsV2WithContext(ctx, query)
-
-		if err != nil {
-			log.Println("error fetching list of objects in s3bucket", err)
-			return result, err
-		}
-
-		for _, file := range response.Contents {
-			result = append(result, *file.Key)
-		}
-
-		// Set continuation token
-		query.ContinuationToken = response.NextContinuationToken
-		truncatedListing = *response.IsTruncated
-	}
-
-	return result, nil
-}
-
-// This function gets metadata of all the elements from a bucket and only returns the ones
-// that fall inside the passed in time values
-func makeGetBucketObjectsTimeInterval(session s3iface.S3API) GetBucketObjectsTimeInterval {
-	return func(ctx context.Context, prefix *string, startTime time.Time, endTime time.Time) ([]string, error) {
-		query := &s3.ListObjectsV2Input{
-			Bucket: bucketName,
-			Prefix: prefix,
-		}
-
-		truncatedListing := true
-		var result []string
-
-		for truncatedListing {
-			response, err := session.ListObjectsV2WithContext(ctx, query)
-
-			if err != nil {
-				log.Println("error fetching list of objects in s3bucket", err)
-				return result, err
-			}
-
-			for _, file := range response.Contents {
-				fileTime := *file.LastModified
-				if fileTime.Equal(startTime) || fileTime.Equal(endTime) ||
-					(fileTime.After(startTime) && fileTime.Before(endTime)) {
-					result = append(result, *file.Key)
-				}
-			}
-
-			// Set continuation token
-			query.ContinuationToken = response.NextContinuationToken
-			truncatedListing = *response.IsTruncated
-		}
-
-		return result, nil
+	if defaultBucket == nil {
+		return nil, S3ClientIsNotInitializedError
 	}
+	return defaultBucket.GetObjects(ctx, prefix)
 }
 
-func InitializeS3Handlers(ctx context.Context, bucketCfg *S3BucketConfig, crypter *crypt.CryptKeeper) error {
-	bucketName = bucketCfg.Name
-	enabledSession, err := getS3BucketSession(bucketCfg)
+// InitializeS3Handlers sets up the package functions for a single bucket. Services that use
+// more than one bucket should create a Bucket for each with MakeBucket instead.
+func InitializeS3Handlers(ctx context.Context, bucketCfg *S3BucketConfig, crypter crypt.CryptKeeperInterface) error {
+	bucket, err := MakeBucket(ctx, bucketCfg, crypter)
 	if err != nil {
 		return err
 	}
-	awsSession := session.Must(enabledSession, nil)
-	S3Session = s3.New(awsSession)
+	S3Session = bucket.Client.(*s3.S3)
+	defaultBucket = bucket
 
 	InitializeS3Bucket = makeInitializeS3Bucket(S3Session)
-	if err := InitializeS3Bucket(ctx, bucketCfg); err != nil {
-		return err
-	}
-
-	Upload = makeUploader(s3manager.NewUploader(awsSession), crypter)
-	Download = makeDownloader(s3manager.NewDownloader(awsSession), crypter)
-	GetKeysPerInterval = makeGetBucketObjectsTimeInterval(S3Session)
-	CopyKeysInBucket = makeCopyObjectInS3(S3Session)
+	Upload = bucket.Upload
+	Download = bucket.Download
+	UploadStream = bucket.UploadStream
+	DownloadStream = bucket.DownloadStream
+	GetKeysPerInterval = bucket.GetKeysPerInterval
+	CopyKeysInBucket = bucket.Copy
+	UploadAll = bucket.UploadAll
+	DownloadAll = bucket.DownloadAll
+	Head = bucket.Head
 
 	return nil
 }
@@ -268,36 +146,18 @@ func makeS3Bucket(ctx context.Context, session s3iface.S3API, bucket *string) (*
 
 func makeInitializeS3Bucket(session s3iface.S3API) InitS3Bucket {
 	return func(ctx context.Context, bucketCfg *S3BucketConfig) error {
-		log.Println("Checking if  bucket ", *bucketCfg.Name, " exists")
-
-		_, headBucketErr := session.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
-			Bucket: bucketCfg.Name,
-		})
-
-		if headBucketErr != nil && bucketCfg.S3LocalstackAddress != nil && *bucketCfg.S3LocalstackAddress != "" {
-			log.Println("Using localstack, and bucket does not exist, so creating new bucket ", *bucketCfg.Name)
-			if _, createErr := makeS3Bucket(ctx, session, bucketCfg.Name); createErr != nil {
-				log.Println("creating bucket failed,", *bucketCfg.Name, createErr.Error())
-				return createErr
-			}
-			log.Println("created bucket,", *bucketCfg.Name)
-		} else if headBucketErr != nil {
-			return headBucketErr
+		bucket := &Bucket{
+			Name:              aws.StringValue(bucketCfg.Name),
+			LocalstackAddress: aws.StringValue(bucketCfg.S3LocalstackAddress),
+			Client:            session,
 		}
-		return nil
+		return bucket.Initialize(ctx)
 	}
 }
 
 func DoesExist(ctx context.Context, prefix string) (bool, error) {
-	if S3Session == nil {
+	if defaultBucket == nil {
 		return false, S3ClientIsNotInitializedError
 	}
-	resp, err := S3Session.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket: bucketName,
-		Prefix: aws.String(prefix),
-	})
-	if err != nil {
-		return false, err
-	}
-	return len(resp.Contents) > 0, nil
+	return defaultBucket.DoesExist(ctx, prefix)
 }
@@ -7,6 +7,8 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
@@ -47,7 +49,6 @@ func (suite *S3BucketsTestSuite) SetupTest() {
 		panic(err)
 	}
 	Crypter = crypter
-	bucketName = aws.String("go-test")
 }
 
 type MockCrypter struct {
@@ -55,8 +56,8 @@ type MockCrypter struct {
 	crypt.CryptKeeperInterface
 }
 
-func (m *MockCrypter) Encrypt(encStr []byte) (string, error) {
-	m.Called(encStr)
+func (m *MockCrypter) EncryptWithAssociatedData(encStr []byte, associatedData []byte) (string, error) {
+	m.Called(encStr, associatedData)
 	return string(encStr), nil
 }
 
@@ -96,6 +97,23 @@ func (m *MockCopyObjectErrS3API) CopyObjectWithContext(ctx aws.Context, config *
 	return output, errors.New("error in copyObject")
 }
 
+// unboundObject is a stored object encrypted before ciphertexts were bound to their keys.
+func unboundObject() *s3.GetObjectOutput {
+	encrypted, err := makeTestCrypter("0123456789abcdef0123456789abcdef").Encrypt([]byte("contents"))
+	if err != nil {
+		panic(err)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(encrypted))}
+}
+
+func (m *MockCopyObjectErrS3API) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return unboundObject(), nil
+}
+
+func (m *MockCopyObjectS3BucketAPI) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return unboundObject(), nil
+}
+
 func (m *MockCopyObjectS3BucketAPI) CopyObjectWithContext(ctx aws.Context, config *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
 	key := "new_key"
 	var result s3.CopyObjectResult
@@ -205,7 +223,7 @@ type MockDownloader struct {
 
 func (m *MockDownloader) DownloadWithContext(ctx aws.Context, writer io.WriterAt, config *s3.GetObjectInput, opts ...func(*s3manager.Downloader)) (int64, error) {
 	m.Called(ctx, writer, config)
-	encrypted, err := Crypter.Encrypt([]byte(Chance.New().String()))
+	encrypted, err := Crypter.EncryptWithAssociatedData([]byte(Chance.New().String()), []byte(*config.Key))
 	if err != nil {
 		panic(err)
 	}
@@ -213,6 +231,21 @@ func (m *MockDownloader) DownloadWithContext(ctx aws.Context, writer io.WriterAt
 	return int64(100), nil
 }
 
+type MockUnboundDownloader struct {
+	mock.Mock
+	contents []byte
+}
+
+func (m *MockUnboundDownloader) DownloadWithContext(ctx aws.Context, writer io.WriterAt, config *s3.GetObjectInput, opts ...func(*s3manager.Downloader)) (int64, error) {
+	m.Called(ctx, writer, config)
+	encrypted, err := Crypter.Encrypt(m.contents)
+	if err != nil {
+		panic(err)
+	}
+	writer.WriteAt([]byte(encrypted), int64(0))
+	return int64(len(encrypted)), nil
+}
+
 type MockDownloaderWithError struct {
 	mock.Mock
 }
@@ -222,23 +255,51 @@ func (m *MockDownloaderWithError) DownloadWithContext(ctx aws.Context, writer io
 	return int64(0), errors.New("error in download")
 }
 
+type MockStreamUploader struct {
+	mock.Mock
+	body []byte
+}
+
+func (m *MockStreamUploader) UploadWithContext(ctx aws.Context, config *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	m.Called(ctx, config)
+	body, err := ioutil.ReadAll(config.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.body = body
+	return &s3manager.UploadOutput{
+		Location: *config.Key,
+	}, nil
+}
+
+type MockGetObjectStreamS3API struct {
+	s3iface.S3API
+	body []byte
+}
+
+func (m *MockGetObjectStreamS3API) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(m.body)),
+	}, nil
+}
+
 func (suite *S3BucketsTestSuite) TestUpload() {
 	chance := Chance.New()
 	value := []byte("UNENCRYPTED_CONTENTS")
 
+	key := chance.Word()
 	mockCrypter := new(MockCrypter)
 	mockCrypter.
-		On("Encrypt", value).
+		On("EncryptWithAssociatedData", value, []byte(key)).
 		Return("ENCRYPTED_CONTENTS", nil)
 
-	key := chance.Word()
 	expected := &s3manager.UploadInput{
 		Bucket: aws.String("go-test"),
 		Key:    aws.String(key),
 		Body:   bytes.NewReader(value),
 	}
 	mockUploader := new(MockUploaderS3API)
-	MockUpload := makeUploader(mockUploader, mockCrypter)
+	MockUpload := (&Bucket{Name: "go-test", Uploader: mockUploader, Crypter: mockCrypter}).Upload
 	mockUploader.
 		On("UploadWithContext", context.Background(), expected).
 		Return(mock.AnythingOfType("*s3manager.UploadOutput"), nil)
@@ -255,13 +316,8 @@ func (suite *S3BucketsTestSuite) TestUploadWithError() {
 	key := chance.Word()
 	value := []byte("UNENCRYPTED_CONTENTS")
 
-	mockCrypter := new(MockCrypter)
-	mockCrypter.
-		On("Encrypt", value).
-		Return("ENCRYPTED_CONTENTS", nil)
-
 	mockUploadWithErr := new(MockUploaderWithError)
-	MockUpload := makeUploader(mockUploadWithErr, Crypter)
+	MockUpload := (&Bucket{Name: "go-test", Uploader: mockUploadWithErr, Crypter: Crypter}).Upload
 	mockUploadWithErr.
 		On("UploadWithContext", mock.Anything, mock.AnythingOfType("*s3manager.UploadInput")).
 		Return(mock.AnythingOfType("*s3manager.UploadOutput"), mock.AnythingOfType("error"))
@@ -275,12 +331,12 @@ func (suite *S3BucketsTestSuite) TestUploadWithTag() {
 	chance := Chance.New()
 	value := []byte("UNENCRYPTED_CONTENTS")
 
+	key := chance.Word()
 	mockCrypter := new(MockCrypter)
 	mockCrypter.
-		On("Encrypt", value).
+		On("EncryptWithAssociatedData", value, []byte(key)).
 		Return("ENCRYPTED_CONTENTS", nil)
 
-	key := chance.Word()
 	tag := "key=value"
 	expected := &s3manager.UploadInput{
 		Bucket:  aws.String("go-test"),
@@ -289,7 +345,7 @@ func (suite *S3BucketsTestSuite) TestUploadWithTag() {
 		Tagging: aws.String(tag),
 	}
 	mockUploader := new(MockUploaderS3API)
-	MockUpload := makeUploader(mockUploader, mockCrypter)
+	MockUpload := (&Bucket{Name: "go-test", Uploader: mockUploader, Crypter: mockCrypter}).Upload
 	mockUploader.
 		On("UploadWithContext", context.Background(), expected).
 		Return(mock.AnythingOfType("*s3manager.UploadOutput"), nil)
@@ -304,22 +360,40 @@ func (suite *S3BucketsTestSuite) TestUploadWithTag() {
 func (suite *S3BucketsTestSuite) TestDownload() {
 	chance := Chance.New()
 	mockDownload := new(MockDownloader)
-	MockDownload := makeDownloader(mockDownload, Crypter)
+	MockDownload := (&Bucket{Name: "go-test", Downloader: mockDownload, Crypter: Crypter}).Download
 	file := chance.Word()
 	mockDownload.
 		On("DownloadWithContext", mock.Anything, mock.AnythingOfType("*aws.WriteAtBuffer"), mock.AnythingOfType("*s3.GetObjectInput")).
 		Return(mock.AnythingOfType("int64"), nil)
 
-	result, _ := MockDownload(context.Background(), file, nil)
+	result, err := MockDownload(context.Background(), file, nil)
 
+	assert.Nil(suite.T(), err, "should decrypt contents bound to the object key")
 	assert.IsType(suite.T(), []byte{}, result, "should return a decrypted byte array")
 }
 
+func (suite *S3BucketsTestSuite) TestDownloadUnboundObject() {
+	value := []byte(Chance.New().String())
+	mockDownload := &MockUnboundDownloader{contents: value}
+	bucket := &Bucket{Name: "go-test", Downloader: mockDownload, Crypter: Crypter}
+	mockDownload.
+		On("DownloadWithContext", mock.Anything, mock.AnythingOfType("*aws.WriteAtBuffer"), mock.AnythingOfType("*s3.GetObjectInput")).
+		Return(mock.AnythingOfType("int64"), nil)
+
+	result, err := bucket.Download(context.Background(), "key", nil)
+	assert.Nil(suite.T(), err, "should decrypt objects uploaded before they were bound to their key")
+	assert.Equal(suite.T(), value, result, "should return the decrypted contents")
+
+	bucket.RejectUnboundObjects = true
+	_, err = bucket.Download(context.Background(), "key", nil)
+	assert.Equal(suite.T(), ErrDecryptFail, err, "should not decrypt unbound objects once they are rejected")
+}
+
 func (suite *S3BucketsTestSuite) TestDownloadWithErr() {
 	chance := Chance.New()
 	file := chance.Word()
 	mockDownload := new(MockDownloaderWithError)
-	MockDownload := makeDownloader(mockDownload, Crypter)
+	MockDownload := (&Bucket{Name: "go-test", Downloader: mockDownload, Crypter: Crypter}).Download
 	mockDownload.
 		On("DownloadWithContext", mock.Anything, mock.AnythingOfType("*aws.WriteAtBuffer"), mock.AnythingOfType("*s3.GetObjectInput")).
 		Return(mock.AnythingOfType("int64"), mock.AnythingOfType("error"))
@@ -335,7 +409,7 @@ func (suite *S3BucketsTestSuite) TestGetBucketObjectsTimeInterval() {
 	startTime, _ := time.Parse(time.RFC3339, "2006-01-01T15:04:05Z")
 	endTime, _ := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
 	mockGetObject := new(MockGetObjectS3API)
-	mockObjectGetter := makeGetBucketObjectsTimeInterval(mockGetObject)
+	mockObjectGetter := (&Bucket{Name: "go-test", Client: mockGetObject}).GetKeysPerInterval
 	response, _ := mockObjectGetter(context.Background(), &prefix, startTime, endTime)
 	assert.Equal(suite.T(), []string{"key"}, response, "should return single key")
 }
@@ -345,7 +419,7 @@ func (suite *S3BucketsTestSuite) TestGetBucketObjectsTimeIntervalError() {
 	startTime, _ := time.Parse(time.RFC3339, "2006-01-01T15:04:05Z")
 	endTime, _ := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
 	mockGetObjectErr := new(MockGetObjectErrorS3API)
-	mockObjectGetter := makeGetBucketObjectsTimeInterval(mockGetObjectErr)
+	mockObjectGetter := (&Bucket{Name: "go-test", Client: mockGetObjectErr}).GetKeysPerInterval
 	_, err := mockObjectGetter(context.Background(), &prefix, startTime, endTime)
 	assert.Equal(suite.T(), "error in listObject", err.Error(), "should surface an error in download go routine")
 }
@@ -355,7 +429,7 @@ func (suite *S3BucketsTestSuite) TestGetBucketObjectsTimeIntervalEmpty() {
 	startTime, _ := time.Parse(time.RFC3339, "2006-01-01T15:04:05Z")
 	endTime, _ := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
 	mockGetObjectEmpty := new(MockGetObjectEmptyS3API)
-	mockObjectGetter := makeGetBucketObjectsTimeInterval(mockGetObjectEmpty)
+	mockObjectGetter := (&Bucket{Name: "go-test", Client: mockGetObjectEmpty}).GetKeysPerInterval
 	response, _ := mockObjectGetter(context.Background(), &prefix, startTime, endTime)
 	assert.Equal(suite.T(), []string(nil), response, "should return single key")
 }
@@ -364,7 +438,7 @@ func (suite *S3BucketsTestSuite) TestCopyObjectInS3() {
 	mockCopyObject := new(MockCopyObjectS3BucketAPI)
 	prefix := "prefix"
 	target := "target"
-	mockCopyKeyInS3 := makeCopyObjectInS3(mockCopyObject)
+	mockCopyKeyInS3 := (&Bucket{Name: "go-test", Client: mockCopyObject}).Copy
 	response := mockCopyKeyInS3(context.Background(), prefix, target)
 	assert.Equal(suite.T(), nil, response, "should return nothing if successful")
 }
@@ -373,7 +447,7 @@ func (suite *S3BucketsTestSuite) TestCopyObjectInS3WithError() {
 	mockCopyObject := new(MockCopyObjectErrS3API)
 	prefix := "prefix"
 	target := "target"
-	mockCopyKeyInS3 := makeCopyObjectInS3(mockCopyObject)
+	mockCopyKeyInS3 := (&Bucket{Name: "go-test", Client: mockCopyObject}).Copy
 	err := mockCopyKeyInS3(context.Background(), prefix, target)
 	assert.Equal(suite.T(), "error in copyObject", err.Error(), "should return an error")
 }
@@ -496,3 +570,35 @@ func (suite *S3BucketsTestSuite) TestInitializeS3BucketExists() {
 	mockInitBucket.AssertNotCalled(suite.T(), "CreateBucketWithContext")
 	assert.Nil(suite.T(), err, "Error should be nil")
 }
+
+func (suite *S3BucketsTestSuite) TestUploadAndDownloadStream() {
+	chance := Chance.New()
+	key := chance.Word()
+	value := []byte(chance.String())
+
+	mockUploader := new(MockStreamUploader)
+	mockUploader.
+		On("UploadWithContext", mock.Anything, mock.AnythingOfType("*s3manager.UploadInput")).
+		Return(mock.AnythingOfType("*s3manager.UploadOutput"), nil)
+	location, err := (&Bucket{Name: "go-test", Uploader: mockUploader, Crypter: Crypter}).UploadStream(context.Background(), key, bytes.NewReader(value), nil)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), key, location, "should use key for file location")
+	assert.NotEqual(suite.T(), value, mockUploader.body, "should upload encrypted contents")
+
+	mockGetObject := &MockGetObjectStreamS3API{body: mockUploader.body}
+	_, err = (&Bucket{Name: "go-test", Client: mockGetObject, Crypter: Crypter}).DownloadStream(context.Background(), "another-key")
+	assert.NotNil(suite.T(), err, "should not decrypt a stream bound to another object key")
+
+	body, err := (&Bucket{Name: "go-test", Client: mockGetObject, Crypter: Crypter}).DownloadStream(context.Background(), key)
+	assert.Nil(suite.T(), err)
+	defer body.Close()
+	result, err := ioutil.ReadAll(body)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), value, result, "should decrypt the streamed object")
+}
+
+func (suite *S3BucketsTestSuite) TestDownloadStreamWithDecryptError() {
+	mockGetObject := &MockGetObjectStreamS3API{body: []byte("UNENCRYPTED_CONTENTS")}
+	_, err := (&Bucket{Name: "go-test", Client: mockGetObject, Crypter: Crypter}).DownloadStream(context.Background(), "key")
+	assert.Equal(suite.T(), ErrDecryptFail, err, "should fail on objects that are not encrypted streams")
+}
@@ -0,0 +1,166 @@
+package s3buckets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func (bucket *Bucket) partSize() int64 {
+	if bucket.PartSize > 0 {
+		return bucket.PartSize
+	}
+	return s3manager.DefaultUploadPartSize
+}
+
+func (bucket *Bucket) concurrency() int {
+	if bucket.Concurrency > 0 {
+		return bucket.Concurrency
+	}
+	return s3manager.DefaultDownloadConcurrency
+}
+
+// configureUploader sets the part size and concurrency of multipart uploads.
+func (bucket *Bucket) configureUploader(uploader *s3manager.Uploader) {
+	uploader.PartSize = bucket.partSize()
+	uploader.Concurrency = bucket.concurrency()
+}
+
+// redirectWriter writes to Writer, which can be replaced between writes.
+type redirectWriter struct {
+	io.Writer
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// rangedBody reads an object in parts, fetching up to concurrency parts ahead of the reader in
+// parallel, so at most that many parts are held in memory.
+type rangedBody struct {
+	cancel  context.CancelFunc
+	parts   chan chan partResult
+	current io.Reader
+	err     error
+}
+
+// objectSize returns the size of the object from the Content-Range of a ranged response, or -1
+// if the response holds the whole object.
+func objectSize(contentRange *string) int64 {
+	value := aws.StringValue(contentRange)
+	separator := strings.LastIndex(value, "/")
+	if separator < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(value[separator+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// isInvalidRange reports whether err is the 416 S3 returns for a range starting past the end of
+// the object, which every range of an empty object does.
+func isInvalidRange(err error) bool {
+	var requestFailure awserr.RequestFailure
+	return errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusRequestedRangeNotSatisfiable
+}
+
+func (bucket *Bucket) getRange(ctx context.Context, filekey string, start int64, etag *string) ([]byte, *s3.GetObjectOutput, error) {
+	var data []byte
+	var output *s3.GetObjectOutput
+	err := bucket.do(ctx, "download_stream", func() error {
+		var err error
+		output, err = bucket.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket.Name),
+			Key:    aws.String(filekey),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, start+bucket.partSize()-1)),
+			// Parts of an object that is overwritten while it is read must not be mixed
+			IfMatch: etag,
+		})
+		if start == 0 && isInvalidRange(err) {
+			// The object is empty
+			output = &s3.GetObjectOutput{}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+		data, err = ioutil.ReadAll(output.Body)
+		return err
+	})
+	return data, output, err
+}
+
+// openRanged fetches the first part of the object and starts fetching the rest in the
+// background. The returned body must be closed.
+func (bucket *Bucket) openRanged(ctx context.Context, filekey string) (*rangedBody, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	first, output, err := bucket.getRange(ctx, filekey, 0, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &rangedBody{
+		cancel:  cancel,
+		parts:   make(chan chan partResult, bucket.concurrency()),
+		current: bytes.NewReader(first),
+	}
+	size := objectSize(output.ContentRange)
+	go func() {
+		defer close(body.parts)
+		for start := bucket.partSize(); start < size; start += bucket.partSize() {
+			part := make(chan partResult, 1)
+			select {
+			case body.parts <- part:
+			case <-ctx.Done():
+				return
+			}
+			go func(start int64) {
+				data, _, err := bucket.getRange(ctx, filekey, start, output.ETag)
+				part <- partResult{data, err}
+			}(start)
+		}
+	}()
+	return body, nil
+}
+
+func (body *rangedBody) Read(p []byte) (int, error) {
+	for body.err == nil {
+		n, err := body.current.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		part, ok := <-body.parts
+		if !ok {
+			body.err = io.EOF
+			break
+		}
+		result := <-part
+		if result.err != nil {
+			body.err = result.err
+			break
+		}
+		body.current = bytes.NewReader(result.data)
+	}
+	return 0, body.err
+}
+
+// Close stops fetching parts that have not been read.
+func (body *rangedBody) Close() error {
+	body.cancel()
+	return nil
+}
@@ -0,0 +1,151 @@
+package s3buckets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockRangedGetObjectS3API serves ranges of body like S3 and records the requested ranges.
+type MockRangedGetObjectS3API struct {
+	s3iface.S3API
+	body   []byte
+	etag   string
+	mutex  sync.Mutex
+	ranges []string
+}
+
+func (m *MockRangedGetObjectS3API) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	m.mutex.Lock()
+	m.ranges = append(m.ranges, *input.Range)
+	m.mutex.Unlock()
+	if input.IfMatch != nil && *input.IfMatch != m.etag {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+	if start >= len(m.body) {
+		return nil, awserr.NewRequestFailure(awserr.New("InvalidRange", "The requested range is not satisfiable", nil), http.StatusRequestedRangeNotSatisfiable, "")
+	}
+	if end >= len(m.body) {
+		end = len(m.body) - 1
+	}
+	return &s3.GetObjectOutput{
+		Body:         ioutil.NopCloser(bytes.NewReader(m.body[start : end+1])),
+		ContentRange: aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(m.body))),
+		ETag:         aws.String(m.etag),
+	}, nil
+}
+
+func uploadTestStream(t *testing.T, bucket *Bucket, key string, value []byte) []byte {
+	uploader := new(MockStreamUploader)
+	uploader.On("UploadWithContext", mock.Anything, mock.Anything)
+	bucket.Uploader = uploader
+	_, err := bucket.UploadStream(context.Background(), key, bytes.NewReader(value), nil)
+	assert.Nil(t, err)
+	return uploader.body
+}
+
+func TestDownloadStreamRanges(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789"), 10000)
+	bucket := &Bucket{Name: "go-test", Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), PartSize: 4096, Concurrency: 3}
+	mockGetObject := &MockRangedGetObjectS3API{body: uploadTestStream(t, bucket, "key", value), etag: "etag"}
+	bucket.Client = mockGetObject
+
+	body, err := bucket.DownloadStream(context.Background(), "key")
+	assert.Nil(t, err)
+	result, err := ioutil.ReadAll(body)
+	assert.Nil(t, err)
+	assert.Nil(t, body.Close())
+	assert.Equal(t, value, result, "should decrypt the object from its ranges")
+	parts := (len(mockGetObject.body) + 4095) / 4096
+	assert.Equal(t, parts, len(mockGetObject.ranges), "should download the object in parts of PartSize")
+	assert.Contains(t, mockGetObject.ranges, "bytes=4096-8191")
+}
+
+func TestDownloadStreamChangedObject(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789"), 10000)
+	bucket := &Bucket{Name: "go-test", Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), PartSize: 4096}
+	mockGetObject := &MockRangedGetObjectS3API{body: uploadTestStream(t, bucket, "key", value), etag: "etag"}
+	bucket.Client = mockGetObject
+
+	body, err := bucket.DownloadStream(context.Background(), "key")
+	assert.Nil(t, err)
+	defer body.Close()
+	mockGetObject.mutex.Lock()
+	mockGetObject.etag = "overwritten"
+	mockGetObject.mutex.Unlock()
+	_, err = ioutil.ReadAll(body)
+	assert.NotNil(t, err, "should fail if the object is overwritten while it is read")
+}
+
+func TestDownloadStreamClose(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789"), 10000)
+	bucket := &Bucket{Name: "go-test", Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), PartSize: 1024, Concurrency: 2}
+	mockGetObject := &MockRangedGetObjectS3API{body: uploadTestStream(t, bucket, "key", value), etag: "etag"}
+	bucket.Client = mockGetObject
+
+	body, err := bucket.DownloadStream(context.Background(), "key")
+	assert.Nil(t, err)
+	assert.Nil(t, body.Close())
+	mockGetObject.mutex.Lock()
+	defer mockGetObject.mutex.Unlock()
+	assert.Less(t, len(mockGetObject.ranges), 10, "should stop fetching parts once closed")
+}
+
+func TestDownloadStreamEmptyObject(t *testing.T) {
+	mockGetObject := &MockRangedGetObjectS3API{body: []byte{}, etag: "etag"}
+	bucket := &Bucket{Name: "go-test", Client: mockGetObject, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), PartSize: 4096}
+
+	body, err := bucket.openRanged(context.Background(), "key")
+	assert.Nil(t, err, "should read empty objects S3 can not serve a range of")
+	result, err := ioutil.ReadAll(body)
+	assert.Nil(t, err)
+	assert.Nil(t, body.Close())
+	assert.Empty(t, result)
+	assert.Equal(t, []string{"bytes=0-4095"}, mockGetObject.ranges, "should not fetch further parts")
+
+	_, err = bucket.DownloadStream(context.Background(), "key")
+	assert.Equal(t, ErrDecryptFail, err, "should not decrypt an empty object")
+}
+
+type MockOptionsUploader struct {
+	MockStreamUploader
+	uploader s3manager.Uploader
+}
+
+func (m *MockOptionsUploader) UploadWithContext(ctx aws.Context, config *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	for _, opt := range opts {
+		opt(&m.uploader)
+	}
+	return m.MockStreamUploader.UploadWithContext(ctx, config)
+}
+
+func TestUploadStreamParts(t *testing.T) {
+	uploader := new(MockOptionsUploader)
+	uploader.On("UploadWithContext", mock.Anything, mock.Anything)
+	bucket := &Bucket{Name: "go-test", Uploader: uploader, Crypter: makeTestCrypter("0123456789abcdef0123456789abcdef"), PartSize: 8 << 20, Concurrency: 2}
+	_, err := bucket.UploadStream(context.Background(), "key", bytes.NewReader([]byte("contents")), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8<<20), uploader.uploader.PartSize, "should upload in parts of PartSize")
+	assert.Equal(t, 2, uploader.uploader.Concurrency)
+
+	_, err = (&Bucket{Name: "go-test", Uploader: uploader, Crypter: bucket.Crypter}).UploadStream(context.Background(), "key", bytes.NewReader([]byte("contents")), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(s3manager.DefaultUploadPartSize), uploader.uploader.PartSize, "should default to the s3manager part size")
+}
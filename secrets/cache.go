@@ -0,0 +1,221 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultSecretCacheTTL = 5 * time.Minute
+
+// SecretProviderFunc adapts a function to a SecretProvider.
+type SecretProviderFunc func(ctx context.Context, secretName string) (*Secret, error)
+
+func (fetch SecretProviderFunc) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	return fetch(ctx, secretName)
+}
+
+// SecretChangeHandler is called with the previous and the current secret when the Version of a
+// cached secret changes.
+type SecretChangeHandler func(previous *Secret, current *Secret)
+
+type cachedSecret struct {
+	secret  *Secret
+	expires time.Time
+}
+
+// secretFetch is a fetch in flight, shared by the callers asking for the same secret.
+type secretFetch struct {
+	done   chan struct{}
+	secret *Secret
+	err    error
+}
+
+// SecretCache caches the secrets of a provider for a TTL and is safe for concurrent use.
+// Expired secrets are fetched again on their next use; if the provider fails, the expired
+// secret is returned instead, so an outage of the provider does not take down its callers.
+// Subscribers are notified when a fetch returns a new Version of a secret.
+type SecretCache struct {
+	provider    SecretProvider
+	ttl         time.Duration
+	mu          sync.Mutex
+	entries     map[string]cachedSecret
+	fetches     map[string]*secretFetch
+	subscribers map[string]map[int]SecretChangeHandler
+	nextID      int
+	now         func() time.Time
+}
+
+// copySecret copies secret including the bytes of its value, so that zeroing the copy does not
+// zero the original.
+func copySecret(secret *Secret) *Secret {
+	copied := *secret
+	copied.Value = SecretValue{bytes: secret.Value.RevealBytes()}
+	return &copied
+}
+
+func (cache *SecretCache) expired(entry cachedSecret) bool {
+	return cache.ttl > 0 && !cache.now().Before(entry.expires)
+}
+
+// detachedContext keeps the values of its parent but not its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (ctx detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (ctx detachedContext) Done() <-chan struct{}             { return nil }
+func (ctx detachedContext) Err() error                        { return nil }
+func (ctx detachedContext) Value(key interface{}) interface{} { return ctx.parent.Value(key) }
+
+// fetch fetches the secret from the provider and caches it. Concurrent fetches of a secret
+// share a single call to the provider, which is not cancelled with the context of the caller
+// that started it; every caller stops waiting when its own context is done.
+func (cache *SecretCache) fetch(ctx context.Context, secretName string) (*Secret, error) {
+	cache.mu.Lock()
+	current, ok := cache.fetches[secretName]
+	if !ok {
+		current = &secretFetch{done: make(chan struct{})}
+		cache.fetches[secretName] = current
+		go cache.fetchShared(detachedContext{ctx}, secretName, current)
+	}
+	cache.mu.Unlock()
+	select {
+	case <-current.done:
+		if current.err != nil {
+			return nil, current.err
+		}
+		return copySecret(current.secret), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cache *SecretCache) fetchShared(ctx context.Context, secretName string, current *secretFetch) {
+	secret, err := cache.provider.GetSecret(ctx, secretName)
+
+	var previous *Secret
+	var handlers []SecretChangeHandler
+	cache.mu.Lock()
+	delete(cache.fetches, secretName)
+	if err == nil {
+		if entry, ok := cache.entries[secretName]; ok {
+			previous = entry.secret
+		}
+		cache.entries[secretName] = cachedSecret{secret: copySecret(secret), expires: cache.now().Add(cache.ttl)}
+		if previous != nil && !reflect.DeepEqual(previous.Version, secret.Version) {
+			for _, handler := range cache.subscribers[secretName] {
+				handlers = append(handlers, handler)
+			}
+		}
+	}
+	cache.mu.Unlock()
+
+	// Handlers are called before the callers waiting for the fetch are released
+	for _, handler := range handlers {
+		handler(copySecret(previous), copySecret(secret))
+	}
+	current.secret, current.err = secret, err
+	close(current.done)
+}
+
+// GetSecret returns the cached secret, fetching it if it is not cached or has expired. If the
+// fetch of an expired secret fails, the expired secret is returned.
+func (cache *SecretCache) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	cache.mu.Lock()
+	entry, ok := cache.entries[secretName]
+	cache.mu.Unlock()
+	if ok && !cache.expired(entry) {
+		return copySecret(entry.secret), nil
+	}
+	secret, err := cache.fetch(ctx, secretName)
+	if err != nil {
+		if ok {
+			log.Println(fmt.Sprintf("error refreshing secret %#v, using the cached version: %#v", secretName, err.Error()))
+			return copySecret(entry.secret), nil
+		}
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Refresh fetches every cached secret again, regardless of its expiry. Secrets that can not be
+// fetched stay cached, and their errors are returned together.
+func (cache *SecretCache) Refresh(ctx context.Context) error {
+	cache.mu.Lock()
+	names := make([]string, 0, len(cache.entries))
+	for name := range cache.entries {
+		names = append(names, name)
+	}
+	cache.mu.Unlock()
+	sort.Strings(names)
+	var failures []string
+	for _, name := range names {
+		if _, err := cache.fetch(ctx, name); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("error refreshing secrets: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Watch refreshes the cached secrets every interval, DefaultSecretCacheTTL if it is not
+// positive, until ctx is done. Refresh errors are passed to onError, if not nil.
+func (cache *SecretCache) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		interval = DefaultSecretCacheTTL
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := cache.Refresh(ctx); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// Subscribe registers handler to be called when the Version of the secret named secretName
+// changes, and returns a function that unregisters it. Handlers are called from the goroutine
+// that fetched the new version, before the callers waiting for the fetch return.
+func (cache *SecretCache) Subscribe(secretName string, handler SecretChangeHandler) func() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	id := cache.nextID
+	cache.nextID++
+	if cache.subscribers[secretName] == nil {
+		cache.subscribers[secretName] = map[int]SecretChangeHandler{}
+	}
+	cache.subscribers[secretName][id] = handler
+	return func() {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		delete(cache.subscribers[secretName], id)
+	}
+}
+
+// MakeSecretCache creates a cache of the secrets of provider. Secrets expire after ttl, or
+// never if ttl is not positive.
+func MakeSecretCache(provider SecretProvider, ttl time.Duration) *SecretCache {
+	return &SecretCache{
+		provider:    provider,
+		ttl:         ttl,
+		entries:     map[string]cachedSecret{},
+		fetches:     map[string]*secretFetch{},
+		subscribers: map[string]map[int]SecretChangeHandler{},
+		now:         time.Now,
+	}
+}
@@ -0,0 +1,195 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingProvider wraps a MemoryProvider, counting fetches and failing while err is set.
+type countingProvider struct {
+	*MemoryProvider
+	mu      sync.Mutex
+	fetches int
+	err     error
+	release chan struct{}
+}
+
+func (provider *countingProvider) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	if provider.release != nil {
+		<-provider.release
+	}
+	provider.mu.Lock()
+	provider.fetches++
+	err := provider.err
+	provider.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return provider.MemoryProvider.GetSecret(ctx, secretName)
+}
+
+func (provider *countingProvider) fetched() int {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	return provider.fetches
+}
+
+func makeTestCache(ttl time.Duration) (*SecretCache, *countingProvider, *time.Time) {
+	provider := &countingProvider{MemoryProvider: MakeMemoryProvider(Secret{Name: "KEY", Version: "1", Value: MakeSecretValue("one")})}
+	cache := MakeSecretCache(provider, ttl)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	return cache, provider, &now
+}
+
+func TestSecretCacheTTL(t *testing.T) {
+	cache, provider, now := makeTestCache(time.Minute)
+	secret, err := cache.GetSecret(context.Background(), "KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "one", secret.Value.Reveal())
+
+	provider.Set(Secret{Name: "KEY", Version: "2", Value: MakeSecretValue("two")})
+	secret, _ = cache.GetSecret(context.Background(), "KEY")
+	assert.Equal(t, "one", secret.Value.Reveal(), "should serve the cached secret within the TTL")
+	assert.Equal(t, 1, provider.fetched())
+
+	*now = now.Add(time.Minute)
+	secret, _ = cache.GetSecret(context.Background(), "KEY")
+	assert.Equal(t, "two", secret.Value.Reveal(), "should fetch the secret again once expired")
+	assert.Equal(t, 2, provider.fetched())
+
+	_, err = cache.GetSecret(context.Background(), "MISSING")
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+}
+
+func TestSecretCacheWithoutTTL(t *testing.T) {
+	cache, provider, now := makeTestCache(0)
+	cache.GetSecret(context.Background(), "KEY")
+	*now = now.Add(24 * time.Hour)
+	cache.GetSecret(context.Background(), "KEY")
+	assert.Equal(t, 1, provider.fetched(), "should never expire secrets without a TTL")
+}
+
+func TestSecretCacheServesStaleOnError(t *testing.T) {
+	cache, provider, now := makeTestCache(time.Minute)
+	cache.GetSecret(context.Background(), "KEY")
+
+	provider.err = errors.New("unavailable")
+	*now = now.Add(time.Minute)
+	secret, err := cache.GetSecret(context.Background(), "KEY")
+	assert.Nil(t, err, "should not fail while an expired secret is cached")
+	assert.Equal(t, "one", secret.Value.Reveal())
+
+	_, err = cache.GetSecret(context.Background(), "OTHER")
+	assert.Equal(t, provider.err, err, "should fail for secrets that were never fetched")
+
+	assert.NotNil(t, cache.Refresh(context.Background()))
+	secret, _ = cache.GetSecret(context.Background(), "KEY")
+	assert.Equal(t, "one", secret.Value.Reveal(), "should keep secrets that fail to refresh")
+}
+
+func TestSecretCacheSharesFetches(t *testing.T) {
+	cache, provider, _ := makeTestCache(time.Minute)
+	provider.release = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			secret, err := cache.GetSecret(context.Background(), "KEY")
+			assert.Nil(t, err)
+			assert.Equal(t, "one", secret.Value.Reveal())
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(provider.release)
+	wg.Wait()
+	assert.Equal(t, 1, provider.fetched(), "should fetch a secret once for concurrent callers")
+}
+
+func TestSecretCacheCopiesSharedFetches(t *testing.T) {
+	cache, provider, _ := makeTestCache(time.Minute)
+	provider.release = make(chan struct{})
+	secrets := make(chan *Secret, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			secret, _ := cache.GetSecret(context.Background(), "KEY")
+			secrets <- secret
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(provider.release)
+	first, second := <-secrets, <-secrets
+	first.Zero()
+	assert.Equal(t, "one", second.Value.Reveal(), "should return a copy of a shared fetch to every caller")
+}
+
+func TestSecretCacheDetachesSharedFetches(t *testing.T) {
+	cache, provider, _ := makeTestCache(time.Minute)
+	provider.release = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := cache.GetSecret(ctx, "KEY")
+		leader <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	waiter := make(chan *Secret, 1)
+	go func() {
+		secret, err := cache.GetSecret(context.Background(), "KEY")
+		assert.Nil(t, err)
+		waiter <- secret
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-leader, "should stop waiting when the context of the caller is done")
+	close(provider.release)
+	assert.Equal(t, "one", (<-waiter).Value.Reveal(), "should not fail other callers when the first caller gives up")
+	assert.Equal(t, 1, provider.fetched())
+}
+
+func TestSecretCacheSubscribe(t *testing.T) {
+	cache, provider, _ := makeTestCache(time.Minute)
+	var changes []string
+	unsubscribe := cache.Subscribe("KEY", func(previous *Secret, current *Secret) {
+		changes = append(changes, previous.Value.Reveal()+"->"+current.Value.Reveal())
+	})
+	cache.GetSecret(context.Background(), "KEY")
+	assert.Empty(t, changes, "should not notify on the first fetch")
+
+	provider.Set(Secret{Name: "KEY", Version: "1", Value: MakeSecretValue("one")})
+	cache.Refresh(context.Background())
+	assert.Empty(t, changes, "should not notify when the version is unchanged")
+
+	provider.Set(Secret{Name: "KEY", Version: "2", Value: MakeSecretValue("two")})
+	assert.Nil(t, cache.Refresh(context.Background()))
+	assert.Equal(t, []string{"one->two"}, changes)
+
+	unsubscribe()
+	provider.Set(Secret{Name: "KEY", Version: "3", Value: MakeSecretValue("three")})
+	cache.Refresh(context.Background())
+	assert.Equal(t, []string{"one->two"}, changes, "should not notify after unsubscribing")
+}
+
+func TestSecretCacheWatch(t *testing.T) {
+	cache, provider, _ := makeTestCache(time.Hour)
+	cache.GetSecret(context.Background(), "KEY")
+	changed := make(chan *Secret, 1)
+	cache.Subscribe("KEY", func(previous *Secret, current *Secret) { changed <- current })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider.Set(Secret{Name: "KEY", Version: "2", Value: MakeSecretValue("two")})
+	cache.Watch(ctx, time.Millisecond, nil)
+	select {
+	case secret := <-changed:
+		assert.Equal(t, "two", secret.Value.Reveal())
+	case <-time.After(time.Second):
+		t.Fatal("should refresh secrets in the background")
+	}
+	cache.Watch(ctx, 0, nil)
+}
@@ -0,0 +1,356 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+var ErrSecretNotFound = errors.New("secret does not exist")
+
+// SecretProvider is a source of secrets. GetSecret returns an error wrapping ErrSecretNotFound
+// when the source does not hold the secret.
+type SecretProvider interface {
+	GetSecret(ctx context.Context, secretName string) (*Secret, error)
+}
+
+func secretNotFound(secretName string) error {
+	return fmt.Errorf("%w: %#v", ErrSecretNotFound, secretName)
+}
+
+// FileProvider reads secrets from the JSON files in a directory, such as the one mounted by
+// kubernetes. The directory is read on every call.
+type FileProvider struct {
+	Dir string
+}
+
+func (provider *FileProvider) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	secrets, err := readSecretsDir(provider.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if secret, ok := (*secrets)[secretName]; ok {
+		return secret, nil
+	}
+	return nil, secretNotFound(secretName)
+}
+
+// MakeFileProvider creates a provider for the secrets in dir, or in SecretsDir when dir is empty.
+func MakeFileProvider(dir string) *FileProvider {
+	if dir == "" {
+		dir = SecretsDir
+	}
+	return &FileProvider{Dir: dir}
+}
+
+const (
+	VersionStageCurrent  = "AWSCURRENT"
+	VersionStagePrevious = "AWSPREVIOUS"
+	VersionStagePending  = "AWSPENDING"
+
+	// DefaultBatchConcurrency is the number of secrets FetchAll fetches at a time.
+	DefaultBatchConcurrency = 8
+)
+
+var ErrSecretKeyNotFound = errors.New("secret has no such key")
+
+// AWSSecretRequest selects a version of a secret in AWS secret manager. The version is chosen
+// by VersionID, if set, or else by VersionStage, which defaults to AWSCURRENT.
+//
+// By default the secret is parsed as a Secret. If Key is set, the secret is parsed as any JSON
+// object instead and Value is the value of Key, encoded as JSON unless it is a string. If Raw
+// is set, Value is the whole secret string. In both cases Version is the AWS version id.
+type AWSSecretRequest struct {
+	Name         string
+	VersionStage string
+	VersionID    string
+	Key          string
+	Raw          bool
+}
+
+// AWSProvider fetches secrets from AWS secret manager.
+type AWSProvider struct {
+	Client secretsmanageriface.SecretsManagerAPI
+	// Concurrency is the number of secrets FetchAll fetches at a time, DefaultBatchConcurrency if not positive.
+	Concurrency int
+}
+
+// GetSecret fetches the current version of the secret.
+func (provider *AWSProvider) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	return provider.Fetch(ctx, AWSSecretRequest{Name: secretName})
+}
+
+// Fetch fetches the version of the secret selected by request.
+func (provider *AWSProvider) Fetch(ctx context.Context, request AWSSecretRequest) (*Secret, error) {
+	input := &secretsmanager.GetSecretValueInput{SecretId: aws.String(request.Name)}
+	if request.VersionID != "" {
+		input.VersionId = aws.String(request.VersionID)
+	}
+	if request.VersionStage != "" || request.VersionID == "" {
+		stage := request.VersionStage
+		if stage == "" {
+			stage = VersionStageCurrent
+		}
+		input.VersionStage = aws.String(stage)
+	}
+	result, err := provider.Client.GetSecretValueWithContext(ctx, input)
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return nil, secretNotFound(request.Name)
+		}
+		return nil, err
+	}
+	if request.Key == "" && !request.Raw {
+		return parseSecretValue(result)
+	}
+	secretString, err := secretValueString(result)
+	if err != nil {
+		return nil, err
+	}
+	secret := &Secret{Name: request.Name, Value: MakeSecretValue(secretString)}
+	if result.VersionId != nil {
+		secret.Version = *result.VersionId
+	}
+	if request.Key != "" {
+		value, err := extractSecretKey(secretString, request.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %#v in secret %#v", err, request.Key, request.Name)
+		}
+		secret.Value = MakeSecretValue(value)
+	}
+	return secret, nil
+}
+
+func extractSecretKey(secretString string, key string) (string, error) {
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(secretString), &values); err != nil {
+		return "", err
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", ErrSecretKeyNotFound
+	}
+	var str string
+	if err := json.Unmarshal(value, &str); err == nil {
+		return str, nil
+	}
+	return string(value), nil
+}
+
+// BatchError reports the secrets FetchAll could not fetch, by their index in the requests.
+type BatchError struct {
+	Errors map[int]error
+}
+
+func (err *BatchError) Error() string {
+	indexes := make([]int, 0, len(err.Errors))
+	for index := range err.Errors {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	failures := make([]string, len(indexes))
+	for i, index := range indexes {
+		failures[i] = fmt.Sprintf("%d: %s", index, err.Errors[index].Error())
+	}
+	return fmt.Sprintf("error fetching %d secrets: %s", len(indexes), strings.Join(failures, "; "))
+}
+
+// FetchAll fetches the secrets of requests concurrently and returns them in the order of the
+// requests. If some secrets can not be fetched, the others are returned with nil in place of
+// the failed ones, along with a *BatchError.
+func (provider *AWSProvider) FetchAll(ctx context.Context, requests []AWSSecretRequest) ([]*Secret, error) {
+	concurrency := provider.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	secrets := make([]*Secret, len(requests))
+	errs := make([]error, len(requests))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, request AWSSecretRequest) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			secrets[i], errs[i] = provider.Fetch(ctx, request)
+		}(i, request)
+	}
+	wg.Wait()
+	batchError := &BatchError{Errors: map[int]error{}}
+	for i, err := range errs {
+		if err != nil {
+			batchError.Errors[i] = err
+		}
+	}
+	if len(batchError.Errors) > 0 {
+		return secrets, batchError
+	}
+	return secrets, nil
+}
+
+// FetchCurrentAndPrevious fetches the AWSCURRENT and AWSPREVIOUS versions of the secret, for
+// example to decrypt with both keys during a rotation. previous is nil if the secret has not
+// been rotated yet.
+func (provider *AWSProvider) FetchCurrentAndPrevious(ctx context.Context, secretName string) (current *Secret, previous *Secret, err error) {
+	secrets, err := provider.FetchAll(ctx, []AWSSecretRequest{
+		{Name: secretName, VersionStage: VersionStageCurrent},
+		{Name: secretName, VersionStage: VersionStagePrevious},
+	})
+	var batchError *BatchError
+	if errors.As(err, &batchError) {
+		if err, ok := batchError.Errors[0]; ok {
+			return nil, nil, err
+		}
+		if err := batchError.Errors[1]; !errors.Is(err, ErrSecretNotFound) {
+			return nil, nil, err
+		}
+	}
+	return secrets[0], secrets[1], nil
+}
+
+// MakeAWSProvider creates a provider fetching secrets with client.
+func MakeAWSProvider(client secretsmanageriface.SecretsManagerAPI) *AWSProvider {
+	return &AWSProvider{Client: client}
+}
+
+// MakeDefaultAWSProvider creates a provider for the secret manager of the AWS region the service runs in.
+func MakeDefaultAWSProvider() (*AWSProvider, error) {
+	sess, err := session.NewSession(&aws.Config{
+		MaxRetries: aws.Int(3),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return MakeAWSProvider(secretsmanager.New(sess, secretsManagerConfig())), nil
+}
+
+// EnvProvider reads secrets from environment variables. The variable of a secret is Prefix
+// followed by the secret name upper-cased, with characters other than letters and digits
+// replaced by underscores: with Prefix "SECRET_", "service.ENCRYPTION_KEY" is read from
+// SECRET_SERVICE_ENCRYPTION_KEY. The version, if any, is read from the same variable suffixed
+// with _VERSION.
+type EnvProvider struct {
+	Prefix string
+}
+
+// VariableName returns the environment variable holding secretName.
+func (provider *EnvProvider) VariableName(secretName string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(secretName))
+	return provider.Prefix + name
+}
+
+func (provider *EnvProvider) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	variable := provider.VariableName(secretName)
+	value, ok := os.LookupEnv(variable)
+	if !ok {
+		return nil, secretNotFound(secretName)
+	}
+	secret := &Secret{Name: secretName, Value: MakeSecretValue(value)}
+	if version, ok := os.LookupEnv(variable + "_VERSION"); ok {
+		secret.Version = version
+	}
+	return secret, nil
+}
+
+// MakeEnvProvider creates a provider reading secrets from variables starting with prefix.
+func MakeEnvProvider(prefix string) *EnvProvider {
+	return &EnvProvider{Prefix: prefix}
+}
+
+// MemoryProvider holds secrets in memory, for tests and local runs.
+type MemoryProvider struct {
+	mutex   sync.RWMutex
+	secrets map[string]Secret
+}
+
+func (provider *MemoryProvider) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	secret, ok := provider.secrets[secretName]
+	if !ok {
+		return nil, secretNotFound(secretName)
+	}
+	return copySecret(&secret), nil
+}
+
+// Set adds the secret, replacing the secret of the same name.
+func (provider *MemoryProvider) Set(secret Secret) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.secrets[secret.Name] = *copySecret(&secret)
+}
+
+func (provider *MemoryProvider) Delete(secretName string) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	delete(provider.secrets, secretName)
+}
+
+// MakeMemoryProvider creates a provider holding secrets.
+func MakeMemoryProvider(secrets ...Secret) *MemoryProvider {
+	provider := &MemoryProvider{secrets: map[string]Secret{}}
+	for _, secret := range secrets {
+		provider.Set(secret)
+	}
+	return provider
+}
+
+// ChainProvider tries its providers in order and returns the secret of the first one holding
+// it. It stops at the first provider that fails with an error other than ErrSecretNotFound, so
+// a secret is never served by a later provider because an earlier one was unavailable.
+type ChainProvider struct {
+	Providers []SecretProvider
+	// SkipFailures lets providers that fail be skipped. If no provider holds the secret, their
+	// errors are returned, or ErrSecretNotFound if none failed.
+	SkipFailures bool
+}
+
+func (provider *ChainProvider) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	var failures []string
+	for _, source := range provider.Providers {
+		secret, err := source.GetSecret(ctx, secretName)
+		if err == nil {
+			return secret, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if errors.Is(err, ErrSecretNotFound) {
+			continue
+		}
+		if !provider.SkipFailures {
+			return nil, fmt.Errorf("error fetching secret %#v: %w", secretName, err)
+		}
+		failures = append(failures, err.Error())
+	}
+	if len(failures) > 0 {
+		return nil, fmt.Errorf("error fetching secret %#v: %s", secretName, strings.Join(failures, "; "))
+	}
+	return nil, secretNotFound(secretName)
+}
+
+// MakeChainProvider creates a provider trying providers in order.
+func MakeChainProvider(providers ...SecretProvider) *ChainProvider {
+	return &ChainProvider{Providers: providers}
+}
@@ -0,0 +1,263 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSecretVersion struct {
+	id     string
+	stages []string
+	value  string
+}
+
+// mockSecretsManager holds the AWSCURRENT value of secrets in secrets, and any other versions in versions.
+type mockSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets  map[string]string
+	versions map[string][]mockSecretVersion
+	err      error
+}
+
+func (m *mockSecretsManager) lookup(input *secretsmanager.GetSecretValueInput) (mockSecretVersion, bool) {
+	stage := aws.StringValue(input.VersionStage)
+	if value, ok := m.secrets[*input.SecretId]; ok && input.VersionId == nil && stage == VersionStageCurrent {
+		return mockSecretVersion{id: "current", stages: []string{VersionStageCurrent}, value: value}, true
+	}
+	for _, version := range m.versions[*input.SecretId] {
+		if input.VersionId != nil && *input.VersionId != version.id {
+			continue
+		}
+		for _, versionStage := range version.stages {
+			if stage == "" || stage == versionStage {
+				return version, true
+			}
+		}
+	}
+	return mockSecretVersion{}, false
+}
+
+func (m *mockSecretsManager) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	version, ok := m.lookup(input)
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "not found", nil)
+	}
+	return &secretsmanager.GetSecretValueOutput{Name: input.SecretId, VersionId: aws.String(version.id), SecretString: aws.String(version.value)}, nil
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte(`{"version": 3, "name": "FILE_KEY", "value": "file-value"}`)
+	if err := ioutil.WriteFile(path.Join(dir, "file.json"), data, 0600); err != nil {
+		panic(err)
+	}
+	provider := MakeFileProvider(dir)
+	secret, err := provider.GetSecret(context.Background(), "FILE_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "file-value", secret.Value.Reveal())
+
+	_, err = provider.GetSecret(context.Background(), "MISSING_KEY")
+	assert.True(t, errors.Is(err, ErrSecretNotFound), "should return ErrSecretNotFound for a missing secret")
+
+	_, err = MakeFileProvider(path.Join(dir, "missing")).GetSecret(context.Background(), "FILE_KEY")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrSecretNotFound), "should fail when the directory is not mounted")
+
+	ioutil.WriteFile(path.Join(dir, "broken.json"), []byte(`{`), 0600)
+	secret, err = provider.GetSecret(context.Background(), "FILE_KEY")
+	assert.Nil(t, err, "should return the secrets of the files that parse")
+	assert.Equal(t, "file-value", secret.Value.Reveal())
+	_, err = provider.GetSecret(context.Background(), "MISSING_KEY")
+	assert.True(t, errors.Is(err, ErrSecretNotFound), "should skip the files that fail to parse")
+}
+
+func TestAWSProvider(t *testing.T) {
+	client := &mockSecretsManager{secrets: map[string]string{
+		"service.ENCRYPTION_KEY": `{"version": "2", "name": "service.ENCRYPTION_KEY", "value": "aws-value"}`,
+	}}
+	provider := MakeAWSProvider(client)
+	secret, err := provider.GetSecret(context.Background(), "service.ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "aws-value", secret.Value.Reveal())
+	assert.Equal(t, "2", secret.Version)
+
+	_, err = provider.GetSecret(context.Background(), "other.ENCRYPTION_KEY")
+	assert.True(t, errors.Is(err, ErrSecretNotFound), "should map ResourceNotFoundException to ErrSecretNotFound")
+
+	client.err = errors.New("throttled")
+	_, err = provider.GetSecret(context.Background(), "service.ENCRYPTION_KEY")
+	assert.Equal(t, client.err, err)
+}
+
+func TestEnvProvider(t *testing.T) {
+	provider := MakeEnvProvider("SECRET_")
+	assert.Equal(t, "SECRET_SERVICE_ENCRYPTION_KEY", provider.VariableName("service.ENCRYPTION_KEY"))
+
+	t.Setenv("SECRET_SERVICE_ENCRYPTION_KEY", "env-value")
+	secret, err := provider.GetSecret(context.Background(), "service.ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "env-value", secret.Value.Reveal())
+	assert.Equal(t, "service.ENCRYPTION_KEY", secret.Name)
+	assert.Nil(t, secret.Version, "should have no version unless one is set")
+
+	t.Setenv("SECRET_SERVICE_ENCRYPTION_KEY_VERSION", "7")
+	secret, err = provider.GetSecret(context.Background(), "service.ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "7", secret.Version)
+
+	_, err = provider.GetSecret(context.Background(), "other.ENCRYPTION_KEY")
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+}
+
+func TestMemoryProvider(t *testing.T) {
+	provider := MakeMemoryProvider(Secret{Name: "KEY", Value: MakeSecretValue("one")})
+	secret, err := provider.GetSecret(context.Background(), "KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "one", secret.Value.Reveal())
+
+	secret.Zero()
+	secret, _ = provider.GetSecret(context.Background(), "KEY")
+	assert.Equal(t, "one", secret.Value.Reveal(), "should not be zeroed through a returned secret")
+
+	provider.Set(Secret{Name: "KEY", Value: MakeSecretValue("two")})
+	secret, _ = provider.GetSecret(context.Background(), "KEY")
+	assert.Equal(t, "two", secret.Value.Reveal())
+
+	provider.Delete("KEY")
+	_, err = provider.GetSecret(context.Background(), "KEY")
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+}
+
+func TestChainProvider(t *testing.T) {
+	first := MakeMemoryProvider(Secret{Name: "SHARED", Value: MakeSecretValue("first")})
+	second := MakeMemoryProvider(Secret{Name: "SHARED", Value: MakeSecretValue("second")}, Secret{Name: "FALLBACK", Value: MakeSecretValue("second")})
+	chain := MakeChainProvider(first, second)
+
+	secret, err := chain.GetSecret(context.Background(), "SHARED")
+	assert.Nil(t, err)
+	assert.Equal(t, "first", secret.Value.Reveal(), "should prefer the first provider")
+
+	secret, err = chain.GetSecret(context.Background(), "FALLBACK")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", secret.Value.Reveal(), "should fall back to later providers")
+
+	_, err = chain.GetSecret(context.Background(), "MISSING")
+	assert.True(t, errors.Is(err, ErrSecretNotFound), "should return ErrSecretNotFound when no provider holds the secret")
+
+	failing := MakeAWSProvider(&mockSecretsManager{err: errors.New("throttled")})
+	_, err = MakeChainProvider(failing, second).GetSecret(context.Background(), "FALLBACK")
+	assert.NotNil(t, err, "should stop at a failing provider")
+	assert.False(t, errors.Is(err, ErrSecretNotFound))
+	assert.Contains(t, err.Error(), "throttled")
+
+	skipping := MakeChainProvider(failing, second)
+	skipping.SkipFailures = true
+	secret, err = skipping.GetSecret(context.Background(), "FALLBACK")
+	assert.Nil(t, err, "should skip failing providers when asked to")
+	assert.Equal(t, "second", secret.Value.Reveal())
+
+	_, err = skipping.GetSecret(context.Background(), "MISSING")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrSecretNotFound), "should report failures when the secret was not found")
+	assert.Contains(t, err.Error(), "throttled")
+}
+
+func makeVersionedProvider() *AWSProvider {
+	return MakeAWSProvider(&mockSecretsManager{versions: map[string][]mockSecretVersion{
+		"service.ENCRYPTION_KEY": {
+			{id: "v3", stages: []string{VersionStagePending}, value: `{"version": 3, "name": "service.ENCRYPTION_KEY", "value": "pending"}`},
+			{id: "v2", stages: []string{VersionStageCurrent}, value: `{"version": 2, "name": "service.ENCRYPTION_KEY", "value": "current"}`},
+			{id: "v1", stages: []string{VersionStagePrevious}, value: `{"version": 1, "name": "service.ENCRYPTION_KEY", "value": "previous"}`},
+		},
+		"service.DATABASE": {
+			{id: "d1", stages: []string{VersionStageCurrent}, value: `{"username": "app", "password": "hunter2", "port": 5432}`},
+		},
+		"new.ENCRYPTION_KEY": {
+			{id: "n1", stages: []string{VersionStageCurrent}, value: `{"version": 1, "name": "new.ENCRYPTION_KEY", "value": "only"}`},
+		},
+	}})
+}
+
+func TestAWSProviderVersions(t *testing.T) {
+	provider := makeVersionedProvider()
+	for stage, expected := range map[string]string{"": "current", VersionStageCurrent: "current", VersionStagePrevious: "previous", VersionStagePending: "pending"} {
+		secret, err := provider.Fetch(context.Background(), AWSSecretRequest{Name: "service.ENCRYPTION_KEY", VersionStage: stage})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, secret.Value.Reveal(), "should fetch the version of stage %q", stage)
+	}
+
+	secret, err := provider.Fetch(context.Background(), AWSSecretRequest{Name: "service.ENCRYPTION_KEY", VersionID: "v1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "previous", secret.Value.Reveal(), "should fetch a version by id")
+
+	_, err = provider.Fetch(context.Background(), AWSSecretRequest{Name: "service.ENCRYPTION_KEY", VersionID: "v1", VersionStage: VersionStageCurrent})
+	assert.True(t, errors.Is(err, ErrSecretNotFound), "should require the version id to have the stage")
+}
+
+func TestAWSProviderKeys(t *testing.T) {
+	provider := makeVersionedProvider()
+	secret, err := provider.Fetch(context.Background(), AWSSecretRequest{Name: "service.DATABASE", Key: "password"})
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", secret.Value.Reveal())
+	assert.Equal(t, "service.DATABASE", secret.Name)
+	assert.Equal(t, "d1", secret.Version, "should use the AWS version id")
+
+	secret, err = provider.Fetch(context.Background(), AWSSecretRequest{Name: "service.DATABASE", Key: "port"})
+	assert.Nil(t, err)
+	assert.Equal(t, "5432", secret.Value.Reveal(), "should encode non-string values as JSON")
+
+	_, err = provider.Fetch(context.Background(), AWSSecretRequest{Name: "service.DATABASE", Key: "host"})
+	assert.True(t, errors.Is(err, ErrSecretKeyNotFound))
+
+	secret, err = provider.Fetch(context.Background(), AWSSecretRequest{Name: "service.DATABASE", Raw: true})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"username": "app", "password": "hunter2", "port": 5432}`, secret.Value.Reveal())
+
+	_, err = provider.GetSecret(context.Background(), "service.DATABASE")
+	assert.Nil(t, err, "should parse any JSON object as a Secret")
+}
+
+func TestAWSProviderFetchAll(t *testing.T) {
+	provider := makeVersionedProvider()
+	provider.Concurrency = 2
+	secrets, err := provider.FetchAll(context.Background(), []AWSSecretRequest{
+		{Name: "service.ENCRYPTION_KEY"},
+		{Name: "missing.ENCRYPTION_KEY"},
+		{Name: "service.DATABASE", Key: "username"},
+		{Name: "service.ENCRYPTION_KEY", VersionStage: VersionStagePrevious},
+	})
+	var batchError *BatchError
+	assert.True(t, errors.As(err, &batchError))
+	assert.Equal(t, 1, len(batchError.Errors))
+	assert.True(t, errors.Is(batchError.Errors[1], ErrSecretNotFound))
+	assert.Equal(t, "current", secrets[0].Value.Reveal())
+	assert.Nil(t, secrets[1])
+	assert.Equal(t, "app", secrets[2].Value.Reveal())
+	assert.Equal(t, "previous", secrets[3].Value.Reveal())
+
+	current, previous, err := provider.FetchCurrentAndPrevious(context.Background(), "service.ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "current", current.Value.Reveal())
+	assert.Equal(t, "previous", previous.Value.Reveal())
+
+	current, previous, err = provider.FetchCurrentAndPrevious(context.Background(), "new.ENCRYPTION_KEY")
+	assert.Nil(t, err, "should not fail before the first rotation")
+	assert.Equal(t, "only", current.Value.Reveal())
+	assert.Nil(t, previous)
+
+	_, _, err = provider.FetchCurrentAndPrevious(context.Background(), "missing.ENCRYPTION_KEY")
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+}
@@ -0,0 +1,253 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const (
+	SourceAWS  = "aws"
+	SourceFile = "file"
+	SourceEnv  = "env"
+
+	referencePrefix = "secret://"
+)
+
+var (
+	ErrInvalidSecretReference = errors.New("invalid secret reference")
+	ErrUnknownSecretSource    = errors.New("unknown secret source")
+	ErrNotPointer             = errors.New("value to resolve must be a non-nil pointer")
+)
+
+var inlineReference = regexp.MustCompile(`\$\{secret:([^}]*)\}`)
+
+// KeyedSecretProvider is a SecretProvider that can extract a key of a JSON secret itself, such
+// as AWSProvider. The keys of secrets of other providers are extracted from their Value.
+type KeyedSecretProvider interface {
+	SecretProvider
+	GetSecretKey(ctx context.Context, secretName string, key string) (*Secret, error)
+}
+
+// GetSecretKey fetches the current version of a JSON secret and returns the value of key.
+func (provider *AWSProvider) GetSecretKey(ctx context.Context, secretName string, key string) (*Secret, error) {
+	return provider.Fetch(ctx, AWSSecretRequest{Name: secretName, Key: key})
+}
+
+type secretReference struct {
+	source string
+	name   string
+	key    string
+}
+
+// Resolver expands secret references in configuration values with the secrets of its
+// providers, keyed by source name. A value of the form
+//
+//	secret://aws/prod/db#password
+//
+// is replaced by the secret, or the key of a JSON secret after #, of its source. References of
+// the form ${secret:name#key} are replaced wherever they occur in a value, using the default
+// source; ${secret://file/name} names the source explicitly.
+type Resolver struct {
+	Providers map[string]SecretProvider
+	// Default is the source of references that do not name one.
+	Default string
+}
+
+func parseReference(reference string, defaultSource string) (*secretReference, error) {
+	parsed := &secretReference{source: defaultSource}
+	rest := reference
+	if strings.HasPrefix(reference, referencePrefix) {
+		rest = strings.TrimPrefix(reference, referencePrefix)
+		separator := strings.Index(rest, "/")
+		if separator <= 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidSecretReference, reference)
+		}
+		parsed.source, rest = rest[:separator], rest[separator+1:]
+	}
+	if separator := strings.LastIndex(rest, "#"); separator >= 0 {
+		rest, parsed.key = rest[:separator], rest[separator+1:]
+		if parsed.key == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidSecretReference, reference)
+		}
+	}
+	parsed.name = rest
+	if parsed.name == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSecretReference, reference)
+	}
+	return parsed, nil
+}
+
+func (resolver *Resolver) resolveReference(ctx context.Context, reference *secretReference) (string, error) {
+	provider, ok := resolver.Providers[reference.source]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownSecretSource, reference.source)
+	}
+	if reference.key == "" {
+		secret, err := provider.GetSecret(ctx, reference.name)
+		if err != nil {
+			return "", err
+		}
+		return secret.Value.Reveal(), nil
+	}
+	if keyed, ok := provider.(KeyedSecretProvider); ok {
+		secret, err := keyed.GetSecretKey(ctx, reference.name, reference.key)
+		if err != nil {
+			return "", err
+		}
+		return secret.Value.Reveal(), nil
+	}
+	secret, err := provider.GetSecret(ctx, reference.name)
+	if err != nil {
+		return "", err
+	}
+	value, err := extractSecretKey(secret.Value.Reveal(), reference.key)
+	if err != nil {
+		return "", fmt.Errorf("%w: %#v in secret %#v", err, reference.key, reference.name)
+	}
+	return value, nil
+}
+
+// ResolveString expands the secret references in value. Values without references are
+// returned unchanged.
+func (resolver *Resolver) ResolveString(ctx context.Context, value string) (string, error) {
+	if strings.HasPrefix(value, referencePrefix) {
+		reference, err := parseReference(value, resolver.Default)
+		if err != nil {
+			return "", err
+		}
+		return resolver.resolveReference(ctx, reference)
+	}
+	var resolveErr error
+	resolved := inlineReference.ReplaceAllStringFunc(value, func(match string) string {
+		if resolveErr != nil {
+			return match
+		}
+		inline := inlineReference.FindStringSubmatch(match)[1]
+		if strings.HasPrefix(inline, "//") {
+			// ${secret://aws/name} names its source like a whole value reference.
+			inline = "secret:" + inline
+		}
+		reference, err := parseReference(inline, resolver.Default)
+		if err != nil {
+			resolveErr = err
+			return match
+		}
+		secret, err := resolver.resolveReference(ctx, reference)
+		if err != nil {
+			resolveErr = err
+			return match
+		}
+		return secret
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	return resolved, nil
+}
+
+// Getenv returns the environment variable named key with its secret references expanded.
+func (resolver *Resolver) Getenv(ctx context.Context, key string) (string, error) {
+	return resolver.ResolveString(ctx, os.Getenv(key))
+}
+
+// Resolve expands the secret references in the strings of the struct, map or slice v points to,
+// in place. Exported struct fields, map values, slice elements and pointers are followed.
+func (resolver *Resolver) Resolve(ctx context.Context, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return ErrNotPointer
+	}
+	return resolver.resolveValue(ctx, value.Elem(), "")
+}
+
+func (resolver *Resolver) resolveValue(ctx context.Context, value reflect.Value, path string) error {
+	switch value.Kind() {
+	case reflect.String:
+		resolved, err := resolver.ResolveString(ctx, value.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if value.CanSet() {
+			value.SetString(resolved)
+		}
+	case reflect.Ptr:
+		if !value.IsNil() {
+			return resolver.resolveValue(ctx, value.Elem(), path)
+		}
+	case reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		elem := value.Elem()
+		if elem.Kind() == reflect.String && value.CanSet() {
+			resolved, err := resolver.ResolveString(ctx, elem.String())
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			value.Set(reflect.ValueOf(resolved).Convert(elem.Type()))
+			return nil
+		}
+		return resolver.resolveValue(ctx, elem, path)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			if err := resolver.resolveValue(ctx, value.Field(i), joinPath(path, field.Name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := resolver.resolveValue(ctx, value.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			// Map values are not addressable, so they are resolved in a copy and stored back.
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			if err := resolver.resolveValue(ctx, elem, joinPath(path, fmt.Sprint(iter.Key().Interface()))); err != nil {
+				return err
+			}
+			value.SetMapIndex(iter.Key(), elem)
+		}
+	}
+	return nil
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// MakeResolver creates a resolver for the secrets of providers, keyed by source name, taking
+// references without a source from defaultSource.
+func MakeResolver(providers map[string]SecretProvider, defaultSource string) *Resolver {
+	return &Resolver{Providers: providers, Default: defaultSource}
+}
+
+// MakeDefaultResolver creates a resolver for the secrets directory (file), AWS secret manager
+// (aws) and environment variables (env), taking references without a source from the secrets
+// directory.
+func MakeDefaultResolver() (*Resolver, error) {
+	aws, err := MakeDefaultAWSProvider()
+	if err != nil {
+		return nil, err
+	}
+	return MakeResolver(map[string]SecretProvider{
+		SourceAWS:  aws,
+		SourceFile: MakeFileProvider(""),
+		SourceEnv:  MakeEnvProvider(""),
+	}, SourceFile), nil
+}
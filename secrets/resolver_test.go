@@ -0,0 +1,106 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestResolver() *Resolver {
+	aws := makeVersionedProvider()
+	file := MakeMemoryProvider(
+		Secret{Name: "ENCRYPTION_KEY", Value: MakeSecretValue("file-key")},
+		Secret{Name: "CREDENTIALS", Value: MakeSecretValue(`{"user": "app", "password": "s3cret"}`)},
+	)
+	return MakeResolver(map[string]SecretProvider{SourceAWS: aws, SourceFile: file}, SourceFile)
+}
+
+func TestResolveString(t *testing.T) {
+	resolver := makeTestResolver()
+	cases := map[string]string{
+		"plain value":                            "plain value",
+		"secret://file/ENCRYPTION_KEY":           "file-key",
+		"secret://file/CREDENTIALS#user":         "app",
+		"secret://aws/service.DATABASE#password": "hunter2",
+		"secret://aws/service.ENCRYPTION_KEY":    "current",
+		"${secret:ENCRYPTION_KEY}":               "file-key",
+		"postgres://${secret:CREDENTIALS#user}:${secret:CREDENTIALS#password}@db:5432": "postgres://app:s3cret@db:5432",
+		"key=${secret://aws/service.DATABASE#username}":                                "key=app",
+	}
+	for value, expected := range cases {
+		resolved, err := resolver.ResolveString(context.Background(), value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, resolved, "should resolve %q", value)
+	}
+}
+
+func TestResolveStringErrors(t *testing.T) {
+	resolver := makeTestResolver()
+	_, err := resolver.ResolveString(context.Background(), "secret://vault/ENCRYPTION_KEY")
+	assert.True(t, errors.Is(err, ErrUnknownSecretSource))
+
+	for _, value := range []string{"secret://file", "secret:///ENCRYPTION_KEY", "secret://file/", "${secret:ENCRYPTION_KEY#}", "${secret:}"} {
+		_, err = resolver.ResolveString(context.Background(), value)
+		assert.True(t, errors.Is(err, ErrInvalidSecretReference), "should reject %q", value)
+	}
+
+	_, err = resolver.ResolveString(context.Background(), "${secret:MISSING}")
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+
+	_, err = resolver.ResolveString(context.Background(), "secret://file/CREDENTIALS#host")
+	assert.True(t, errors.Is(err, ErrSecretKeyNotFound))
+	assert.NotContains(t, err.Error(), "s3cret", "should not leak the secret in errors")
+}
+
+type databaseConfig struct {
+	Host     string
+	Password string
+	Options  map[string]string
+}
+
+type serviceConfig struct {
+	Name     string
+	Database *databaseConfig
+	Keys     []string
+	Extra    map[string]interface{}
+	internal string
+}
+
+func TestResolve(t *testing.T) {
+	resolver := makeTestResolver()
+	config := &serviceConfig{
+		Name: "service",
+		Database: &databaseConfig{
+			Host:     "db",
+			Password: "secret://aws/service.DATABASE#password",
+			Options:  map[string]string{"user": "${secret:CREDENTIALS#user}"},
+		},
+		Keys:     []string{"secret://file/ENCRYPTION_KEY", "secret://aws/service.ENCRYPTION_KEY"},
+		Extra:    map[string]interface{}{"token": "${secret:ENCRYPTION_KEY}", "nested": []interface{}{"secret://file/CREDENTIALS#password"}},
+		internal: "secret://file/ENCRYPTION_KEY",
+	}
+	assert.Nil(t, resolver.Resolve(context.Background(), config))
+	assert.Equal(t, "service", config.Name)
+	assert.Equal(t, "hunter2", config.Database.Password)
+	assert.Equal(t, "app", config.Database.Options["user"])
+	assert.Equal(t, []string{"file-key", "current"}, config.Keys)
+	assert.Equal(t, "file-key", config.Extra["token"])
+	assert.Equal(t, []interface{}{"s3cret"}, config.Extra["nested"])
+	assert.Equal(t, "secret://file/ENCRYPTION_KEY", config.internal, "should leave unexported fields alone")
+
+	config.Database.Host = "${secret:MISSING}"
+	err := resolver.Resolve(context.Background(), config)
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+	assert.Contains(t, err.Error(), "Database.Host", "should report the path of the failing value")
+
+	assert.Equal(t, ErrNotPointer, resolver.Resolve(context.Background(), *config))
+}
+
+func TestResolverGetenv(t *testing.T) {
+	t.Setenv("DATABASE_PASSWORD", "secret://aws/service.DATABASE#password")
+	password, err := makeTestResolver().Getenv(context.Background(), "DATABASE_PASSWORD")
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", password)
+}
@@ -1,6 +1,7 @@
 package secrets
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -8,6 +9,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/diptamay/go-commons/helpers"
 
@@ -20,57 +23,146 @@ var SecretsDir = "/run/secrets"
 var SecretsInitialized = false
 var Secrets *map[string]*Secret
 
+// SecretsManagerEndpoint, if set, replaces the AWS secrets manager endpoint, for example with
+// a secretstest server in integration tests.
+var SecretsManagerEndpoint = ""
+
 func init() {
 	secretDir := os.Getenv("SECRETS_DIRECTORY")
 	if secretDir != "" {
 		SecretsDir = secretDir
 	}
+	SecretsManagerEndpoint = os.Getenv("SECRETS_MANAGER_ENDPOINT")
+}
+
+func secretsManagerConfig() *aws.Config {
+	config := aws.NewConfig().WithRegion(helpers.GetAWSRegion())
+	if SecretsManagerEndpoint != "" {
+		config = config.WithEndpoint(SecretsManagerEndpoint)
+	}
+	return config
 }
 
 type Secret struct {
 	Version interface{} `json:"version"`
 	Name    string      `json:"name"`
-	Value   string      `json:"value"`
+	Value   SecretValue `json:"value"`
+}
+
+func fetchSecretFile(filename string) (*Secret, error) {
+	return readSecretFile(SecretsDir, filename)
 }
 
-func fetchSecretFile(filename string, fileChan chan *Secret) {
-	fp := filepath.Join(SecretsDir, filename)
+func readSecretFile(dir string, filename string) (*Secret, error) {
+	fp := filepath.Join(dir, filename)
 	filedata, err := ioutil.ReadFile(fp)
 	if err != nil {
-		fmt.Printf("error in ioutil.readFile: %#v", err.Error())
-		fileChan <- nil
-		return
+		return nil, err
 	}
 	secret := new(Secret)
-	err = json.Unmarshal(filedata, secret)
-	if err != nil {
-		fmt.Printf("error in ioutil.readFile: %#v", err.Error())
-		fileChan <- nil
-	} else {
-		fileChan <- secret
+	if err := json.Unmarshal(filedata, secret); err != nil {
+		return nil, err
 	}
+	return secret, nil
 }
 
-func FetchSecrets() (*map[string]*Secret, error) {
-	files, err := ioutil.ReadDir(SecretsDir)
+// readSecretFiles reads every secret file in dir, keyed by filename. Files that can not be read
+// or parsed are returned as FileErrors, while the secrets of the other files are still returned.
+func readSecretFiles(ctx context.Context, dir string) (map[string]*Secret, []*FileError, error) {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return nil, fmt.Errorf("Secrets directory is not mounted: %#v", err.Error())
+		return nil, nil, fmt.Errorf("Secrets directory is not mounted: %#v", err.Error())
 	}
-	filedatas := make(chan *Secret, len(files))
+	// Kubernetes mounts secrets as symlinks into a timestamped directory reached through ..data,
+	// which are skipped: the symlinks to the files are read instead.
+	names := []string{}
 	for _, file := range files {
-		go fetchSecretFile(file.Name(), filedatas)
+		if !strings.HasPrefix(file.Name(), "..") && !file.IsDir() {
+			names = append(names, file.Name())
+		}
 	}
-	Secrets = &map[string]*Secret{}
-	SecretsInitialized = true
-	for s := 0; s < len(files); s++ {
-		secret := <-filedatas
-		if secret != nil && secret.Name != "" {
-			(*Secrets)[secret.Name] = secret
+	type fileResult struct {
+		secret *Secret
+		err    error
+	}
+	results := make([]fileResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			secret, err := readSecretFile(dir, name)
+			results[i] = fileResult{secret, err}
+		}(i, name)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	secrets := map[string]*Secret{}
+	var fileErrors []*FileError
+	for i, result := range results {
+		switch {
+		case result.err != nil:
+			fileErrors = append(fileErrors, &FileError{Filename: names[i], Err: result.err})
+		case result.secret.Name == "":
+			fileErrors = append(fileErrors, &FileError{Filename: names[i], Err: ErrMissingSecretName})
+		default:
+			secrets[names[i]] = result.secret
 		}
 	}
+	return secrets, fileErrors, nil
+}
+
+// loadSecretsDir reads every secret file in dir, keyed by secret name, as readSecretFiles does.
+func loadSecretsDir(ctx context.Context, dir string) (map[string]*Secret, []*FileError, error) {
+	files, fileErrors, err := readSecretFiles(ctx, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	secrets := make(map[string]*Secret, len(files))
+	for _, secret := range files {
+		secrets[secret.Name] = secret
+	}
+	return secrets, fileErrors, nil
+}
+
+// readSecretsDir reads every secret file in dir. Files that can not be read or parsed are
+// skipped; Store and Watcher report them.
+func readSecretsDir(dir string) (*map[string]*Secret, error) {
+	secrets, _, err := loadSecretsDir(context.Background(), dir)
+	if err != nil {
+		return nil, err
+	}
+	return &secrets, nil
+}
+
+// FetchSecrets reads the secrets directory and caches its secrets for GetSecret. Files that
+// can not be read or parsed are skipped.
+func FetchSecrets() (*map[string]*Secret, error) {
+	secrets, err := readSecretsDir(SecretsDir)
+	if err != nil {
+		return nil, err
+	}
+	Secrets = secrets
+	SecretsInitialized = true
 	return Secrets, nil
 }
 
+// FetchSecret reads the secrets directory again and returns the current version of the secret,
+// without touching the secrets cached by GetSecret.
+func FetchSecret(secretName string) (*Secret, error) {
+	secrets, err := readSecretsDir(SecretsDir)
+	if err != nil {
+		return nil, err
+	}
+	if secret, ok := (*secrets)[secretName]; ok {
+		return secret, nil
+	}
+	return nil, fmt.Errorf("Secret for secretName %#v does not exist", secretName)
+}
+
 func GetSecret(secretName string) (*Secret, error) {
 	if !SecretsInitialized {
 		FetchSecrets()
@@ -89,22 +181,37 @@ For now, separate the 2 ways of get secrets now. Cz the env above appbuild hasn'
 TODO: When every env has k8s, remove the old above getSecret() and fetchSecret() APIs of from runtime mounted disk.
 */
 
-// this secretsMap is for the AWS secret manager version.
-var secretsMap = map[string]*Secret{}
+// awsSecrets caches the secrets of the AWS secret manager version, for the lifetime of the process.
+var awsSecrets = MakeSecretCache(SecretProviderFunc(func(ctx context.Context, secretName string) (*Secret, error) {
+	return fetchSecretsFromAWSSecretManager(secretName)
+}), 0)
 
 func GetSecretsFromAWSSecretManager(secretName string) (*Secret, error) {
 	//cache the secret, avoid duplicate call to AWS secret manager to get a same secret
-	if secret, ok := secretsMap[secretName]; ok {
-		return secret, nil
-	} else {
-		if secret, err := fetchSecretsFromAWSSecretManager(secretName); err != nil {
-			return nil, err
-		} else {
-			//cache
-			secretsMap[secretName] = secret
-			return secret, nil
-		}
+	return awsSecrets.GetSecret(context.Background(), secretName)
+}
+
+// FetchSecretFromAWSSecretManager fetches the current version of the secret from AWS secret manager,
+// bypassing the cache used by GetSecretsFromAWSSecretManager.
+func FetchSecretFromAWSSecretManager(secretName string) (*Secret, error) {
+	return fetchSecretsFromAWSSecretManager(secretName)
+}
+
+// KeySource is a fetch function, such as FetchSecret or FetchSecretFromAWSSecretManager, used as
+// the crypt.SecretSource of crypt.MakeSecretCryptKeeper.
+type KeySource func(secretName string) (*Secret, error)
+
+// SecretKey returns the version and value of the current version of the secret.
+func (fetch KeySource) SecretKey(secretName string) (string, string, error) {
+	secret, err := fetch(secretName)
+	if err != nil {
+		return "", "", err
 	}
+	version := ""
+	if secret.Version != nil {
+		version = fmt.Sprint(secret.Version)
+	}
+	return version, secret.Value.Reveal(), nil
 }
 
 // determine the secret name the runtime needed based on different service running which DL is attaching to.
@@ -133,17 +240,36 @@ func fetchSecretsFromAWSSecretManager(secretName string) (*Secret, error) {
 
 	log.Println(fmt.Sprintf("Going to fetch the secret of the secretName %#v, from AWS secrets manager", secretName), new(map[string]interface{}))
 
-	svc := secretsmanager.New(sess, aws.NewConfig().WithRegion(helpers.GetAWSRegion()))
+	svc := secretsmanager.New(sess, secretsManagerConfig())
 	input := &secretsmanager.GetSecretValueInput{
 		SecretId:     aws.String(secretName),
-		VersionStage: aws.String("AWSCURRENT"), // VersionStage defaults to AWSCURRENT if unspecified
+		VersionStage: aws.String(VersionStageCurrent), // VersionStage defaults to AWSCURRENT if unspecified
 	}
 
 	result, err := svc.GetSecretValue(input)
 	if err != nil {
 		return nil, err
 	}
+	return parseSecretValue(result)
+}
+
+func parseSecretValue(result *secretsmanager.GetSecretValueOutput) (*Secret, error) {
+	secretString, err := secretValueString(result)
+	if err != nil {
+		return nil, err
+	}
 
+	// Currently secrets on AWS secret manager is in string format. Unmarshal the string to Secret struct.
+	secretObj := Secret{}
+	err = json.Unmarshal([]byte(secretString), &secretObj)
+	if err != nil {
+		log.Println(fmt.Sprintf("error unmarshaling secret: %#v", err), new(map[string]interface{}))
+		return nil, err
+	}
+	return &secretObj, nil
+}
+
+func secretValueString(result *secretsmanager.GetSecretValueOutput) (string, error) {
 	// Decrypts secret using the associated KMS CMK.
 	// Depending on whether the secret is a string or binary, one of these fields will be populated.
 	var secretString string
@@ -155,18 +281,10 @@ func fetchSecretsFromAWSSecretManager(secretName string) (*Secret, error) {
 		len, err := base64.StdEncoding.Decode(decodedBinarySecretBytes, result.SecretBinary)
 		if err != nil {
 			log.Println(fmt.Sprintf("Base64 Decode Error when decode the binary result of secrets getting back from AWS secret manager: %#v", err), new(map[string]interface{}))
-			return nil, err
+			return "", err
 		}
 		decodedBinarySecret = string(decodedBinarySecretBytes[:len])
 		secretString = decodedBinarySecret
 	}
-
-	// Currently secrets on AWS secret manager is in string format. Unmarshal the string to Secret struct.
-	secretObj := Secret{}
-	err = json.Unmarshal([]byte(secretString), &secretObj)
-	if err != nil {
-		log.Println(fmt.Sprintf("error unmarshaling secret: %#v", err), new(map[string]interface{}))
-		return nil, err
-	}
-	return &secretObj, nil
+	return secretString, nil
 }
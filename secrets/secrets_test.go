@@ -45,10 +45,9 @@ func init() {
 }
 
 func TestFetchSecretFile(t *testing.T) {
-	fileChan := make(chan *Secret)
-	go fetchSecretFile("nonexistent.json", fileChan)
-	result := <-fileChan
+	result, err := fetchSecretFile("nonexistent.json")
 	assert.Equal(t, true, result == nil, "should result in nil when file does not exist")
+	assert.NotNil(t, err, "should return the error when file does not exist")
 }
 
 func TestFetchSecrets(t *testing.T) {
@@ -65,6 +64,51 @@ func TestFetchSecrets(t *testing.T) {
 	assert.Equal(t, true, err != nil, "should return an error when secrets direcrtory not mounted")
 }
 
+func TestFetchSecret(t *testing.T) {
+	dir := t.TempDir()
+	defer func(previous string) { SecretsDir = previous }(SecretsDir)
+	SecretsDir = dir
+	write := func(version string) {
+		data := []byte(`{"version": "` + version + `", "name": "ROTATING_KEY", "value": "value-` + version + `"}`)
+		if err := ioutil.WriteFile(path.Join(dir, "rotating.json"), data, 0600); err != nil {
+			panic(err)
+		}
+	}
+	write("1")
+	secret, err := FetchSecret("ROTATING_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "value-1", secret.Value.Reveal())
+
+	write("2")
+	secret, err = FetchSecret("ROTATING_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "value-2", secret.Value.Reveal(), "should read the current version of the secret")
+
+	_, err = FetchSecret("MISSING_KEY")
+	assert.NotNil(t, err, "should return an error when the secret does not exist")
+	ioutil.WriteFile(path.Join(dir, "broken.json"), []byte(`{`), 0600)
+	secret, err = FetchSecret("ROTATING_KEY")
+	assert.Nil(t, err, "should skip files that fail to parse")
+	assert.Equal(t, "value-2", secret.Value.Reveal())
+}
+
+func TestKeySource(t *testing.T) {
+	source := KeySource(func(secretName string) (*Secret, error) {
+		return &Secret{Version: 2.0, Name: secretName, Value: MakeSecretValue("key")}, nil
+	})
+	version, value, err := source.SecretKey("ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", version, "should return the version as a string")
+	assert.Equal(t, "key", value)
+
+	source = func(secretName string) (*Secret, error) {
+		return &Secret{Name: secretName, Value: MakeSecretValue("key")}, nil
+	}
+	version, _, err = source.SecretKey("ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "", version, "should return an empty version for secrets without versions")
+}
+
 func TestGetSecret(t *testing.T) {
 	chance := Chance.New()
 	secret, err := GetSecret("ENCRYPTION_KEY")
@@ -0,0 +1,456 @@
+// Package secretstest provides a stand-in for AWS secrets manager, backed by a directory, for
+// integration tests:
+//
+//	server := secretstest.MakeServer(t.TempDir())
+//	defer server.Close()
+//	secrets.SecretsManagerEndpoint = server.URL
+//
+// The server speaks the JSON protocol of the GetSecretValue, PutSecretValue and ListSecrets
+// operations, so the AWS SDK can be pointed at it with Config or the client from Client.
+// Request signatures are not checked, but the SDK still needs credentials to sign with.
+//
+// Every file in the directory is a secret named by its path-unescaped file name. A file written
+// by hand holds the current secret string; files written by PutSecretValue hold every version.
+package secretstest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+const (
+	Region    = "us-east-1"
+	arnPrefix = "arn:aws:secretsmanager:" + Region + ":000000000000:secret:"
+
+	stageCurrent  = "AWSCURRENT"
+	stagePrevious = "AWSPREVIOUS"
+
+	defaultMaxResults = 100
+)
+
+// apiError is an error in the format of the AWS JSON protocol.
+type apiError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (err *apiError) Error() string {
+	return err.Type + ": " + err.Message
+}
+
+func notFound(name string) *apiError {
+	return &apiError{Type: secretsmanager.ErrCodeResourceNotFoundException, Message: fmt.Sprintf("Secrets Manager can't find the specified secret: %s", name)}
+}
+
+func invalidParameter(message string) *apiError {
+	return &apiError{Type: secretsmanager.ErrCodeInvalidParameterException, Message: message}
+}
+
+type storedVersion struct {
+	VersionId     string
+	VersionStages []string
+	SecretString  *string `json:",omitempty"`
+	SecretBinary  []byte  `json:",omitempty"`
+	CreatedDate   time.Time
+}
+
+func (version *storedVersion) hasStage(stage string) bool {
+	for _, versionStage := range version.VersionStages {
+		if versionStage == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func (version *storedVersion) removeStage(stage string) {
+	stages := []string{}
+	for _, versionStage := range version.VersionStages {
+		if versionStage != stage {
+			stages = append(stages, versionStage)
+		}
+	}
+	version.VersionStages = stages
+}
+
+// storedSecret is the file format of secrets written by PutSecretValue.
+type storedSecret struct {
+	SecretVersions []*storedVersion
+}
+
+func (secret *storedSecret) lastChanged() time.Time {
+	var last time.Time
+	for _, version := range secret.SecretVersions {
+		if version.CreatedDate.After(last) {
+			last = version.CreatedDate
+		}
+	}
+	return last
+}
+
+// The outputs mirror those of the SDK, whose timestamps are encoded as epoch seconds.
+type getSecretValueOutput struct {
+	ARN           string
+	Name          string
+	VersionId     string
+	VersionStages []string
+	SecretString  *string `json:",omitempty"`
+	SecretBinary  []byte  `json:",omitempty"`
+	CreatedDate   float64
+}
+
+type putSecretValueOutput struct {
+	ARN           string
+	Name          string
+	VersionId     string
+	VersionStages []string
+}
+
+type secretListEntry struct {
+	ARN                    string
+	Name                   string
+	LastChangedDate        float64
+	SecretVersionsToStages map[string][]string
+}
+
+type listSecretsOutput struct {
+	SecretList []secretListEntry
+	NextToken  *string `json:",omitempty"`
+}
+
+func epoch(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// Server is a stand-in for AWS secrets manager serving the secrets in Dir.
+type Server struct {
+	Dir string
+	URL string
+
+	mu     sync.Mutex
+	server *httptest.Server
+}
+
+func (server *Server) path(name string) string {
+	return filepath.Join(server.Dir, url.PathEscape(name))
+}
+
+// secretName accepts the name or the ARN of a secret.
+func secretName(secretID string) string {
+	return strings.TrimPrefix(secretID, arnPrefix)
+}
+
+func (server *Server) read(name string) (*storedSecret, error) {
+	path := server.path(name)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, notFound(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal(data, &fields) == nil {
+		if _, ok := fields["SecretVersions"]; ok {
+			secret := &storedSecret{}
+			if err := json.Unmarshal(data, secret); err != nil {
+				return nil, err
+			}
+			return secret, nil
+		}
+	}
+	// A file written by hand holds the current secret string, versioned by its contents.
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	value := string(data)
+	return &storedSecret{SecretVersions: []*storedVersion{{
+		VersionId:     hex.EncodeToString(sum[:16]),
+		VersionStages: []string{stageCurrent},
+		SecretString:  &value,
+		CreatedDate:   info.ModTime(),
+	}}}, nil
+}
+
+func (server *Server) write(name string, secret *storedSecret) error {
+	data, err := json.MarshalIndent(secret, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := server.path(name)
+	tmp, err := ioutil.TempFile(server.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (server *Server) getSecretValue(input *secretsmanager.GetSecretValueInput) (interface{}, error) {
+	name := secretName(aws.StringValue(input.SecretId))
+	secret, err := server.read(name)
+	if err != nil {
+		return nil, err
+	}
+	versionID, stage := aws.StringValue(input.VersionId), aws.StringValue(input.VersionStage)
+	if versionID == "" && stage == "" {
+		stage = stageCurrent
+	}
+	for _, version := range secret.SecretVersions {
+		if (versionID == "" || version.VersionId == versionID) && (stage == "" || version.hasStage(stage)) {
+			return &getSecretValueOutput{
+				ARN:           arnPrefix + name,
+				Name:          name,
+				VersionId:     version.VersionId,
+				VersionStages: version.VersionStages,
+				SecretString:  version.SecretString,
+				SecretBinary:  version.SecretBinary,
+				CreatedDate:   epoch(version.CreatedDate),
+			}, nil
+		}
+	}
+	return nil, &apiError{Type: secretsmanager.ErrCodeResourceNotFoundException, Message: fmt.Sprintf("Secrets Manager can't find the specified secret value for VersionId: %s, VersionStage: %s", versionID, stage)}
+}
+
+func newVersionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (server *Server) putSecretValue(input *secretsmanager.PutSecretValueInput) (interface{}, error) {
+	if (input.SecretString == nil) == (input.SecretBinary == nil) {
+		return nil, invalidParameter("You must provide either SecretString or SecretBinary.")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	name := secretName(aws.StringValue(input.SecretId))
+	secret, err := server.read(name)
+	if err != nil {
+		return nil, err
+	}
+	versionID := aws.StringValue(input.ClientRequestToken)
+	if versionID == "" {
+		if versionID, err = newVersionID(); err != nil {
+			return nil, err
+		}
+	}
+	stages := aws.StringValueSlice(input.VersionStages)
+	if len(stages) == 0 {
+		stages = []string{stageCurrent}
+	}
+	for _, version := range secret.SecretVersions {
+		if version.VersionId == versionID {
+			return nil, &apiError{Type: secretsmanager.ErrCodeResourceExistsException, Message: fmt.Sprintf("A version with VersionId %s already exists.", versionID)}
+		}
+	}
+	added := &storedVersion{
+		VersionId:    versionID,
+		SecretString: input.SecretString,
+		SecretBinary: input.SecretBinary,
+		CreatedDate:  time.Now().UTC(),
+	}
+	for _, stage := range stages {
+		for _, version := range secret.SecretVersions {
+			if !version.hasStage(stage) {
+				continue
+			}
+			version.removeStage(stage)
+			// The version that was current becomes the previous version.
+			if stage == stageCurrent {
+				for _, other := range secret.SecretVersions {
+					other.removeStage(stagePrevious)
+				}
+				version.VersionStages = append(version.VersionStages, stagePrevious)
+			}
+		}
+		added.VersionStages = append(added.VersionStages, stage)
+	}
+	secret.SecretVersions = append([]*storedVersion{added}, secret.SecretVersions...)
+	if err := server.write(name, secret); err != nil {
+		return nil, err
+	}
+	return &putSecretValueOutput{
+		ARN:           arnPrefix + name,
+		Name:          name,
+		VersionId:     versionID,
+		VersionStages: added.VersionStages,
+	}, nil
+}
+
+func (server *Server) listSecrets(input *secretsmanager.ListSecretsInput) (interface{}, error) {
+	files, err := ioutil.ReadDir(server.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []string
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Key) != secretsmanager.FilterNameStringTypeName {
+			return nil, invalidParameter(fmt.Sprintf("unsupported filter key %s", aws.StringValue(filter.Key)))
+		}
+		prefixes = append(prefixes, aws.StringValueSlice(filter.Values)...)
+	}
+	names := []string{}
+	for _, file := range files {
+		name, err := url.PathUnescape(file.Name())
+		if err != nil || file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		if len(prefixes) > 0 && !hasAnyPrefix(name, prefixes) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	start := 0
+	if token := aws.StringValue(input.NextToken); token != "" {
+		if start, err = strconv.Atoi(token); err != nil || start < 0 || start > len(names) {
+			return nil, &apiError{Type: secretsmanager.ErrCodeInvalidNextTokenException, Message: "The NextToken value is invalid."}
+		}
+	}
+	maxResults := int(aws.Int64Value(input.MaxResults))
+	if maxResults <= 0 {
+		maxResults = defaultMaxResults
+	}
+	end := start + maxResults
+	if end > len(names) {
+		end = len(names)
+	}
+	output := &listSecretsOutput{SecretList: []secretListEntry{}}
+	for _, name := range names[start:end] {
+		secret, err := server.read(name)
+		if err != nil {
+			return nil, err
+		}
+		versions := map[string][]string{}
+		for _, version := range secret.SecretVersions {
+			versions[version.VersionId] = version.VersionStages
+		}
+		output.SecretList = append(output.SecretList, secretListEntry{
+			ARN:                    arnPrefix + name,
+			Name:                   name,
+			LastChangedDate:        epoch(secret.lastChanged()),
+			SecretVersionsToStages: versions,
+		})
+	}
+	if end < len(names) {
+		output.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return output, nil
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(writer http.ResponseWriter, status int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(body)
+}
+
+// ServeHTTP handles a request of the AWS JSON protocol, whose operation is named by the
+// X-Amz-Target header.
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	var handle func(decoder *json.Decoder) (interface{}, error)
+	switch request.Header.Get("X-Amz-Target") {
+	case "secretsmanager.GetSecretValue":
+		handle = func(decoder *json.Decoder) (interface{}, error) {
+			input := &secretsmanager.GetSecretValueInput{}
+			if err := decoder.Decode(input); err != nil {
+				return nil, invalidParameter(err.Error())
+			}
+			return server.getSecretValue(input)
+		}
+	case "secretsmanager.PutSecretValue":
+		handle = func(decoder *json.Decoder) (interface{}, error) {
+			input := &secretsmanager.PutSecretValueInput{}
+			if err := decoder.Decode(input); err != nil {
+				return nil, invalidParameter(err.Error())
+			}
+			return server.putSecretValue(input)
+		}
+	case "secretsmanager.ListSecrets":
+		handle = func(decoder *json.Decoder) (interface{}, error) {
+			input := &secretsmanager.ListSecretsInput{}
+			if err := decoder.Decode(input); err != nil {
+				return nil, invalidParameter(err.Error())
+			}
+			return server.listSecrets(input)
+		}
+	default:
+		writeJSON(writer, http.StatusBadRequest, &apiError{Type: "UnknownOperationException", Message: request.Header.Get("X-Amz-Target")})
+		return
+	}
+	output, err := handle(json.NewDecoder(request.Body))
+	if apiErr, ok := err.(*apiError); ok {
+		writeJSON(writer, http.StatusBadRequest, apiErr)
+		return
+	}
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, &apiError{Type: secretsmanager.ErrCodeInternalServiceError, Message: err.Error()})
+		return
+	}
+	writeJSON(writer, http.StatusOK, output)
+}
+
+// Config returns an AWS config pointing at the server, with static credentials.
+func (server *Server) Config() *aws.Config {
+	return aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithRegion(Region).
+		WithCredentials(credentials.NewStaticCredentials("secretstest", "secretstest", ""))
+}
+
+// Client returns a secrets manager client for the server.
+func (server *Server) Client() *secretsmanager.SecretsManager {
+	return secretsmanager.New(session.Must(session.NewSession()), server.Config())
+}
+
+func (server *Server) Close() {
+	server.server.Close()
+}
+
+// MakeServer starts a server for the secrets in dir.
+func MakeServer(dir string) *Server {
+	server := &Server{Dir: dir}
+	server.server = httptest.NewServer(server)
+	server.URL = server.server.URL
+	return server
+}
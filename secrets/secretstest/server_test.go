@@ -0,0 +1,132 @@
+package secretstest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/diptamay/go-commons/secrets"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSecret(dir string, name string, value string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, url.PathEscape(name)), []byte(value), 0600); err != nil {
+		panic(err)
+	}
+}
+
+func TestGetSecretValue(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret(dir, "prod/service.ENCRYPTION_KEY", `{"version": 1, "name": "service.ENCRYPTION_KEY", "value": "key"}`)
+	server := MakeServer(dir)
+	defer server.Close()
+	client := server.Client()
+
+	output, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String("prod/service.ENCRYPTION_KEY")})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"version": 1, "name": "service.ENCRYPTION_KEY", "value": "key"}`, *output.SecretString)
+	assert.Equal(t, []string{"AWSCURRENT"}, aws.StringValueSlice(output.VersionStages))
+	assert.False(t, output.CreatedDate.IsZero())
+
+	byARN, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: output.ARN})
+	assert.Nil(t, err, "should accept the ARN of a secret")
+	assert.Equal(t, *output.VersionId, *byARN.VersionId)
+
+	_, err = client.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String("missing")})
+	var awsErr awserr.Error
+	assert.True(t, errors.As(err, &awsErr))
+	assert.Equal(t, secretsmanager.ErrCodeResourceNotFoundException, awsErr.Code())
+}
+
+func TestPutSecretValue(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret(dir, "service.ENCRYPTION_KEY", `{"version": 1, "name": "service.ENCRYPTION_KEY", "value": "first"}`)
+	server := MakeServer(dir)
+	defer server.Close()
+	client := server.Client()
+
+	put, err := client.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String("service.ENCRYPTION_KEY"),
+		SecretString: aws.String(`{"version": 2, "name": "service.ENCRYPTION_KEY", "value": "second"}`),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"AWSCURRENT"}, aws.StringValueSlice(put.VersionStages))
+
+	_, err = client.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:      aws.String("service.ENCRYPTION_KEY"),
+		SecretString:  aws.String(`{"version": 3, "name": "service.ENCRYPTION_KEY", "value": "third"}`),
+		VersionStages: aws.StringSlice([]string{"AWSPENDING"}),
+	})
+	assert.Nil(t, err)
+
+	provider := secrets.MakeAWSProvider(client)
+	for stage, expected := range map[string]string{"AWSCURRENT": "second", "AWSPREVIOUS": "first", "AWSPENDING": "third"} {
+		secret, err := provider.Fetch(context.Background(), secrets.AWSSecretRequest{Name: "service.ENCRYPTION_KEY", VersionStage: stage})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, secret.Value.Reveal(), "should move stages to the new version for %s", stage)
+	}
+	secret, err := provider.Fetch(context.Background(), secrets.AWSSecretRequest{Name: "service.ENCRYPTION_KEY", VersionID: *put.VersionId})
+	assert.Nil(t, err)
+	assert.Equal(t, "second", secret.Value.Reveal())
+
+	restarted := MakeServer(dir)
+	defer restarted.Close()
+	secret, err = secrets.MakeAWSProvider(restarted.Client()).GetSecret(context.Background(), "service.ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", secret.Value.Reveal(), "should persist versions in the directory")
+
+	_, err = client.PutSecretValue(&secretsmanager.PutSecretValueInput{SecretId: aws.String("missing"), SecretString: aws.String("value")})
+	assert.NotNil(t, err, "should only add versions to existing secrets")
+}
+
+func TestListSecrets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.KEY", "b.KEY", "c.KEY", "other"} {
+		writeSecret(dir, name, "value")
+	}
+	server := MakeServer(dir)
+	defer server.Close()
+	client := server.Client()
+
+	names := []string{}
+	pages := 0
+	err := client.ListSecretsPages(&secretsmanager.ListSecretsInput{MaxResults: aws.Int64(2)}, func(page *secretsmanager.ListSecretsOutput, last bool) bool {
+		pages++
+		for _, entry := range page.SecretList {
+			names = append(names, *entry.Name)
+			assert.Equal(t, 1, len(entry.SecretVersionsToStages))
+		}
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.KEY", "b.KEY", "c.KEY", "other"}, names)
+	assert.Equal(t, 2, pages, "should paginate with MaxResults")
+
+	output, err := client.ListSecrets(&secretsmanager.ListSecretsInput{Filters: []*secretsmanager.Filter{
+		{Key: aws.String("name"), Values: aws.StringSlice([]string{"b.", "c."})},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(output.SecretList), "should filter by name prefix")
+}
+
+func TestGetSecretsFromAWSSecretManager(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret(dir, "fake.ENCRYPTION_KEY", `{"version": 1, "name": "fake.ENCRYPTION_KEY", "value": "from-fake"}`)
+	server := MakeServer(dir)
+	defer server.Close()
+	defer func(previous string) { secrets.SecretsManagerEndpoint = previous }(secrets.SecretsManagerEndpoint)
+	secrets.SecretsManagerEndpoint = server.URL
+	t.Setenv("AWS_ACCESS_KEY_ID", "secretstest")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secretstest")
+	t.Setenv("AWS_REGION", Region)
+
+	secret, err := secrets.GetSecretsFromAWSSecretManager("fake.ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "from-fake", secret.Value.Reveal(), "should point the package functions at the server")
+}
@@ -0,0 +1,159 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/diptamay/go-commons/glogger"
+)
+
+var ErrMissingSecretName = errors.New("secret has no name")
+
+// FileError is the error reading or parsing a secret file.
+type FileError struct {
+	Filename string
+	Err      error
+}
+
+func (err *FileError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Filename, err.Err.Error())
+}
+
+func (err *FileError) Unwrap() error {
+	return err.Err
+}
+
+// DirError lists the files of a secrets directory that could not be read or parsed. The
+// secrets of the other files are loaded regardless.
+type DirError struct {
+	Dir   string
+	Files []*FileError
+}
+
+func (err *DirError) Error() string {
+	files := make([]string, len(err.Files))
+	for i, file := range err.Files {
+		files[i] = file.Error()
+	}
+	return fmt.Sprintf("error reading %d secret files in %s: %s", len(err.Files), err.Dir, strings.Join(files, "; "))
+}
+
+// Store holds the secrets of a secrets directory, read on first use or with Load, and fetches
+// secrets from AWS secret manager if it has an AWS provider. Unlike the package functions it
+// keeps no global state, so a service can use several stores side by side.
+type Store struct {
+	Dir string
+	// AWS, if set, is used by GetAWSSecret, for example a SecretCache of an AWSProvider.
+	AWS SecretProvider
+	// Logger, if set, receives the outcome of loads and fetches.
+	Logger glogger.Logger
+
+	mu      sync.RWMutex
+	secrets map[string]*Secret
+}
+
+func (store *Store) log(level string, message string, indexes map[string]interface{}) {
+	if store.Logger == nil {
+		return
+	}
+	indexes["action"] = "secrets"
+	switch level {
+	case "error":
+		store.Logger.Error(message, indexes)
+	case "warn":
+		store.Logger.Warn(message, indexes)
+	default:
+		store.Logger.Info(message, indexes)
+	}
+}
+
+// Load reads the secrets directory, replacing the secrets read before. If some files can not
+// be read or parsed, the secrets of the others are loaded and a *DirError is returned. If the
+// directory can not be read, the secrets read before are kept.
+func (store *Store) Load(ctx context.Context) error {
+	secrets, fileErrors, err := loadSecretsDir(ctx, store.Dir)
+	if err != nil {
+		store.log("error", fmt.Sprintf("error reading secrets directory: %s", err.Error()), map[string]interface{}{"path": store.Dir})
+		return err
+	}
+	store.mu.Lock()
+	store.secrets = secrets
+	store.mu.Unlock()
+
+	for _, fileError := range fileErrors {
+		store.log("warn", fmt.Sprintf("error reading secret file: %s", fileError.Err.Error()), map[string]interface{}{"path": store.Dir, "filename": fileError.Filename})
+	}
+	store.log("info", fmt.Sprintf("loaded %d secrets", len(secrets)), map[string]interface{}{"path": store.Dir})
+	if len(fileErrors) > 0 {
+		return &DirError{Dir: store.Dir, Files: fileErrors}
+	}
+	return nil
+}
+
+// ensureLoaded reads the secrets directory on first use. Files that fail to parse are only
+// reported by Load.
+func (store *Store) ensureLoaded(ctx context.Context) error {
+	store.mu.RLock()
+	loaded := store.secrets != nil
+	store.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	var dirError *DirError
+	if err := store.Load(ctx); err != nil && !errors.As(err, &dirError) {
+		return err
+	}
+	return nil
+}
+
+// GetSecret returns the secret from the secrets directory, reading the directory on first use.
+func (store *Store) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	if err := store.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if secret, ok := store.secrets[secretName]; ok {
+		return copySecret(secret), nil
+	}
+	return nil, secretNotFound(secretName)
+}
+
+// Secrets returns all secrets of the secrets directory, reading the directory on first use.
+func (store *Store) Secrets(ctx context.Context) (map[string]*Secret, error) {
+	if err := store.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	secrets := make(map[string]*Secret, len(store.secrets))
+	for name, secret := range store.secrets {
+		secrets[name] = copySecret(secret)
+	}
+	return secrets, nil
+}
+
+// GetAWSSecret fetches the secret from the AWS provider of the store.
+func (store *Store) GetAWSSecret(ctx context.Context, secretName string) (*Secret, error) {
+	if store.AWS == nil {
+		return nil, fmt.Errorf("store has no AWS provider to fetch secret %#v", secretName)
+	}
+	secret, err := store.AWS.GetSecret(ctx, secretName)
+	if err != nil {
+		store.log("error", fmt.Sprintf("error fetching secret from AWS secrets manager: %s", err.Error()), map[string]interface{}{"name": secretName})
+		return nil, err
+	}
+	return secret, nil
+}
+
+// MakeStore creates a store for the secrets in dir, or in SecretsDir when dir is empty. aws and
+// logger may be nil.
+func MakeStore(dir string, aws SecretProvider, logger glogger.Logger) *Store {
+	if dir == "" {
+		dir = SecretsDir
+	}
+	return &Store{Dir: dir, AWS: aws, Logger: logger}
+}
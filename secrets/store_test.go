@@ -0,0 +1,93 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/diptamay/go-commons/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func makeStoreDir(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"good.json":    `{"version": "1", "name": "GOOD_KEY", "value": "good"}`,
+		"broken.json":  `{"version": `,
+		"unnamed.json": `{"version": "1", "value": "unnamed"}`,
+		"another.json": `{"version": "2", "name": "ANOTHER_KEY", "value": "another"}`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0600); err != nil {
+			panic(err)
+		}
+	}
+	return dir
+}
+
+func TestStoreLoad(t *testing.T) {
+	dir := makeStoreDir(t)
+	logger := &mocks.MockLogger{}
+	logger.On("Warn", mock.Anything, mock.Anything).Return()
+	logger.On("Info", mock.Anything, mock.Anything).Return()
+	store := MakeStore(dir, nil, logger)
+
+	err := store.Load(context.Background())
+	var dirError *DirError
+	assert.True(t, errors.As(err, &dirError), "should return a DirError when files fail to parse")
+	assert.Equal(t, dir, dirError.Dir)
+	assert.Equal(t, 2, len(dirError.Files))
+	assert.Equal(t, "broken.json", dirError.Files[0].Filename)
+	assert.Equal(t, "unnamed.json", dirError.Files[1].Filename)
+	assert.True(t, errors.Is(dirError.Files[1], ErrMissingSecretName))
+	assert.Contains(t, err.Error(), "broken.json")
+
+	secrets, err := store.Secrets(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(secrets), "should load the secrets of the other files")
+	assert.Equal(t, "good", secrets["GOOD_KEY"].Value.Reveal())
+
+	logger.AssertCalled(t, "Warn", mock.Anything, map[string]interface{}{"action": "secrets", "path": dir, "filename": "broken.json"})
+	logger.AssertCalled(t, "Info", "loaded 2 secrets", map[string]interface{}{"action": "secrets", "path": dir})
+}
+
+func TestStoreGetSecret(t *testing.T) {
+	store := MakeStore(makeStoreDir(t), nil, nil)
+	secret, err := store.GetSecret(context.Background(), "ANOTHER_KEY")
+	assert.Nil(t, err, "should load the directory on first use despite broken files")
+	assert.Equal(t, "another", secret.Value.Reveal())
+
+	_, err = store.GetSecret(context.Background(), "MISSING_KEY")
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+
+	missing := MakeStore(path.Join(t.TempDir(), "missing"), nil, nil)
+	_, err = missing.GetSecret(context.Background(), "ANOTHER_KEY")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrSecretNotFound), "should fail when the directory is not mounted")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = MakeStore(makeStoreDir(t), nil, nil).GetSecret(ctx, "GOOD_KEY")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestStoreGetAWSSecret(t *testing.T) {
+	logger := &mocks.MockLogger{}
+	logger.On("Error", mock.Anything, mock.Anything).Return()
+	aws := MakeMemoryProvider(Secret{Name: "service.ENCRYPTION_KEY", Value: MakeSecretValue("aws")})
+	store := MakeStore(t.TempDir(), aws, logger)
+
+	secret, err := store.GetAWSSecret(context.Background(), "service.ENCRYPTION_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "aws", secret.Value.Reveal())
+
+	_, err = store.GetAWSSecret(context.Background(), "other.ENCRYPTION_KEY")
+	assert.True(t, errors.Is(err, ErrSecretNotFound))
+	logger.AssertCalled(t, "Error", mock.Anything, map[string]interface{}{"action": "secrets", "name": "other.ENCRYPTION_KEY"})
+
+	_, err = MakeStore(t.TempDir(), nil, nil).GetAWSSecret(context.Background(), "service.ENCRYPTION_KEY")
+	assert.NotNil(t, err, "should fail without an AWS provider")
+}
@@ -0,0 +1,102 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted is written in place of secret values by String, GoString, MarshalJSON and loggers.
+const Redacted = "[REDACTED]"
+
+// SecretValue holds the plaintext of a secret. It formats, marshals and logs as Redacted, so
+// that printing or logging a Secret does not leak it; the plaintext is only available through
+// Reveal. Copies of a SecretValue share their bytes, and Zero overwrites them for all copies.
+type SecretValue struct {
+	bytes []byte
+}
+
+// Reveal returns the plaintext. The returned string is a copy that Zero can not overwrite, so
+// callers should keep it no longer than needed.
+func (value SecretValue) Reveal() string {
+	return string(value.bytes)
+}
+
+// RevealBytes returns a copy of the plaintext.
+func (value SecretValue) RevealBytes() []byte {
+	return append([]byte(nil), value.bytes...)
+}
+
+func (value SecretValue) Len() int {
+	return len(value.bytes)
+}
+
+// Zero overwrites the plaintext with zeros. The value reveals only zero bytes afterwards.
+func (value SecretValue) Zero() {
+	for i := range value.bytes {
+		value.bytes[i] = 0
+	}
+}
+
+func (value SecretValue) String() string {
+	return Redacted
+}
+
+func (value SecretValue) GoString() string {
+	return fmt.Sprintf("secrets.SecretValue(%q)", Redacted)
+}
+
+// Format redacts the value for every verb, including those fmt does not use String for.
+func (value SecretValue) Format(state fmt.State, verb rune) {
+	if verb == 'v' && state.Flag('#') {
+		io.WriteString(state, value.GoString())
+		return
+	}
+	io.WriteString(state, Redacted)
+}
+
+// MarshalJSON writes Redacted. Use Secret.RevealJSON to marshal the plaintext.
+func (value SecretValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Redacted)
+}
+
+func (value *SecretValue) UnmarshalJSON(data []byte) error {
+	var plain string
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	value.bytes = []byte(plain)
+	return nil
+}
+
+// MakeSecretValue creates a value holding plain.
+func MakeSecretValue(plain string) SecretValue {
+	return SecretValue{bytes: []byte(plain)}
+}
+
+// MarshalLogObject logs the secret with its value redacted.
+func (secret Secret) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
+	encoder.AddString("name", secret.Name)
+	if err := encoder.AddReflected("version", secret.Version); err != nil {
+		return err
+	}
+	encoder.AddString("value", Redacted)
+	return nil
+}
+
+// RevealJSON marshals the secret with its plaintext value, in the format of the secret files,
+// for callers that cache or persist secrets. json.Unmarshal reads it back into a Secret.
+func (secret *Secret) RevealJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Version interface{} `json:"version"`
+		Name    string      `json:"name"`
+		Value   string      `json:"value"`
+	}{secret.Version, secret.Name, secret.Value.Reveal()})
+}
+
+// Zero overwrites the value of the secret with zeros.
+func (secret *Secret) Zero() {
+	secret.Value.Zero()
+}
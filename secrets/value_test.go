@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSecretValueRedaction(t *testing.T) {
+	secret := &Secret{Version: "1", Name: "KEY", Value: MakeSecretValue("hunter2")}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%d"} {
+		assert.NotContains(t, fmt.Sprintf(format, secret), "hunter2", "should redact %s", format)
+		assert.NotContains(t, fmt.Sprintf(format, *secret), "hunter2", "should redact %s", format)
+		assert.NotContains(t, fmt.Sprintf(format, secret.Value), "hunter2", "should redact %s", format)
+	}
+	assert.Equal(t, Redacted, secret.Value.String())
+	assert.Equal(t, `secrets.SecretValue("[REDACTED]")`, fmt.Sprintf("%#v", secret.Value))
+
+	marshaled, err := json.Marshal(secret)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"version": "1", "name": "KEY", "value": "[REDACTED]"}`, string(marshaled))
+
+	assert.Equal(t, "hunter2", secret.Value.Reveal(), "should reveal the plaintext explicitly")
+	assert.Equal(t, []byte("hunter2"), secret.Value.RevealBytes())
+	assert.Equal(t, 7, secret.Value.Len())
+}
+
+func TestSecretValueUnmarshal(t *testing.T) {
+	secret := &Secret{}
+	err := json.Unmarshal([]byte(`{"version": 1, "name": "KEY", "value": "hunter2"}`), secret)
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", secret.Value.Reveal())
+
+	err = json.Unmarshal([]byte(`{"value": 42}`), secret)
+	assert.NotNil(t, err, "should only accept string values")
+}
+
+func TestSecretRevealJSON(t *testing.T) {
+	secret := &Secret{Version: "1", Name: "KEY", Value: MakeSecretValue("hunter2")}
+	revealed, err := secret.RevealJSON()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"version": "1", "name": "KEY", "value": "hunter2"}`, string(revealed))
+
+	restored := &Secret{}
+	assert.Nil(t, json.Unmarshal(revealed, restored))
+	assert.Equal(t, "hunter2", restored.Value.Reveal(), "should round trip the plaintext")
+	assert.Equal(t, secret.Name, restored.Name)
+}
+
+func TestSecretValueZero(t *testing.T) {
+	value := MakeSecretValue("hunter2")
+	copied := value
+	revealed := value.RevealBytes()
+	value.Zero()
+	assert.Equal(t, string(make([]byte, 7)), value.Reveal(), "should overwrite the plaintext")
+	assert.Equal(t, string(make([]byte, 7)), copied.Reveal(), "should overwrite the plaintext of copies")
+	assert.Equal(t, []byte("hunter2"), revealed, "should not overwrite revealed bytes")
+
+	secret := &Secret{Value: MakeSecretValue("hunter2")}
+	cached := copySecret(secret)
+	secret.Zero()
+	assert.Equal(t, "hunter2", cached.Value.Reveal(), "should not zero secrets copied by providers")
+}
+
+func TestSecretValueZap(t *testing.T) {
+	var output bytes.Buffer
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&output), zap.InfoLevel)
+	logger := zap.New(core)
+	secret := Secret{Version: "1", Name: "KEY", Value: MakeSecretValue("hunter2")}
+	logger.Info("loaded", zap.Object("secret", secret), zap.Any("value", secret.Value), zap.Any("reflected", &secret))
+	logger.Sync()
+	assert.NotContains(t, output.String(), "hunter2", "should redact secrets in zap logs")
+	assert.Contains(t, output.String(), `"name":"KEY"`)
+	assert.Contains(t, output.String(), Redacted)
+}
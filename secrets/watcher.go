@@ -0,0 +1,255 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	DefaultPollInterval = 10 * time.Second
+	// watchDebounce groups the events of a single update, such as the several renames of a
+	// kubernetes symlink swap, into one reload.
+	watchDebounce = 100 * time.Millisecond
+)
+
+type SecretEventType int
+
+const (
+	SecretAdded SecretEventType = iota
+	SecretChanged
+	SecretRemoved
+)
+
+func (eventType SecretEventType) String() string {
+	switch eventType {
+	case SecretAdded:
+		return "added"
+	case SecretChanged:
+		return "changed"
+	case SecretRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("SecretEventType(%d)", int(eventType))
+}
+
+// SecretEvent reports a change to a secret of a watched directory. Secret is the current
+// secret, or the removed one for SecretRemoved. Previous is the secret a changed secret replaced.
+type SecretEvent struct {
+	Type     SecretEventType
+	Secret   *Secret
+	Previous *Secret
+}
+
+// Watcher keeps the secrets of a directory up to date as their files change, and notifies
+// subscribers of every change. It watches the directory with inotify where available and polls
+// it otherwise. Watching the directory itself, rather than its files, catches both files
+// rewritten in place and the ..data symlink swap kubernetes uses to update mounted secrets.
+type Watcher struct {
+	Dir string
+	// PollInterval is how often the directory is read when inotify is not available.
+	PollInterval time.Duration
+
+	mu          sync.RWMutex
+	secrets     map[string]*Secret
+	files       map[string]string // secret names by filename
+	subscribers map[int]func(SecretEvent)
+	nextID      int
+	// reloading serializes reloads so that events are emitted in order.
+	reloading    sync.Mutex
+	forcePolling bool
+}
+
+// GetSecret returns the secret as of the last reload.
+func (watcher *Watcher) GetSecret(ctx context.Context, secretName string) (*Secret, error) {
+	watcher.mu.RLock()
+	defer watcher.mu.RUnlock()
+	if secret, ok := watcher.secrets[secretName]; ok {
+		return copySecret(secret), nil
+	}
+	return nil, secretNotFound(secretName)
+}
+
+// Subscribe registers handler to be called with every change to the secrets, and returns a
+// function that unregisters it. Handlers are called from the goroutine reloading the directory.
+func (watcher *Watcher) Subscribe(handler func(SecretEvent)) func() {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	id := watcher.nextID
+	watcher.nextID++
+	watcher.subscribers[id] = handler
+	return func() {
+		watcher.mu.Lock()
+		defer watcher.mu.Unlock()
+		delete(watcher.subscribers, id)
+	}
+}
+
+// Reload reads the directory again and notifies subscribers of the secrets that were added,
+// changed or removed. If the directory can not be read, the current secrets are kept. Files
+// that can not be read or parsed, such as files being rewritten, keep their current secret and
+// are returned in a *DirError.
+func (watcher *Watcher) Reload() error {
+	watcher.reloading.Lock()
+	defer watcher.reloading.Unlock()
+	secretFiles, fileErrors, err := readSecretFiles(context.Background(), watcher.Dir)
+	if err != nil {
+		return err
+	}
+
+	watcher.mu.Lock()
+	secrets := make(map[string]*Secret, len(secretFiles))
+	files := make(map[string]string, len(secretFiles))
+	for filename, secret := range secretFiles {
+		secrets[secret.Name] = secret
+		files[filename] = secret.Name
+	}
+	for _, fileError := range fileErrors {
+		name, ok := watcher.files[fileError.Filename]
+		if _, replaced := secrets[name]; !ok || replaced {
+			continue
+		}
+		if previous, ok := watcher.secrets[name]; ok {
+			secrets[name] = previous
+			files[fileError.Filename] = name
+		}
+	}
+	var events []SecretEvent
+	for name, secret := range secrets {
+		previous, ok := watcher.secrets[name]
+		if !ok {
+			events = append(events, SecretEvent{Type: SecretAdded, Secret: secret})
+		} else if !reflect.DeepEqual(previous, secret) {
+			events = append(events, SecretEvent{Type: SecretChanged, Secret: secret, Previous: previous})
+		}
+	}
+	for name, previous := range watcher.secrets {
+		if _, ok := secrets[name]; !ok {
+			events = append(events, SecretEvent{Type: SecretRemoved, Secret: previous})
+		}
+	}
+	watcher.secrets = secrets
+	watcher.files = files
+	handlers := make([]func(SecretEvent), 0, len(watcher.subscribers))
+	for _, handler := range watcher.subscribers {
+		handlers = append(handlers, handler)
+	}
+	watcher.mu.Unlock()
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Secret.Name < events[j].Secret.Name })
+	for _, event := range events {
+		for _, handler := range handlers {
+			handler(SecretEvent{Type: event.Type, Secret: copySecret(event.Secret), Previous: copyOptionalSecret(event.Previous)})
+		}
+	}
+	if len(fileErrors) > 0 {
+		return &DirError{Dir: watcher.Dir, Files: fileErrors}
+	}
+	return nil
+}
+
+func copyOptionalSecret(secret *Secret) *Secret {
+	if secret == nil {
+		return nil
+	}
+	return copySecret(secret)
+}
+
+// Watch reloads the directory whenever it changes until ctx is done. Errors watching or reading
+// the directory are passed to onError, if not nil, and the current secrets stay in use.
+func (watcher *Watcher) Watch(ctx context.Context, onError func(error)) {
+	report := func(err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	var notifier *fsnotify.Watcher
+	if !watcher.forcePolling {
+		var err error
+		notifier, err = fsnotify.NewWatcher()
+		if err == nil {
+			if err = notifier.Add(watcher.Dir); err != nil {
+				notifier.Close()
+				notifier = nil
+			}
+		}
+		if err != nil {
+			report(fmt.Errorf("error watching secrets directory %s, polling it instead: %w", watcher.Dir, err))
+		}
+	}
+	if notifier == nil {
+		go watcher.poll(ctx, report)
+		return
+	}
+	go func() {
+		defer notifier.Close()
+		debounce := time.NewTimer(watchDebounce)
+		debounce.Stop()
+		defer debounce.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-notifier.Events:
+				if !ok {
+					return
+				}
+				debounce.Reset(watchDebounce)
+			case err, ok := <-notifier.Errors:
+				if !ok {
+					return
+				}
+				report(err)
+			case <-debounce.C:
+				report(watcher.Reload())
+			}
+		}
+	}()
+}
+
+func (watcher *Watcher) poll(ctx context.Context, report func(error)) {
+	interval := watcher.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report(watcher.Reload())
+		}
+	}
+}
+
+// MakeWatcher creates a watcher for the secrets in dir, or in SecretsDir when dir is empty, and
+// reads them. Call Watch to keep them up to date. If some files can not be read or parsed, the
+// watcher is returned with a *DirError, holding the secrets of the other files.
+func MakeWatcher(dir string) (*Watcher, error) {
+	if dir == "" {
+		dir = SecretsDir
+	}
+	watcher := &Watcher{
+		Dir:          dir,
+		PollInterval: DefaultPollInterval,
+		secrets:      map[string]*Secret{},
+		files:        map[string]string{},
+		subscribers:  map[int]func(SecretEvent){},
+	}
+	if err := watcher.Reload(); err != nil {
+		var dirError *DirError
+		if errors.As(err, &dirError) {
+			return watcher, err
+		}
+		return nil, err
+	}
+	return watcher, nil
+}
@@ -0,0 +1,166 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSecretFile(dir string, filename string, version string, value string) {
+	data := []byte(`{"version": "` + version + `", "name": "WATCHED_KEY", "value": "` + value + `"}`)
+	if err := ioutil.WriteFile(path.Join(dir, filename), data, 0600); err != nil {
+		panic(err)
+	}
+}
+
+// mountSecret lays out dir like a kubernetes secret volume, with key.json a symlink through
+// ..data into a timestamped directory, and swaps ..data atomically on every call.
+func mountSecret(dir string, revision string, version string, value string) {
+	revisionDir := path.Join(dir, "..revision_"+revision)
+	if err := os.Mkdir(revisionDir, 0700); err != nil {
+		panic(err)
+	}
+	writeSecretFile(revisionDir, "key.json", version, value)
+	if err := os.Symlink("..revision_"+revision, path.Join(dir, "..data_tmp")); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(path.Join(dir, "..data_tmp"), path.Join(dir, "..data")); err != nil {
+		panic(err)
+	}
+	if _, err := os.Lstat(path.Join(dir, "key.json")); os.IsNotExist(err) {
+		if err := os.Symlink("..data/key.json", path.Join(dir, "key.json")); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func watchEvents(t *testing.T, watcher *Watcher) chan SecretEvent {
+	events := make(chan SecretEvent, 10)
+	watcher.Subscribe(func(event SecretEvent) { events <- event })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	watcher.Watch(ctx, func(err error) { t.Log(err) })
+	return events
+}
+
+func nextEvent(t *testing.T, events chan SecretEvent) SecretEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("should emit an event for the change")
+	}
+	return SecretEvent{}
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	writeSecretFile(dir, "key.json", "1", "one")
+	watcher, err := MakeWatcher(dir)
+	assert.Nil(t, err)
+	secret, err := watcher.GetSecret(context.Background(), "WATCHED_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "one", secret.Value.Reveal())
+
+	var events []SecretEvent
+	watcher.Subscribe(func(event SecretEvent) { events = append(events, event) })
+	assert.Nil(t, watcher.Reload())
+	assert.Empty(t, events, "should not emit events when nothing changed")
+
+	writeSecretFile(dir, "key.json", "2", "two")
+	assert.Nil(t, watcher.Reload())
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, SecretChanged, events[0].Type)
+	assert.Equal(t, "one", events[0].Previous.Value.Reveal())
+	assert.Equal(t, "two", events[0].Secret.Value.Reveal())
+
+	os.Remove(path.Join(dir, "key.json"))
+	assert.Nil(t, watcher.Reload())
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, SecretRemoved, events[1].Type)
+	_, err = watcher.GetSecret(context.Background(), "WATCHED_KEY")
+	assert.NotNil(t, err, "should forget removed secrets")
+
+	os.RemoveAll(dir)
+	assert.NotNil(t, watcher.Reload(), "should fail when the directory is gone")
+
+	_, err = MakeWatcher(dir)
+	assert.NotNil(t, err)
+}
+
+func TestWatcherKeepsUnparsedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeSecretFile(dir, "key.json", "1", "one")
+	watcher, err := MakeWatcher(dir)
+	assert.Nil(t, err)
+	var events []SecretEvent
+	watcher.Subscribe(func(event SecretEvent) { events = append(events, event) })
+
+	ioutil.WriteFile(path.Join(dir, "key.json"), []byte(`{"version": "2", "na`), 0600)
+	err = watcher.Reload()
+	var dirError *DirError
+	assert.True(t, errors.As(err, &dirError), "should return the files that fail to parse")
+	assert.Empty(t, events, "should not remove the secret of a file being rewritten")
+	secret, err := watcher.GetSecret(context.Background(), "WATCHED_KEY")
+	assert.Nil(t, err)
+	assert.Equal(t, "one", secret.Value.Reveal(), "should keep the previous secret")
+
+	writeSecretFile(dir, "key.json", "2", "two")
+	assert.Nil(t, watcher.Reload())
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, SecretChanged, events[0].Type)
+
+	ioutil.WriteFile(path.Join(dir, "other.json"), []byte(`{`), 0600)
+	watcher, err = MakeWatcher(dir)
+	assert.True(t, errors.As(err, &dirError))
+	assert.NotNil(t, watcher, "should return the watcher with the secrets of the other files")
+}
+
+func TestWatcherNotify(t *testing.T) {
+	dir := t.TempDir()
+	writeSecretFile(dir, "key.json", "1", "one")
+	watcher, err := MakeWatcher(dir)
+	assert.Nil(t, err)
+	events := watchEvents(t, watcher)
+
+	writeSecretFile(dir, "key.json", "2", "two")
+	event := nextEvent(t, events)
+	assert.Equal(t, SecretChanged, event.Type, "should reload files rewritten in place")
+	assert.Equal(t, "two", event.Secret.Value.Reveal())
+}
+
+func TestWatcherSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	mountSecret(dir, "1", "1", "one")
+	watcher, err := MakeWatcher(dir)
+	assert.Nil(t, err)
+	secret, err := watcher.GetSecret(context.Background(), "WATCHED_KEY")
+	assert.Nil(t, err, "should read secrets mounted through ..data")
+	assert.Equal(t, "one", secret.Value.Reveal())
+	events := watchEvents(t, watcher)
+
+	mountSecret(dir, "2", "2", "two")
+	event := nextEvent(t, events)
+	assert.Equal(t, SecretChanged, event.Type, "should reload secrets when ..data is swapped")
+	assert.Equal(t, "two", event.Secret.Value.Reveal())
+}
+
+func TestWatcherPolling(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := MakeWatcher(dir)
+	assert.Nil(t, err)
+	watcher.forcePolling = true
+	watcher.PollInterval = 10 * time.Millisecond
+	events := watchEvents(t, watcher)
+
+	writeSecretFile(dir, "key.json", "1", "one")
+	event := nextEvent(t, events)
+	assert.Equal(t, SecretAdded, event.Type)
+	assert.Equal(t, "one", event.Secret.Value.Reveal())
+}